@@ -0,0 +1,25 @@
+package torOnion
+
+import "net"
+
+// WithAcceptFilter has filter decide whether a connection accepted by
+// the listener is handed to the application. Inbound onion connections
+// all come from tor on the loopback interface, so they cannot be told
+// apart by address, but filter may for instance exchange an
+// application-level token over the raw connection before the upgrade
+// to a secure channel. A connection for which filter returns an error
+// is closed and Accept waits for the next one. Without a filter every
+// connection is accepted.
+func WithAcceptFilter(filter func(conn net.Conn) error) ListenOption {
+	return func(c *listenConfig) {
+		c.acceptFilter = filter
+	}
+}
+
+// runFilter runs the listener's accept filter on conn, if any
+func (l *OnionListener) runFilter(conn net.Conn) error {
+	if l.filter == nil {
+		return nil
+	}
+	return l.filter(conn)
+}
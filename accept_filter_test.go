@@ -0,0 +1,62 @@
+package torOnion
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+func TestAcceptFilter(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	// admit connections presenting the token "y"
+	filter := func(conn net.Conn) error {
+		token := make([]byte, 1)
+		if _, err := io.ReadFull(conn, token); err != nil {
+			return err
+		}
+		if token[0] != 'y' {
+			return errors.New("bad token")
+		}
+		return nil
+	}
+	l, err := transport.ListenEphemeralV3(4003, WithAcceptFilter(filter), WithMaxConns(1, LimitReject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ch := acceptAsync(l)
+	rejected := dialListener(t, l)
+	if _, err := rejected.Write([]byte("n")); err != nil {
+		t.Fatal(err)
+	}
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the rejected connection to be closed, got %v", err)
+	}
+	select {
+	case <-ch:
+		t.Fatal("rejected connection was accepted")
+	default:
+	}
+
+	// the rejected connection does not hold a slot
+	accepted := dialListener(t, l)
+	if _, err := accepted.Write([]byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-ch:
+		if conn == nil {
+			t.Fatal("Accept failed")
+		}
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection with a valid token not accepted")
+	}
+}
@@ -0,0 +1,101 @@
+package torOnion
+
+import (
+	"net"
+	"sync"
+)
+
+// WithAcceptQueue makes the listener accept connections in the
+// background rather than in Accept, so that the streams tor delivers
+// are taken off the socket backlog, where they would eventually be
+// reset, even while the application is slow to call Accept. Up to
+// workers connections at once are admitted under WithMaxConns and run
+// through the accept filter, and up to size upgraded connections wait
+// for Accept, which returns them in the order they became ready. Once
+// the queue is full accepting pauses until Accept catches up. When the
+// listener is closed the connections still queued are closed.
+func WithAcceptQueue(size, workers int) ListenOption {
+	return func(c *listenConfig) {
+		c.queueSize = size
+		c.queueWorkers = workers
+	}
+}
+
+// acceptQueue holds the connections accepted in the background
+type acceptQueue struct {
+	// ready is closed once the listener stopped accepting and all
+	// workers are done, err then holds the reason accepting stopped
+	ready chan *OnionConn
+	err   error
+}
+
+// startAcceptQueue starts accepting in the background if WithAcceptQueue
+// was given, with one goroutine pulling connections off the listener
+// and handing them to workers goroutines for upgrading
+func (l *OnionListener) startAcceptQueue(size, workers int) {
+	if workers <= 0 {
+		return
+	}
+	if size < 0 {
+		size = 0
+	}
+	q := &acceptQueue{ready: make(chan *OnionConn, size)}
+	l.queue = q
+	raw := make(chan net.Conn)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for conn := range raw {
+				onionConn := l.upgrade(conn)
+				if onionConn == nil {
+					// frees the slot taken for it under LimitBlock
+					l.limiter.abandon()
+					continue
+				}
+				q.ready <- onionConn
+			}
+		}()
+	}
+	go func() {
+		q.err = l.pull(raw)
+		close(raw)
+		wg.Wait()
+		close(q.ready)
+	}()
+}
+
+// pull hands connections accepted from the local listener to the
+// workers until accepting fails
+func (l *OnionListener) pull(raw chan<- net.Conn) error {
+	for {
+		if !l.limiter.wait() {
+			return errListenerClosed
+		}
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.limiter.abandon()
+			return err
+		}
+		raw <- conn
+	}
+}
+
+// accept returns the next queued connection, or once the listener
+// stopped accepting the reason why
+func (q *acceptQueue) accept() (*OnionConn, error) {
+	conn, ok := <-q.ready
+	if !ok {
+		return nil, q.err
+	}
+	return conn, nil
+}
+
+// drain closes the queued connections until the workers are done. It
+// must be called after the local listener was closed.
+func (q *acceptQueue) drain() {
+	for conn := range q.ready {
+		conn.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package torOnion
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+// waitQueued waits until n upgraded connections wait in l's queue
+func waitQueued(t *testing.T, l *OnionListener, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(l.queue.ready) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections queued, expected %d", len(l.queue.ready), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAcceptQueue(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	// a slow upgrade, upgrading the burst one at a time would take 3s
+	upgradeDelay := 200 * time.Millisecond
+	filter := func(conn net.Conn) error {
+		time.Sleep(upgradeDelay)
+		_, err := io.ReadFull(conn, make([]byte, 1))
+		return err
+	}
+	const burst = 15
+	l, err := transport.ListenEphemeralV3(4003, WithAcceptFilter(filter), WithAcceptQueue(burst, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the burst arrives while the application is not calling Accept
+	start := time.Now()
+	for i := 0; i < burst; i++ {
+		client := dialListener(t, l)
+		if _, err := client.Write([]byte("y")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitQueued(t, l, burst)
+	if elapsed := time.Since(start); elapsed > burst*upgradeDelay/2 {
+		t.Fatalf("upgrading the burst took %s, upgrades are not concurrent", elapsed)
+	}
+	for i := 0; i < burst; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	// connections still queued when the listener closes are closed
+	var pending []net.Conn
+	for i := 0; i < 3; i++ {
+		client := dialListener(t, l)
+		if _, err := client.Write([]byte("y")); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, client)
+	}
+	waitQueued(t, l, len(pending))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range pending {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected the queued connection to be closed, got %v", err)
+		}
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("Accept succeeded on a closed listener")
+	}
+	if n := len(transport.conns); n != 0 {
+		t.Fatalf("%d queued connections still tracked", n)
+	}
+}
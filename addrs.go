@@ -0,0 +1,77 @@
+package torOnion
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var errNoDialableAddr = errors.New("no dialable address")
+
+// OnionAddr is the net.Addr of an onion service, which has no IP
+// address
+type OnionAddr struct {
+	// ServiceID is the onion address without the ".onion" suffix
+	ServiceID string
+	// Port is the virtual port of the service
+	Port uint16
+}
+
+// Network returns "onion"
+func (a *OnionAddr) Network() string {
+	return "onion"
+}
+
+// String returns the address in host:port form, for instance
+// erhkddypoy6qml6h.onion:4003
+func (a *OnionAddr) String() string {
+	return net.JoinHostPort(a.ServiceID+".onion", strconv.Itoa(int(a.Port)))
+}
+
+// AddrPreference selects which kind of address is dialed first when a
+// peer advertises both onion and TCP addresses
+type AddrPreference int
+
+const (
+	// PreferOnion dials onion addresses first, keeping the location of
+	// both ends hidden. This is the default.
+	PreferOnion AddrPreference = iota
+	// PreferTCP dials TCP addresses, which tor reaches through an exit
+	// relay, first. These connect faster over shorter circuits but
+	// reveal the peer's address to the exit.
+	PreferTCP
+)
+
+// DialableAddrs returns the addresses among addrs the transport can
+// dial ordered according to pref, keeping the given order among
+// addresses of the same kind. TCP addresses are left out when the
+// transport only dials onion addresses.
+func (t *OnionTransport) DialableAddrs(addrs []ma.Multiaddr, pref AddrPreference) []ma.Multiaddr {
+	var dialable []ma.Multiaddr
+	for _, a := range addrs {
+		if t.CanDial(a) {
+			dialable = append(dialable, a)
+		}
+	}
+	sort.SliceStable(dialable, func(i, j int) bool {
+		onionI, onionJ := IsValidOnionMultiAddr(dialable[i]), IsValidOnionMultiAddr(dialable[j])
+		if pref == PreferTCP {
+			return !onionI && onionJ
+		}
+		return onionI && !onionJ
+	})
+	return dialable
+}
+
+// BestDialAddr returns the address among addrs to dial first according
+// to pref, failing if the transport can dial none of them
+func (t *OnionTransport) BestDialAddr(addrs []ma.Multiaddr, pref AddrPreference) (ma.Multiaddr, error) {
+	dialable := t.DialableAddrs(addrs, pref)
+	if len(dialable) == 0 {
+		return nil, errNoDialableAddr
+	}
+	return dialable[0], nil
+}
@@ -0,0 +1,59 @@
+package torOnion
+
+import (
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDialableAddrs(t *testing.T) {
+	var addrs []ma.Multiaddr
+	for _, s := range []string{
+		"/ip4/1.2.3.4/tcp/4001",
+		"/onion/erhkddypoy6qml6h:4003",
+		"/ip4/1.2.3.4/udp/4001",
+		"/ip6/::1/tcp/4001",
+		"/onion3/vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd:1234",
+	} {
+		a, err := ma.NewMultiaddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, a)
+	}
+	tcp4, onion, tcp6, onion3 := addrs[0], addrs[1], addrs[3], addrs[4]
+
+	for _, tc := range []struct {
+		onlyOnion bool
+		pref      AddrPreference
+		want      []ma.Multiaddr
+	}{
+		{false, PreferOnion, []ma.Multiaddr{onion, onion3, tcp4, tcp6}},
+		{false, PreferTCP, []ma.Multiaddr{tcp4, tcp6, onion, onion3}},
+		{true, PreferOnion, []ma.Multiaddr{onion, onion3}},
+		{true, PreferTCP, []ma.Multiaddr{onion, onion3}},
+	} {
+		tpt := &OnionTransport{onlyOnion: tc.onlyOnion}
+		got := tpt.DialableAddrs(addrs, tc.pref)
+		if len(got) != len(tc.want) {
+			t.Fatalf("onlyOnion %v, preference %d: got %v, expected %v", tc.onlyOnion, tc.pref, got, tc.want)
+		}
+		for i := range got {
+			if !got[i].Equal(tc.want[i]) {
+				t.Fatalf("onlyOnion %v, preference %d: got %v, expected %v", tc.onlyOnion, tc.pref, got, tc.want)
+			}
+		}
+		best, err := tpt.BestDialAddr(addrs, tc.pref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !best.Equal(tc.want[0]) {
+			t.Fatalf("onlyOnion %v, preference %d: best address %s, expected %s", tc.onlyOnion, tc.pref, best, tc.want[0])
+		}
+	}
+
+	tpt := &OnionTransport{onlyOnion: true}
+	if _, err := tpt.BestDialAddr([]ma.Multiaddr{tcp4, tcp6}, PreferOnion); err != errNoDialableAddr {
+		t.Fatalf("expected errNoDialableAddr, got %v", err)
+	}
+}
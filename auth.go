@@ -0,0 +1,116 @@
+package torOnion
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/yawning/bulb"
+)
+
+// ControlAuth selects how the transport authenticates to the tor control port
+type ControlAuth int
+
+const (
+	// AuthAuto uses the best method advertised by tor
+	AuthAuto ControlAuth = iota
+	// AuthPassword authenticates with the control password (HashedControlPassword)
+	AuthPassword
+	// AuthCookie authenticates with the control auth cookie using SAFECOOKIE
+	// (CookieAuthentication). The cookie path is discovered via PROTOCOLINFO.
+	AuthCookie
+	// AuthNull sends an empty AUTHENTICATE for control ports without authentication
+	AuthNull
+)
+
+const (
+	safeCookieServerKey = "Tor safe cookie authentication server-to-controller hash"
+	safeCookieClientKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// authenticate authenticates conn to the tor control port using method
+func authenticate(conn *bulb.Conn, method ControlAuth, password string) error {
+	switch method {
+	case AuthAuto:
+		return conn.Authenticate(password)
+	case AuthPassword:
+		_, err := conn.Request("AUTHENTICATE %s", quoteControlString(password))
+		return err
+	case AuthCookie:
+		return authenticateCookie(conn)
+	case AuthNull:
+		_, err := conn.Request("AUTHENTICATE")
+		return err
+	}
+	return fmt.Errorf("unknown control auth method %d", method)
+}
+
+// quoteControlString quotes s as a control port QuotedString. Tor only
+// unescapes backslashes and double quotes there, so unlike strconv.Quote
+// every other byte is sent as is.
+func quoteControlString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// authenticateCookie performs SAFECOOKIE authentication using the cookie
+// file advertised by the control port
+func authenticateCookie(conn *bulb.Conn) error {
+	pi, err := conn.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+	if !pi.AuthMethods["SAFECOOKIE"] {
+		return errors.New("control port does not support SAFECOOKIE authentication")
+	}
+	if pi.CookieFile == "" {
+		return errors.New("control port did not advertise a cookie file")
+	}
+	cookie, err := ioutil.ReadFile(pi.CookieFile)
+	if err != nil {
+		return fmt.Errorf("failed to read control auth cookie: %v", err)
+	}
+
+	clientNonce := make([]byte, 32)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	resp, err := conn.Request("AUTHCHALLENGE SAFECOOKIE %s", hex.EncodeToString(clientNonce))
+	if err != nil {
+		return err
+	}
+	var serverHash, serverNonce []byte
+	for _, field := range strings.Fields(resp.Reply) {
+		switch {
+		case strings.HasPrefix(field, "SERVERHASH="):
+			serverHash, err = hex.DecodeString(strings.TrimPrefix(field, "SERVERHASH="))
+		case strings.HasPrefix(field, "SERVERNONCE="):
+			serverNonce, err = hex.DecodeString(strings.TrimPrefix(field, "SERVERNONCE="))
+		}
+		if err != nil {
+			return fmt.Errorf("malformed AUTHCHALLENGE reply: %v", err)
+		}
+	}
+	if serverHash == nil || serverNonce == nil {
+		return errors.New("malformed AUTHCHALLENGE reply")
+	}
+
+	msg := bytes.Join([][]byte{cookie, clientNonce, serverNonce}, nil)
+	if !hmac.Equal(serverHash, safeCookieHash(safeCookieServerKey, msg)) {
+		return errors.New("control port failed to prove knowledge of the auth cookie")
+	}
+	_, err = conn.Request("AUTHENTICATE %s", hex.EncodeToString(safeCookieHash(safeCookieClientKey, msg)))
+	return err
+}
+
+func safeCookieHash(key string, msg []byte) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(msg)
+	return h.Sum(nil)
+}
@@ -0,0 +1,66 @@
+package torOnion
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	errBridgesDisabled = errors.New("tor is not configured to use bridges, UseBridges is not set")
+	errNoBridges       = errors.New("tor is configured to use bridges but none are configured")
+	errBridgeBootstrap = errors.New("tor cannot bootstrap through its bridges")
+)
+
+// WithRequireBridges makes the transport require tor to connect to the
+// network through bridges, as needed where tor is censored. The bridges
+// themselves are configured in torrc. Creating the transport fails
+// unless UseBridges is set, at least one Bridge is configured and each
+// pluggable transport the bridges use, such as obfs4, has a
+// ClientTransportPlugin. WaitBootstrap then fails with a descriptive
+// error when tor reports trouble reaching the bridges.
+func WithRequireBridges() Option {
+	return func(t *OnionTransport) {
+		t.requireBridges = true
+	}
+}
+
+// checkBridges verifies that tor's bridge configuration is usable
+func (t *OnionTransport) checkBridges() error {
+	conf, err := t.getConf("UseBridges", "Bridge", "ClientTransportPlugin")
+	if err != nil {
+		return fmt.Errorf("failed to query the bridge configuration: %v", err)
+	}
+	if useBridges := conf["UseBridges"]; len(useBridges) == 0 || useBridges[0] != "1" {
+		return errBridgesDisabled
+	}
+	if len(conf["Bridge"]) == 0 {
+		return errNoBridges
+	}
+	// ClientTransportPlugin transport[,transport...] exec path [options]
+	plugins := make(map[string]bool)
+	for _, plugin := range conf["ClientTransportPlugin"] {
+		if fields := strings.Fields(plugin); len(fields) != 0 {
+			for _, name := range strings.Split(fields[0], ",") {
+				plugins[name] = true
+			}
+		}
+	}
+	// Bridge [transport] address:port [fingerprint] [options]
+	for _, bridge := range conf["Bridge"] {
+		fields := strings.Fields(bridge)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(fields[0]); err == nil {
+			// a plain bridge without a pluggable transport
+			continue
+		}
+		if !plugins[fields[0]] {
+			return fmt.Errorf("bridge %q uses pluggable transport %s, which has no ClientTransportPlugin configured", bridge, fields[0])
+		}
+	}
+	t.log().Debug("bridge configuration usable", "bridges", len(conf["Bridge"]))
+	return nil
+}
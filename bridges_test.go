@@ -0,0 +1,104 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+const testBridge = "obfs4 192.0.2.3:443 B9E7141C594AF25699E0079C1F0146F409495296 cert=ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw iat-mode=0"
+
+func TestRequireBridges(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf map[string][]string
+		err  string
+	}{
+		{"bridges disabled", nil, errBridgesDisabled.Error()},
+		{"no bridges", map[string][]string{"UseBridges": {"1"}}, errNoBridges.Error()},
+		{"missing plugin", map[string][]string{
+			"UseBridges": {"1"},
+			"Bridge":     {"192.0.2.2:9001", testBridge},
+		}, "pluggable transport obfs4, which has no ClientTransportPlugin"},
+		{"usable", map[string][]string{
+			"UseBridges":            {"1"},
+			"Bridge":                {"192.0.2.2:9001", testBridge},
+			"ClientTransportPlugin": {"meek_lite,obfs4 exec /usr/bin/obfs4proxy"},
+		}, ""},
+	} {
+		fc := testutil.NewControlServer(t)
+		fc.Conf = tc.conf
+		tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false, WithRequireBridges())
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+				continue
+			}
+			tpt.Close()
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	if _, err := NewSOCKSOnionTransport("tcp4", "127.0.0.1:9050", nil, true, WithRequireBridges()); err != errControlRequired {
+		t.Fatalf("expected checking bridges to require the control port, got %v", err)
+	}
+}
+
+func TestWaitBootstrapBridges(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.Conf = map[string][]string{
+		"UseBridges":            {"1"},
+		"Bridge":                {testBridge},
+		"ClientTransportPlugin": {"obfs4 exec /usr/bin/obfs4proxy"},
+	}
+	// the bridge is blocked
+	fc.SetBootstrap(5)
+	fc.SetBootstrapWarning("Connection refused")
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false, WithRequireBridges())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = tpt.WaitBootstrap(ctx)
+	if !errors.Is(err, errBridgeBootstrap) || !strings.Contains(err.Error(), "Connection refused") {
+		t.Fatalf("expected a bridge bootstrap error, got %v", err)
+	}
+
+	// without bridges required tor is left to keep trying
+	plain := newControlTransport(t, fc)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := plain.WaitBootstrap(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	// once a bridge is reached bootstrapping completes
+	fc.SetBootstrapWarning("")
+	fc.SetBootstrap(100)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tpt.WaitBootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatusArgs(t *testing.T) {
+	args := statusArgs(`WARN BOOTSTRAP PROGRESS=5 TAG=conn SUMMARY="Connecting to a relay" WARNING="No route to host \"x\"" REASON=NOROUTE`)
+	for key, want := range map[string]string{
+		"PROGRESS": "5",
+		"SUMMARY":  "Connecting to a relay",
+		"WARNING":  `No route to host "x"`,
+		"REASON":   "NOROUTE",
+	} {
+		if args[key] != want {
+			t.Errorf("%s: got %q, expected %q", key, args[key], want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package torOnion
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errNoCircuitInfo = errors.New("circuit information is only available for outbound connections with a tor control port")
+
+// CircuitID returns the id of the tor circuit carrying the connection.
+// The stream is found among tor's open streams by its target, so while
+// several connections to the same onion service are open on different
+// circuits the circuit cannot be told apart and an error is returned.
+func (c *OnionConn) CircuitID() (string, error) {
+	t, ok := c.transport.(*OnionTransport)
+	if !ok || c.target == "" || t.conn() == nil {
+		return "", errNoCircuitInfo
+	}
+	lines, err := t.getInfoLines("stream-status")
+	if err != nil {
+		return "", err
+	}
+	var circuitID string
+	for _, line := range lines {
+		// StreamID StreamStatus CircuitID Target
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != c.target || fields[2] == "0" {
+			continue
+		}
+		if circuitID != "" && circuitID != fields[2] {
+			return "", fmt.Errorf("several circuits carry streams to %s", c.target)
+		}
+		circuitID = fields[2]
+	}
+	if circuitID == "" {
+		return "", fmt.Errorf("no tor stream to %s found", c.target)
+	}
+	return circuitID, nil
+}
+
+// CircuitPath returns the fingerprints of the relays in the tor circuit
+// carrying the connection, starting with the guard
+func (c *OnionConn) CircuitPath() ([]string, error) {
+	circuitID, err := c.CircuitID()
+	if err != nil {
+		return nil, err
+	}
+	t := c.transport.(*OnionTransport)
+	lines, err := t.getInfoLines("circuit-status")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		// CircuitID CircStatus Path BUILD_FLAGS=... PURPOSE=...
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != circuitID {
+			continue
+		}
+		var path []string
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], "$") {
+			// no relays chosen yet
+			return path, nil
+		}
+		for _, relay := range strings.Split(fields[2], ",") {
+			// relays are named $fingerprint, $fingerprint~nickname
+			// or $fingerprint=nickname
+			relay = strings.TrimPrefix(relay, "$")
+			if i := strings.IndexAny(relay, "~="); i >= 0 {
+				relay = relay[:i]
+			}
+			path = append(path, relay)
+		}
+		return path, nil
+	}
+	return nil, fmt.Errorf("circuit %s not found", circuitID)
+}
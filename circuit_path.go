@@ -0,0 +1,263 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	tpt "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+var (
+	errCircuitPathsDisabled = errors.New("dialing over chosen circuits requires WithCircuitPaths")
+	errStreamsAttached      = errors.New("tor attaches streams itself, __LeaveStreamsUnattached must be set to 1")
+	errEmptyPath            = errors.New("a circuit path needs at least one relay")
+	errPathOnion            = errors.New("onion services are reached over circuits tor builds itself, circuit paths only apply to TCP addresses")
+)
+
+// WithCircuitPaths enables PathDialer, which builds circuits through
+// relays chosen by the caller, for instance to pin a guard or to exit
+// in a given country, and attaches its streams to them. The transport
+// needs the control port address and tor must be configured with
+// __LeaveStreamsUnattached 1, otherwise it attaches every stream to a
+// circuit of its own choosing. With that setting tor leaves all streams
+// unattached, including those of other dialers and applications, which
+// hang unless a controller attaches them, so the tor used should be
+// dedicated to path dials.
+func WithCircuitPaths() Option {
+	return func(t *OnionTransport) {
+		t.circuitPaths = true
+	}
+}
+
+// PathDialer dials TCP addresses through tor, each connection over a
+// new circuit built through the same relays
+type PathDialer struct {
+	transport *OnionTransport
+	path      []string
+}
+
+// PathDialer returns a dialer whose circuits go through path, the
+// relays given by fingerprint as "$<hex>" or by nickname starting with
+// the guard. The last relay is the exit and its exit policy must allow
+// the dialed addresses. It requires WithCircuitPaths and tor's
+// __LeaveStreamsUnattached option set to 1. The transport must also
+// have the control port address, to watch tor's events on a connection
+// of its own, so it cannot be created with NewOnionTransportFromConn,
+// and tor's SOCKS port must be a TCP port, streams being told apart by
+// their source address.
+func (t *OnionTransport) PathDialer(path ...string) (*PathDialer, error) {
+	if !t.circuitPaths {
+		return nil, errCircuitPathsDisabled
+	}
+	if t.controlAddr == "" {
+		return nil, errControlRequired
+	}
+	if len(path) == 0 {
+		return nil, errEmptyPath
+	}
+	conf, err := t.getConf("__LeaveStreamsUnattached")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query __LeaveStreamsUnattached: %v", err)
+	}
+	if leave := conf["__LeaveStreamsUnattached"]; len(leave) == 0 || leave[0] != "1" {
+		return nil, errStreamsAttached
+	}
+	return &PathDialer{transport: t, path: append([]string(nil), path...)}, nil
+}
+
+// Dial connects to raddr over a new circuit through the dialer's path
+func (d *PathDialer) Dial(raddr ma.Multiaddr) (tpt.Conn, error) {
+	return d.DialContext(context.Background(), raddr)
+}
+
+// DialContext connects to raddr over a new circuit through the dialer's
+// path. The circuit is built with EXTENDCIRCUIT and the stream to raddr
+// attached to it with ATTACHSTREAM once tor reports it. Tor closes the
+// circuit when it has been unused for a while after the connection
+// closes.
+func (d *PathDialer) DialContext(ctx context.Context, raddr ma.Multiaddr) (tpt.Conn, error) {
+	t := d.transport
+	if t.isClosed() {
+		return nil, ErrTransportClosed
+	}
+	if IsValidOnionMultiAddr(raddr) {
+		return nil, errPathOnion
+	}
+	var network, target string
+	if host, port, ok := dnsTCPAddr(raddr); ok {
+		network, target = "tcp", net.JoinHostPort(host, port)
+	} else if netaddr, err := manet.ToNetAddr(raddr); err == nil {
+		network, target = netaddr.Network(), netaddr.String()
+	} else {
+		return nil, err
+	}
+
+	metrics := t.getMetrics()
+	metrics.DialAttempt()
+	conn, circuitID, err := d.dial(ctx, network, target)
+	if err != nil {
+		reason := dialFailureReason(ctx, err)
+		metrics.DialFailure(reason)
+		t.log().Debug("path dial failed", "addr", raddr, "path", d.path, "reason", reason, "err", err)
+		return nil, err
+	}
+	t.log().Debug("dialed over a chosen circuit", "addr", raddr, "path", d.path, "circuit", circuitID)
+	metrics.DialSuccess()
+	metrics.ConnOpened()
+	onionConn := &OnionConn{
+		Conn:      conn,
+		transport: tpt.Transport(t),
+		raddr:     raddr,
+		target:    target,
+		metrics:   metrics,
+	}
+	onionConn.opened(t.connStateHook)
+	onionConn.startIdleTimer(t.idleTimeout)
+	onionConn.startKeepAlive(t.keepAliveInterval, t.keepAliveHeartbeat)
+	return onionConn, nil
+}
+
+// dial builds the circuit and connects to target over it, returning the
+// connection and the circuit id
+func (d *PathDialer) dial(ctx context.Context, network, target string) (net.Conn, string, error) {
+	t := d.transport
+	events, err := t.watchEvents("CIRC", "STREAM")
+	if err != nil {
+		return nil, "", err
+	}
+	defer events.close()
+	circuitID, err := d.buildCircuit(ctx, events)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := d.attachStream(ctx, events, circuitID, network, target)
+	if err != nil {
+		if _, cerr := t.request("CLOSECIRCUIT %s", circuitID); cerr != nil {
+			t.log().Debug("failed to close circuit", "circuit", circuitID, "err", cerr)
+		}
+		return nil, "", err
+	}
+	return conn, circuitID, nil
+}
+
+// buildCircuit extends a new circuit through the path and waits until
+// tor reports it built
+func (d *PathDialer) buildCircuit(ctx context.Context, events *eventWatcher) (string, error) {
+	path := strings.Join(d.path, ",")
+	resp, err := d.transport.request("EXTENDCIRCUIT 0 %s", path)
+	if err != nil {
+		return "", fmt.Errorf("EXTENDCIRCUIT failed: %v", err)
+	}
+	// 250 EXTENDED <circuit id>
+	fields := strings.Fields(resp.Reply)
+	if len(fields) != 2 || fields[0] != "EXTENDED" {
+		return "", fmt.Errorf("unexpected EXTENDCIRCUIT reply %q", resp.Reply)
+	}
+	circuitID := fields[1]
+	for {
+		event, err := events.next(ctx)
+		if err != nil {
+			return "", err
+		}
+		// 650 CIRC <circuit id> <status> [<path>] ...
+		fields := strings.Fields(event)
+		if len(fields) < 3 || fields[0] != "CIRC" || fields[1] != circuitID {
+			continue
+		}
+		switch fields[2] {
+		case "BUILT":
+			return circuitID, nil
+		case "FAILED", "CLOSED":
+			return "", fmt.Errorf("building a circuit through %s failed: %s", path, statusArgs(event)["REASON"])
+		}
+	}
+}
+
+// attachStream connects to target through the SOCKS port and attaches
+// the stream tor reports for it to the circuit circuitID. The stream is
+// told apart from others by its source address, the local end of the
+// connection to the SOCKS port, which therefore has to be a TCP port.
+func (d *PathDialer) attachStream(ctx context.Context, events *eventWatcher, circuitID, network, target string) (net.Conn, error) {
+	t := d.transport
+	// stops the SOCKS handshake if the stream cannot be attached
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	forward := &sourceRecorder{abortableForward: newAbortableForward(ctx), sources: make(chan string, 1)}
+	defer forward.release()
+	dialer, err := t.newTorDialer(t.auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := dialContext(ctx, dialer, network, target)
+		done <- dialResult{conn, err}
+	}()
+	fail := func(err error) (net.Conn, error) {
+		cancel()
+		if res := <-done; res.conn != nil {
+			res.conn.Close()
+		}
+		return nil, err
+	}
+
+	// a connection made as ctx is done is closed by release
+	dialed := func(res dialResult) (net.Conn, error) {
+		if res.err == nil && forward.release() {
+			return nil, ctx.Err()
+		}
+		return res.conn, res.err
+	}
+
+	var source string
+	select {
+	case source = <-forward.sources:
+	case res := <-done:
+		return dialed(res)
+	}
+	for {
+		event, err := events.next(ctx)
+		if err != nil {
+			return fail(err)
+		}
+		// 650 STREAM <stream id> NEW 0 <target> SOURCE_ADDR=<address> ...
+		fields := strings.Fields(event)
+		if len(fields) < 5 || fields[0] != "STREAM" || fields[2] != "NEW" || statusArgs(event)["SOURCE_ADDR"] != source {
+			continue
+		}
+		if _, err := t.request("ATTACHSTREAM %s %s", fields[1], circuitID); err != nil {
+			return fail(fmt.Errorf("ATTACHSTREAM failed: %v", err))
+		}
+		break
+	}
+	return dialed(<-done)
+}
+
+// sourceRecorder connects to the SOCKS port like abortableForward,
+// passing on the local address of the connection
+type sourceRecorder struct {
+	*abortableForward
+	sources chan string
+}
+
+// Dial connects to the SOCKS port
+func (r *sourceRecorder) Dial(network, addr string) (net.Conn, error) {
+	conn, err := r.abortableForward.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case r.sources <- conn.LocalAddr().String():
+	default:
+	}
+	return conn, nil
+}
@@ -0,0 +1,89 @@
+package torOnion
+
+import (
+	"io"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestPathDialer(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.Conf = map[string][]string{"__LeaveStreamsUnattached": {"1"}}
+	fs := testutil.NewSOCKSServer(t)
+	fs.Control = fc
+	fc.SetSOCKSAddr(fs.Addr())
+	guard := "$0123456789ABCDEF0123456789ABCDEF01234567"
+	exit := "$89ABCDEF0123456789ABCDEF0123456789ABCDEF"
+
+	plain, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err := plain.PathDialer(guard, exit); err != errCircuitPathsDisabled {
+		t.Fatalf("expected errCircuitPathsDisabled, got %v", err)
+	}
+
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false, WithCircuitPaths())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	dialer, err := tpt.PathDialer(guard, "middle", exit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial(onion); err != errPathOnion {
+		t.Fatalf("expected errPathOnion, got %v", err)
+	}
+
+	addr, err := ma.NewMultiaddr("/ip4/93.184.216.34/tcp/80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the proxy echoes everything written once the stream is attached
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	var sequence []string
+	for _, cmd := range fc.Commands() {
+		switch cmd {
+		case "SETEVENTS", "EXTENDCIRCUIT", "ATTACHSTREAM":
+			sequence = append(sequence, cmd)
+		}
+	}
+	if len(sequence) != 3 || sequence[0] != "SETEVENTS" || sequence[1] != "EXTENDCIRCUIT" || sequence[2] != "ATTACHSTREAM" {
+		t.Fatalf("unexpected command sequence %v", sequence)
+	}
+	if n := fc.RequestCount("EXTENDCIRCUIT 0 " + guard + ",middle," + exit); n != 1 {
+		t.Fatalf("circuit extended through the path %d times", n)
+	}
+	if n := fc.RequestCount("ATTACHSTREAM 1 1"); n != 1 {
+		t.Fatalf("stream attached to the circuit %d times", n)
+	}
+	if target := fs.LastTarget(); target != "93.184.216.34:80" {
+		t.Fatalf("dialed %q", target)
+	}
+
+	// without __LeaveStreamsUnattached tor would attach the stream
+	// before the dialer could
+	fc.SetConf(nil)
+	if _, err := tpt.PathDialer(guard, exit); err != errStreamsAttached {
+		t.Fatalf("expected errStreamsAttached, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package torOnion
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestCircuitID(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	fc := testutil.NewControlServer(t)
+	fc.SetSOCKSAddr(fs.Addr())
+	fc.AddStream("12 SUCCEEDED 7 example.com:443")
+	fc.AddStream("13 SUCCEEDED 9 erhkddypoy6qml6h.onion:4003")
+	fc.AddCircuit("7 BUILT $AAAA~guard,$BBBB~middle,$CCCC~exit PURPOSE=GENERAL")
+	fc.AddCircuit("9 BUILT $DDDD~guard,$EEEE=middle,$FFFF PURPOSE=HS_CLIENT_REND")
+	tpt := newControlTransport(t, fc)
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := c.(*OnionConn)
+
+	id, err := conn.CircuitID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "9" {
+		t.Fatalf("expected circuit 9, got %s", id)
+	}
+	path, err := conn.CircuitPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(path, []string{"DDDD", "EEEE", "FFFF"}) {
+		t.Fatalf("unexpected circuit path %v", path)
+	}
+
+	// streams to the same target on different circuits are ambiguous
+	fc.AddStream("14 SUCCEEDED 11 erhkddypoy6qml6h.onion:4003")
+	if _, err := conn.CircuitID(); err == nil {
+		t.Fatal("expected an error for an ambiguous stream")
+	}
+
+	// inbound connections have no stream of their own
+	inbound := &OnionConn{transport: tpt}
+	if _, err := inbound.CircuitID(); err != errNoCircuitInfo {
+		t.Fatalf("expected errNoCircuitInfo, got %v", err)
+	}
+}
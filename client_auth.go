@@ -0,0 +1,171 @@
+package torOnion
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	// ErrClientAuthRequired is returned when dialing a v3 onion service
+	// which requires client authorization without a registered key
+	ErrClientAuthRequired = errors.New("onion service requires client authorization")
+	// ErrClientAuthRejected is returned when dialing a v3 onion service
+	// which does not accept the registered client authorization key
+	ErrClientAuthRejected = errors.New("onion service rejected client authorization")
+
+	errClientAuthV2 = errors.New("client authorization requires a v3 onion service")
+)
+
+// SOCKS reply codes tor uses for client authorization failures when the
+// SocksPort has the ExtendedErrors flag, 0xF6 being a bad onion address
+const (
+	socksClientAuthMissing = 0xF4
+	socksClientAuthBad     = 0xF5
+)
+
+// ListenOption configures optional behavior of a single onion service
+type ListenOption func(*listenConfig)
+
+type listenConfig struct {
+	// authorizedClients are the x25519 public keys of the clients
+	// allowed to connect, or empty for a public service
+	authorizedClients [][32]byte
+	// virtPort, if not zero, is the published virtual port, the listen
+	// port then being the local port
+	virtPort uint16
+	// unixPath, if set, is the unix socket tor forwards connections to
+	unixPath string
+	// localTarget, if set, is the TCP address tor forwards connections
+	// to in place of 127.0.0.1
+	localTarget string
+	// maxConns, if positive, limits the open accepted connections,
+	// handled according to limitPolicy
+	maxConns    int
+	limitPolicy ConnLimitPolicy
+	// ephemeral is set when the key was generated for the listener
+	ephemeral bool
+	// keyCallback is passed the generated key of an ephemeral listener
+	keyCallback func(serviceID string, key crypto.PrivateKey)
+	// acceptFilter, if set, admits or rejects accepted connections
+	acceptFilter func(conn net.Conn) error
+	// nonAnonymous publishes a single onion service
+	nonAnonymous bool
+	// detach and discardPK set the ADD_ONION flags of the same name
+	detach    bool
+	discardPK bool
+	// maxStreams and maxStreamsCloseCircuit limit the streams per
+	// rendezvous circuit
+	maxStreams             int
+	maxStreamsCloseCircuit bool
+	// publishCtx, if set, bounds waiting for the descriptor upload
+	publishCtx context.Context
+	// queueWorkers, if positive, accept connections in the background
+	// for Accept to pick up from a queue of queueSize
+	queueSize    int
+	queueWorkers int
+	// label tags the listener and its connections for the application
+	label string
+}
+
+// ephemeralKey marks a listener whose key was generated for it
+func ephemeralKey(c *listenConfig) {
+	c.ephemeral = true
+}
+
+// WithAuthorizedClients makes a v3 onion service private, so that only
+// clients holding the x25519 private key for one of pubs can connect.
+// Tor encrypts the service descriptor to these keys, so other clients
+// cannot even discover the service. LoadAuthorizedClients reads keys
+// kept in tor's authorized_clients format. Clients register their key
+// with WithClientAuthV3, AddClientAuthV3 or AddClientAuthDir.
+func WithAuthorizedClients(pubs ...[32]byte) ListenOption {
+	return func(c *listenConfig) {
+		c.authorizedClients = append(c.authorizedClients, pubs...)
+	}
+}
+
+// WithClientAuthV3 registers key, an x25519 private key, with tor when
+// the transport is created so that it can dial the private v3 onion
+// service serviceID.
+func WithClientAuthV3(serviceID string, key [32]byte) Option {
+	return func(t *OnionTransport) {
+		if t.clientAuth == nil {
+			t.clientAuth = make(map[string][32]byte)
+		}
+		t.clientAuth[normalizeOnionHost(serviceID)] = key
+	}
+}
+
+// GenerateClientAuthKey returns a new x25519 key pair for v3 onion
+// service client authorization. The public key is given to the service
+// operator and the private key kept by the client.
+func GenerateClientAuthKey() (pub, priv [32]byte, err error) {
+	if _, err = rand.Read(priv[:]); err != nil {
+		return pub, priv, err
+	}
+	p, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return pub, priv, err
+	}
+	copy(pub[:], p)
+	return pub, priv, nil
+}
+
+// AddClientAuthV3 registers key, an x25519 private key, with tor so that
+// it can dial the private v3 onion service serviceID. The key is
+// registered again if the transport reconnects to the control port.
+func (t *OnionTransport) AddClientAuthV3(serviceID string, key [32]byte) error {
+	if t.conn() == nil {
+		return errControlRequired
+	}
+	serviceID = normalizeOnionHost(serviceID)
+	if err := t.requireTorVersion(clientAuthAddMinVersion, "client authorization keys"); err != nil {
+		return err
+	}
+	_, err := t.request("%s", clientAuthCommand(serviceID, key))
+	if err != nil {
+		return fmt.Errorf("ONION_CLIENT_AUTH_ADD failed: %v", err)
+	}
+	// remember the key to register it again should tor restart
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.clientAuth == nil {
+		t.clientAuth = make(map[string][32]byte)
+	}
+	t.clientAuth[serviceID] = key
+	return nil
+}
+
+// clientAuthKeys returns a copy of the registered client authorization
+// keys
+func (t *OnionTransport) clientAuthKeys() map[string][32]byte {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	keys := make(map[string][32]byte, len(t.clientAuth))
+	for serviceID, key := range t.clientAuth {
+		keys[serviceID] = key
+	}
+	return keys
+}
+
+// clientAuthCommand formats the ONION_CLIENT_AUTH_ADD command for
+// AddClientAuthV3
+func clientAuthCommand(serviceID string, key [32]byte) string {
+	serviceID = strings.TrimSuffix(serviceID, ".onion")
+	return fmt.Sprintf("ONION_CLIENT_AUTH_ADD %s x25519:%s", serviceID, base64.StdEncoding.EncodeToString(key[:]))
+}
+
+// clientAuthArg formats pub as the value of an ADD_ONION ClientAuthV3
+// argument
+func clientAuthArg(pub [32]byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(pub[:])
+}
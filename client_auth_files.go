@@ -0,0 +1,128 @@
+package torOnion
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Tor keeps client authorization keys in text files: the
+// authorized_clients directory of an onion service holds a ".auth" file
+// with the public key of each client, and the ClientOnionAuthDir of a
+// client an ".auth_private" file with its private key for each service.
+const (
+	authorizedClientExt  = ".auth"
+	clientAuthPrivateExt = ".auth_private"
+
+	descriptorKeyPrefix = "descriptor:x25519:"
+)
+
+// MarshalAuthorizedClient formats pub, the x25519 public key of a
+// client, as the content of a .auth file
+func MarshalAuthorizedClient(pub [32]byte) string {
+	return descriptorKeyPrefix + clientAuthArg(pub)
+}
+
+// ParseAuthorizedClient parses the content of a .auth file, returning
+// the x25519 public key of the client
+func ParseAuthorizedClient(s string) ([32]byte, error) {
+	return parseDescriptorKey(strings.TrimSpace(s))
+}
+
+// MarshalClientAuthPrivate formats priv, the x25519 private key for the
+// onion service serviceID, as the content of an .auth_private file
+func MarshalClientAuthPrivate(serviceID string, priv [32]byte) string {
+	return normalizeOnionHost(serviceID) + ":" + descriptorKeyPrefix + clientAuthArg(priv)
+}
+
+// ParseClientAuthPrivate parses the content of an .auth_private file,
+// returning the onion service id and the x25519 private key for it
+func ParseClientAuthPrivate(s string) (string, [32]byte, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", [32]byte{}, errors.New("client authorization key is missing the onion address")
+	}
+	serviceID := normalizeOnionHost(s[:i])
+	if err := ValidateV3OnionAddress(serviceID); err != nil {
+		return "", [32]byte{}, err
+	}
+	key, err := parseDescriptorKey(s[i+1:])
+	return serviceID, key, err
+}
+
+// parseDescriptorKey parses a "descriptor:x25519:<base32 key>" key
+func parseDescriptorKey(s string) ([32]byte, error) {
+	var key [32]byte
+	if !strings.HasPrefix(s, descriptorKeyPrefix) {
+		return key, fmt.Errorf("client authorization key must start with %q", descriptorKeyPrefix)
+	}
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimPrefix(s, descriptorKeyPrefix)))
+	if err != nil {
+		return key, fmt.Errorf("client authorization key is not base32: %v", err)
+	}
+	if len(b) != len(key) {
+		return key, fmt.Errorf("client authorization key must be %d bytes", len(key))
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// readKeyFile returns the trimmed content of a key file
+func readKeyFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(b)), err
+}
+
+// LoadAuthorizedClients reads the client public keys of the .auth files
+// in dir, an onion service's authorized_clients directory, to be passed
+// to WithAuthorizedClients
+func LoadAuthorizedClients(dir string) ([][32]byte, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+authorizedClientExt))
+	if err != nil {
+		return nil, err
+	}
+	pubs := make([][32]byte, 0, len(paths))
+	for _, path := range paths {
+		content, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := ParseAuthorizedClient(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		pubs = append(pubs, pub)
+	}
+	return pubs, nil
+}
+
+// AddClientAuthDir registers the private keys of the .auth_private files
+// in dir, laid out like tor's ClientOnionAuthDir, with AddClientAuthV3 so
+// that the private onion services they are for can be dialed. It
+// returns the ids of those services.
+func (t *OnionTransport) AddClientAuthDir(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+clientAuthPrivateExt))
+	if err != nil {
+		return nil, err
+	}
+	var added []string
+	for _, path := range paths {
+		content, err := readKeyFile(path)
+		if err != nil {
+			return added, err
+		}
+		serviceID, key, err := ParseClientAuthPrivate(content)
+		if err != nil {
+			return added, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := t.AddClientAuthV3(serviceID, key); err != nil {
+			return added, err
+		}
+		added = append(added, serviceID)
+	}
+	return added, nil
+}
@@ -0,0 +1,192 @@
+package torOnion
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestListenAuthorizedClients(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	pub, _, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tpt.ListenEphemeralV3(4003, WithAuthorizedClients(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	clients := fc.ClientAuth(l.serviceID)
+	if len(clients) != 1 || clients[0] != clientAuthArg(pub) {
+		t.Fatalf("service registered with client keys %v, expected %s", clients, clientAuthArg(pub))
+	}
+
+	// client authorization is a v3 only feature
+	if _, err := tpt.listen(4004, nil, WithAuthorizedClients(pub)); err != errClientAuthV2 {
+		t.Fatalf("expected v2 client authorization to be refused, got %v", err)
+	}
+}
+
+func TestClientAuthV3(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	_, priv, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd"
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false, WithClientAuthV3(id, priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	cmd := "ONION_CLIENT_AUTH_ADD " + id + " x25519:" + base64.StdEncoding.EncodeToString(priv[:])
+	if n := fc.RequestCount(cmd); n != 1 {
+		t.Fatalf("client key registered %d times, expected once", n)
+	}
+
+	if _, err := NewSOCKSOnionTransport("tcp4", "127.0.0.1:9050", nil, true, WithClientAuthV3(id, priv)); err != errControlRequired {
+		t.Fatalf("expected client authorization to require the control port, got %v", err)
+	}
+}
+
+func TestDialClientAuthErrors(t *testing.T) {
+	addr, err := ma.NewMultiaddr("/onion3/vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		reply byte
+		err   error
+	}{
+		{0xF4, ErrClientAuthRequired},
+		{0xF5, ErrClientAuthRejected},
+	} {
+		fs := testutil.NewSOCKSServer(t)
+		fs.Reply = tc.reply
+		tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialer, err := tpt.Dialer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dialer.Dial(addr); err != tc.err {
+			t.Errorf("SOCKS reply %#x: expected %v, got %v", tc.reply, tc.err, err)
+		}
+		tpt.Close()
+	}
+}
+
+func TestClientAuthFiles(t *testing.T) {
+	pub, priv, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ParseAuthorizedClient(MarshalAuthorizedClient(pub) + "\n"); err != nil || got != pub {
+		t.Fatalf("public key did not round trip: %v", err)
+	}
+	id := "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd"
+	gotID, got, err := ParseClientAuthPrivate(MarshalClientAuthPrivate(id+".onion", priv))
+	if err != nil || gotID != id || got != priv {
+		t.Fatalf("private key did not round trip: %s %v", gotID, err)
+	}
+	for _, s := range []string{
+		"x25519:" + clientAuthArg(pub),
+		"descriptor:x25519:AAAA",
+	} {
+		if _, err := ParseAuthorizedClient(s); err == nil {
+			t.Errorf("parsed malformed key %q", s)
+		}
+	}
+	if _, _, err := ParseClientAuthPrivate(MarshalAuthorizedClient(priv)); err == nil {
+		t.Error("parsed private key without an onion address")
+	}
+}
+
+func TestClientAuthEndToEnd(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fs := testutil.NewSOCKSServer(t)
+	fs.Control = fc
+	fc.SetSOCKSAddr(fs.Addr())
+
+	// the service operator keeps the client's public key in
+	// authorized_clients
+	pub, priv, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientsDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(clientsDir, "alice.auth"), []byte(MarshalAuthorizedClient(pub)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := LoadAuthorizedClients(clientsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newControlTransport(t, fc)
+	l, err := service.ListenEphemeralV3(4003, WithAuthorizedClients(clients...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	client, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	dialer, err := client.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial(l.Multiaddr()); err != ErrClientAuthRequired {
+		t.Fatalf("expected ErrClientAuthRequired without a key, got %v", err)
+	}
+	_, other, err := GenerateClientAuthKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddClientAuthV3(l.serviceID, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial(l.Multiaddr()); err != ErrClientAuthRejected {
+		t.Fatalf("expected ErrClientAuthRejected with an unauthorized key, got %v", err)
+	}
+
+	// the client keeps its private key in its ClientOnionAuthDir
+	authDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(authDir, "service.auth_private"), []byte(MarshalClientAuthPrivate(l.serviceID, priv)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	added, err := client.AddClientAuthDir(authDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != l.serviceID {
+		t.Fatalf("unexpected services %v", added)
+	}
+	conn, err := dialer.Dial(l.Multiaddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
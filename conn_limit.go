@@ -0,0 +1,107 @@
+package torOnion
+
+import "errors"
+
+var errListenerClosed = errors.New("listener closed")
+
+// ConnLimitPolicy controls what a listener limited with WithMaxConns
+// does once the limit is reached
+type ConnLimitPolicy int
+
+const (
+	// LimitBlock holds off accepting connections until an accepted one
+	// is closed. Tor queues the pending streams meanwhile.
+	LimitBlock ConnLimitPolicy = iota
+	// LimitReject accepts and immediately closes connections over the
+	// limit
+	LimitReject
+)
+
+// WithMaxConns caps the number of concurrently open connections accepted
+// by the listener at max, handling further connections according to
+// policy. This protects a publicly reachable onion service from being
+// flooded with streams.
+func WithMaxConns(max int, policy ConnLimitPolicy) ListenOption {
+	return func(c *listenConfig) {
+		c.maxConns = max
+		c.limitPolicy = policy
+	}
+}
+
+// connLimiter tracks the connection slots of a listener. Each accepted
+// connection holds one slot until it is closed. A nil connLimiter
+// imposes no limit.
+type connLimiter struct {
+	slots  chan struct{}
+	policy ConnLimitPolicy
+	// done is closed when the listener is closed
+	done chan struct{}
+}
+
+func newConnLimiter(max int, policy ConnLimitPolicy) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{
+		slots:  make(chan struct{}, max),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+}
+
+// wait takes a slot under LimitBlock, waiting for one to free up. It
+// returns false if the listener is closed meanwhile.
+func (c *connLimiter) wait() bool {
+	if c == nil || c.policy != LimitBlock {
+		return true
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// abandon gives back the slot taken by wait when accepting failed
+func (c *connLimiter) abandon() {
+	if c != nil && c.policy == LimitBlock {
+		<-c.slots
+	}
+}
+
+// admit takes a slot for an accepted connection under LimitReject,
+// returning false if none is free
+func (c *connLimiter) admit() bool {
+	if c == nil || c.policy != LimitReject {
+		return true
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// reject gives back the slot taken by admit for a connection which was
+// turned away
+func (c *connLimiter) reject() {
+	if c != nil && c.policy == LimitReject {
+		<-c.slots
+	}
+}
+
+// release gives back the slot of a closed connection
+func (c *connLimiter) release() {
+	if c != nil {
+		<-c.slots
+	}
+}
+
+// close wakes up Accept calls waiting for a slot
+func (c *connLimiter) close() {
+	if c != nil {
+		close(c.done)
+	}
+}
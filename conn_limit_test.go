@@ -0,0 +1,138 @@
+package torOnion
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	tpt "github.com/libp2p/go-libp2p-transport"
+)
+
+// dialListener connects to the local side of l the way tor does
+func dialListener(t *testing.T, l *OnionListener) net.Conn {
+	conn, err := net.Dial("tcp4", l.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// acceptAsync runs Accept in the background
+func acceptAsync(l *OnionListener) <-chan tpt.Conn {
+	ch := make(chan tpt.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- conn
+	}()
+	return ch
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	l, err := transport.ListenEphemeralV3(4003, WithMaxConns(2, LimitReject))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var accepted []tpt.Conn
+	for i := 0; i < 2; i++ {
+		dialListener(t, l)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		accepted = append(accepted, conn)
+	}
+
+	// the third connection is closed right away
+	ch := acceptAsync(l)
+	rejected := dialListener(t, l)
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection over the limit to be closed, got %v", err)
+	}
+
+	// once a slot is free connections are accepted again
+	accepted[0].Close()
+	dialListener(t, l)
+	select {
+	case conn := <-ch:
+		if conn == nil {
+			t.Fatal("Accept failed")
+		}
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted after a slot was freed")
+	}
+}
+
+func TestMaxConnsBlock(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	l, err := transport.ListenEphemeralV3(4003, WithMaxConns(2, LimitBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var accepted []tpt.Conn
+	for i := 0; i < 2; i++ {
+		dialListener(t, l)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		accepted = append(accepted, conn)
+	}
+
+	// the third connection waits for a slot
+	dialListener(t, l)
+	ch := acceptAsync(l)
+	select {
+	case <-ch:
+		t.Fatal("accepted a connection over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	accepted[1].Close()
+	select {
+	case conn := <-ch:
+		if conn == nil {
+			t.Fatal("Accept failed")
+		}
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted after a slot was freed")
+	}
+
+	// closing the listener releases a blocked Accept
+	accepted[0].Close()
+	for i := 0; i < 2; i++ {
+		dialListener(t, l)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	ch = acceptAsync(l)
+	l.Close()
+	select {
+	case conn := <-ch:
+		if conn != nil {
+			t.Fatal("Accept succeeded on a closed listener")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+}
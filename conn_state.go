@@ -0,0 +1,62 @@
+package torOnion
+
+import ma "github.com/multiformats/go-multiaddr"
+
+// ConnState is a step in a connection's lifecycle
+type ConnState int
+
+const (
+	// StateOpen is reported once a connection is dialed or accepted
+	StateOpen ConnState = iota
+	// StateClosed is reported when a connection is closed
+	StateClosed
+)
+
+// String returns "open" or "closed"
+func (s ConnState) String() string {
+	if s == StateClosed {
+		return "closed"
+	}
+	return "open"
+}
+
+// ConnInfo describes a connection to a ConnState hook
+type ConnInfo struct {
+	LocalAddr  ma.Multiaddr
+	RemoteAddr ma.Multiaddr
+	// Inbound is set for accepted connections
+	Inbound bool
+	// Onion is set for connections to and from onion services
+	Onion bool
+	// Label is the label of the listener which accepted the
+	// connection, see WithLabel
+	Label string
+}
+
+// WithConnStateHook makes hook be called when a connection is dialed or
+// accepted and again, with the same ConnInfo, when it is closed. hook is
+// called synchronously from Dial, Accept and Close and from the idle
+// and keep-alive timers, so it must be quick and safe for concurrent
+// use.
+func WithConnStateHook(hook func(ConnInfo, ConnState)) Option {
+	return func(t *OnionTransport) {
+		t.connStateHook = hook
+	}
+}
+
+// opened reports c as open to hook, which is remembered to report the
+// close, if hook is set
+func (c *OnionConn) opened(hook func(ConnInfo, ConnState)) {
+	if hook == nil {
+		return
+	}
+	c.stateHook = hook
+	c.info = ConnInfo{
+		LocalAddr:  c.laddr,
+		RemoteAddr: c.raddr,
+		Inbound:    c.target == "",
+		Onion:      c.onion,
+		Label:      c.label,
+	}
+	hook(c.info, StateOpen)
+}
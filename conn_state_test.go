@@ -0,0 +1,108 @@
+package torOnion
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// stateEvent is a call to a ConnState hook
+type stateEvent struct {
+	info  ConnInfo
+	state ConnState
+}
+
+// stateRecorder records the calls to its hook
+type stateRecorder struct {
+	mtx    sync.Mutex
+	events []stateEvent
+}
+
+func (r *stateRecorder) hook(info ConnInfo, state ConnState) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.events = append(r.events, stateEvent{info, state})
+}
+
+// expect checks that the hook was called with each of states, in
+// order, for a connection described by want
+func (r *stateRecorder) expect(t *testing.T, want ConnInfo, states ...ConnState) {
+	t.Helper()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if len(r.events) != len(states) {
+		t.Fatalf("expected %d events, got %v", len(states), r.events)
+	}
+	for i, e := range r.events {
+		if e.state != states[i] {
+			t.Fatalf("event %d is %s, expected %s", i, e.state, states[i])
+		}
+		got := e.info
+		if got.Inbound != want.Inbound || got.Onion != want.Onion || got.Label != want.Label ||
+			!multiaddrEqual(got.LocalAddr, want.LocalAddr) || !multiaddrEqual(got.RemoteAddr, want.RemoteAddr) {
+			t.Fatalf("event %d describes %+v, expected %+v", i, got, want)
+		}
+	}
+}
+
+// multiaddrEqual compares multiaddrs which may be nil
+func multiaddrEqual(a, b ma.Multiaddr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+func TestConnStateHookDialed(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	var rec stateRecorder
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, WithConnStateHook(rec.hook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConnInfo{RemoteAddr: addr, Onion: true}
+	rec.expect(t, want, StateOpen)
+
+	// the close is reported once
+	conn.Close()
+	conn.Close()
+	rec.expect(t, want, StateOpen, StateClosed)
+}
+
+func TestConnStateHookAccepted(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	var rec stateRecorder
+	WithConnStateHook(rec.hook)(transport)
+	l, err := transport.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := dialListener(t, l)
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConnInfo{LocalAddr: l.Multiaddr(), RemoteAddr: l.Multiaddr(), Inbound: true, Onion: true}
+	rec.expect(t, want, StateOpen)
+	conn.Close()
+	rec.expect(t, want, StateOpen, StateClosed)
+}
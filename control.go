@@ -0,0 +1,375 @@
+package torOnion
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yawning/bulb"
+	"github.com/yawning/bulb/utils/pkcs1"
+)
+
+// onionInfo is the parsed reply to an ADD_ONION command
+type onionInfo struct {
+	serviceID  string
+	privateKey crypto.PrivateKey
+}
+
+// onionFlags are the ADD_ONION flags of an onion service
+type onionFlags struct {
+	// nonAnonymous makes it a single onion service
+	nonAnonymous bool
+	// detach keeps it published when the control connection closes
+	detach bool
+	// discardPK stops tor from returning a key it generated
+	discardPK bool
+	// maxStreams, if positive, limits the streams per rendezvous
+	// circuit, which are closed along with the circuit over the limit
+	// if maxStreamsCloseCircuit is set
+	maxStreams             int
+	maxStreamsCloseCircuit bool
+}
+
+// addOnion registers an onion service on the control port which
+// forwards virtPort to the local target address. key is either an
+// *rsa.PrivateKey for a v2 or an ed25519.PrivateKey for a v3 service.
+// If key is nil tor generates a new RSA1024 key which is returned in
+// the reply. If clients is not empty the service is a private v3
+// service which only accepts those x25519 public keys. flags are passed
+// on to tor.
+func (t *OnionTransport) addOnion(key crypto.PrivateKey, virtPort uint16, target string, clients [][32]byte, flags onionFlags) (*onionInfo, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		if err := t.requireTorVersion(v3OnionMinVersion, "v3 onion services"); err != nil {
+			return nil, err
+		}
+	}
+	if len(clients) != 0 {
+		if err := t.requireTorVersion(addOnionClientAuthMinVersion, "authorized clients"); err != nil {
+			return nil, err
+		}
+	}
+	cmd, err := addOnionCommand(key, virtPort, target, clients, flags)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.request("%s", cmd)
+	if err != nil {
+		if e, ok := err.(*textproto.Error); ok && e.Code == 512 {
+			switch {
+			case strings.Contains(e.Msg, "Tor is in anonymous hidden service mode"):
+				return nil, errNonAnonymousDisabled
+			case strings.Contains(e.Msg, "Tor is in non-anonymous hidden service mode"):
+				return nil, errNonAnonymousRequired
+			case strings.HasPrefix(target, "unix:"):
+				// tor without unix target support rejects the Port
+				// argument
+				return nil, errUnixTargetUnsupported
+			}
+		}
+		return nil, fmt.Errorf("ADD_ONION failed: %v", err)
+	}
+	return parseAddOnionReply(resp, key)
+}
+
+// addOnionCommand formats the ADD_ONION command for addOnion
+func addOnionCommand(key crypto.PrivateKey, virtPort uint16, target string, clients [][32]byte, flags onionFlags) (string, error) {
+	var keyStr string
+	switch k := key.(type) {
+	case nil:
+		keyStr = "NEW:RSA1024"
+	case *rsa.PrivateKey:
+		der, err := pkcs1.EncodePrivateKeyDER(k)
+		if err != nil {
+			return "", err
+		}
+		keyStr = "RSA1024:" + base64.StdEncoding.EncodeToString(der)
+	case ed25519.PrivateKey:
+		keyStr = "ED25519-V3:" + base64.StdEncoding.EncodeToString(expandEd25519Key(k))
+	default:
+		return "", fmt.Errorf("unsupported onion service key type %T", key)
+	}
+
+	var flagList []string
+	var flagArg, clientAuth string
+	if len(clients) != 0 {
+		if _, ok := key.(ed25519.PrivateKey); !ok {
+			return "", errClientAuthV2
+		}
+		flagList = append(flagList, "V3Auth")
+		for _, pub := range clients {
+			clientAuth += " ClientAuthV3=" + clientAuthArg(pub)
+		}
+	}
+	if flags.nonAnonymous {
+		flagList = append(flagList, "NonAnonymous")
+	}
+	if flags.detach {
+		flagList = append(flagList, "Detach")
+	}
+	if flags.discardPK {
+		flagList = append(flagList, "DiscardPK")
+	}
+	if flags.maxStreamsCloseCircuit {
+		flagList = append(flagList, "MaxStreamsCloseCircuit")
+	}
+	if len(flagList) != 0 {
+		flagArg = " Flags=" + strings.Join(flagList, ",")
+	}
+	if flags.maxStreams > 0 {
+		flagArg += fmt.Sprintf(" MaxStreams=%d", flags.maxStreams)
+	}
+
+	return fmt.Sprintf("ADD_ONION %s%s Port=%d,%s%s", keyStr, flagArg, virtPort, target, clientAuth), nil
+}
+
+// parseAddOnionReply parses the reply to an ADD_ONION command sent
+// with key
+func parseAddOnionReply(resp *bulb.Response, key crypto.PrivateKey) (*onionInfo, error) {
+	info := &onionInfo{privateKey: key}
+	for _, line := range resp.Data {
+		switch {
+		case strings.HasPrefix(line, "ServiceID="):
+			info.serviceID = strings.TrimPrefix(line, "ServiceID=")
+		case strings.HasPrefix(line, "PrivateKey=RSA1024:"):
+			der, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "PrivateKey=RSA1024:"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode onion service key: %v", err)
+			}
+			info.privateKey, _, err = pkcs1.DecodePrivateKeyDER(der)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode onion service key: %v", err)
+			}
+		}
+	}
+	if info.serviceID == "" {
+		return nil, errors.New("ADD_ONION reply is missing the service ID")
+	}
+	return info, nil
+}
+
+// removeOnion removes an onion service during cleanup, where a failure
+// can only be logged
+func (t *OnionTransport) removeOnion(serviceID string) {
+	if err := t.delOnion(serviceID); err != nil {
+		t.log().Warn("failed to remove onion service", "id", serviceID, "err", err)
+	}
+}
+
+// delOnion removes an onion service previously registered with addOnion
+func (t *OnionTransport) delOnion(serviceID string) error {
+	_, err := t.request("DEL_ONION %s", serviceID)
+	return err
+}
+
+// bootstrapProgress returns tor's bootstrap progress in percent
+func (t *OnionTransport) bootstrapProgress() (int, error) {
+	progress, _, err := t.bootstrapStatus()
+	return progress, err
+}
+
+// bootstrapStatus returns tor's bootstrap progress in percent and the
+// warning it reports if bootstrapping is having trouble
+func (t *OnionTransport) bootstrapStatus() (int, string, error) {
+	resp, err := t.request("GETINFO status/bootstrap-phase")
+	if err != nil {
+		return 0, "", err
+	}
+	for _, line := range resp.Data {
+		args := statusArgs(strings.TrimPrefix(line, "status/bootstrap-phase="))
+		if progress, ok := args["PROGRESS"]; ok {
+			p, err := strconv.Atoi(progress)
+			if p == 100 {
+				t.mtx.Lock()
+				t.bootstrapped = true
+				t.mtx.Unlock()
+			}
+			return p, args["WARNING"], err
+		}
+	}
+	return 0, "", errors.New("bootstrap phase reply is missing the progress")
+}
+
+// statusArgs returns the KEY=VALUE arguments of a tor status line such
+// as the bootstrap phase, unquoting quoted values
+func statusArgs(line string) map[string]string {
+	args := make(map[string]string)
+	for {
+		line = strings.TrimLeft(line, " ")
+		i := strings.IndexAny(line, "= ")
+		if i < 0 {
+			return args
+		}
+		if line[i] == ' ' {
+			// a keyword without a value
+			line = line[i:]
+			continue
+		}
+		key, rest := line[:i], line[i+1:]
+		end := strings.IndexByte(rest, ' ')
+		if strings.HasPrefix(rest, "\"") {
+			// find the closing quote, skipping escaped characters
+			end = -1
+			for j := 1; j < len(rest); j++ {
+				if rest[j] == '\\' {
+					j++
+				} else if rest[j] == '"' {
+					end = j + 1
+					break
+				}
+			}
+		}
+		if end < 0 {
+			end = len(rest)
+		}
+		value := rest[:end]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		args[key] = value
+		line = rest[end:]
+	}
+}
+
+// getConf queries tor's configuration with GETCONF, returning the
+// values of each of keys. Options which may be given several times,
+// like Bridge, have a value for each, unset options none.
+func (t *OnionTransport) getConf(keys ...string) (map[string][]string, error) {
+	resp, err := t.request("GETCONF %s", strings.Join(keys, " "))
+	if err != nil {
+		return nil, err
+	}
+	conf := make(map[string][]string, len(keys))
+	// the last value is sent on the final line of the reply
+	for _, line := range append(resp.Data, resp.Reply) {
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			conf[line[:i]] = append(conf[line[:i]], line[i+1:])
+		}
+	}
+	return conf, nil
+}
+
+// bootstrapPollInterval is how often WaitBootstrap checks the progress
+const bootstrapPollInterval = 500 * time.Millisecond
+
+// WaitBootstrap blocks until tor reports that it has fully bootstrapped
+// and is able to build circuits, or until ctx is done in which case the
+// context error is returned. Applications can use it to hold off dialing
+// until onion connections can actually succeed. With WithRequireBridges
+// it fails as soon as tor warns about trouble bootstrapping, as tor
+// would otherwise keep retrying bridges which are blocked or down.
+func (t *OnionTransport) WaitBootstrap(ctx context.Context) error {
+	if t.conn() == nil {
+		return errControlRequired
+	}
+	for {
+		progress, warning, err := t.bootstrapStatus()
+		if err != nil {
+			return err
+		}
+		if progress == 100 {
+			return nil
+		}
+		if warning != "" && t.requireBridges {
+			return fmt.Errorf("%w at %d%%: %s", errBridgeBootstrap, progress, warning)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(bootstrapPollInterval):
+		}
+	}
+}
+
+// socksListener returns the network and address of the first SOCKS
+// port tor is listening on
+func (t *OnionTransport) socksListener() (string, string, error) {
+	resp, err := t.request("GETINFO net/listeners/socks")
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range resp.Data {
+		listeners := strings.Fields(strings.TrimPrefix(line, "net/listeners/socks="))
+		if len(listeners) == 0 {
+			continue
+		}
+		addr, err := strconv.Unquote(listeners[0])
+		if err != nil {
+			return "", "", fmt.Errorf("malformed SOCKS listener %s: %v", listeners[0], err)
+		}
+		if strings.HasPrefix(addr, "unix:") {
+			return "unix", strings.TrimPrefix(addr, "unix:"), nil
+		}
+		return "tcp", addr, nil
+	}
+	return "", "", errors.New("tor has no SOCKS listener configured")
+}
+
+// GetInfo queries tor for the values of keys with GETINFO, for
+// instance "version" or "traffic/read", returning them by key. Values
+// tor sends as multi-line data are joined with newlines. The query fails
+// if tor does not recognize one of the keys.
+func (t *OnionTransport) GetInfo(keys ...string) (map[string]string, error) {
+	if t.conn() == nil {
+		return nil, errControlRequired
+	}
+	info := make(map[string]string, len(keys))
+	if len(keys) == 0 {
+		return info, nil
+	}
+	for _, key := range keys {
+		// a key must not smuggle further arguments or commands
+		if key == "" || strings.ContainsAny(key, " \t\r\n") {
+			return nil, fmt.Errorf("invalid GETINFO key %q", key)
+		}
+	}
+	resp, err := t.request("GETINFO %s", strings.Join(keys, " "))
+	if err != nil {
+		return nil, err
+	}
+	var key string
+	for _, data := range resp.Data {
+		// data is either a key=value line or the data following a
+		// key= line of a multi-line reply
+		if k, v, ok := cutInfoKey(data, keys); ok {
+			key = k
+			info[key] = v
+		} else if key != "" {
+			info[key] = strings.TrimPrefix(info[key]+"\n"+data, "\n")
+		}
+	}
+	return info, nil
+}
+
+// cutInfoKey splits a GETINFO reply line into one of keys and its value
+func cutInfoKey(data string, keys []string) (string, string, bool) {
+	for _, key := range keys {
+		if strings.HasPrefix(data, key+"=") {
+			return key, strings.TrimPrefix(data, key+"="), true
+		}
+	}
+	return "", "", false
+}
+
+// getInfoLines returns the lines of a GETINFO reply for key, which tor
+// sends either on a single line or as a multi-line data reply
+func (t *OnionTransport) getInfoLines(key string) ([]string, error) {
+	info, err := t.GetInfo(key)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(info[key], "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
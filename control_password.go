@@ -0,0 +1,83 @@
+package torOnion
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// WithControlPasswordFile makes the transport read the control password
+// from the file at path each time it connects to the control port,
+// rather than keeping it in memory for its lifetime. A trailing newline
+// is ignored.
+func WithControlPasswordFile(path string) Option {
+	return func(t *OnionTransport) {
+		t.controlPassSource = func() (string, error) {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("failed to read the control password: %w", err)
+			}
+			return strings.TrimRight(string(b), "\r\n"), nil
+		}
+	}
+}
+
+// WithControlPasswordEnv makes the transport read the control password
+// from the environment variable name each time it connects to the
+// control port, rather than keeping it in memory for its lifetime
+func WithControlPasswordEnv(name string) Option {
+	return func(t *OnionTransport) {
+		t.controlPassSource = func() (string, error) {
+			pass, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("control password variable %s is not set", name)
+			}
+			return pass, nil
+		}
+	}
+}
+
+// controlCredentials returns the method and password to authenticate
+// a new control connection with, reading the password from its source
+// if one was configured
+func (t *OnionTransport) controlCredentials() (ControlAuth, string, error) {
+	t.authMtx.Lock()
+	method, pass, source := t.controlAuth, t.controlPass, t.controlPassSource
+	t.authMtx.Unlock()
+	if source != nil {
+		var err error
+		if pass, err = source(); err != nil {
+			return method, "", err
+		}
+	}
+	return method, pass, nil
+}
+
+// UpdateControlAuth replaces the control password used to connect to
+// the control port, for when tor's HashedControlPassword is rotated.
+// The current control connection stays open, the new password is used
+// once the transport reconnects. A password source set with
+// WithControlPasswordFile or WithControlPasswordEnv is dropped, and
+// cookie or null authentication is switched to AuthPassword.
+func (t *OnionTransport) UpdateControlAuth(newPass string) {
+	t.authMtx.Lock()
+	defer t.authMtx.Unlock()
+	t.controlPass = newPass
+	t.controlPassSource = nil
+	if t.controlAuth == AuthCookie || t.controlAuth == AuthNull {
+		t.controlAuth = AuthPassword
+	}
+}
+
+// UpdateControlCookieAuth switches to SAFECOOKIE authentication for
+// future connections to the control port, leaving the current one
+// open. The cookie file is read on every connect, so a cookie tor
+// rewrote on restart needs no update.
+func (t *OnionTransport) UpdateControlCookieAuth() {
+	t.authMtx.Lock()
+	defer t.authMtx.Unlock()
+	t.controlAuth = AuthCookie
+	t.controlPass = ""
+	t.controlPassSource = nil
+}
@@ -0,0 +1,115 @@
+package torOnion
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+func TestControlPasswordFile(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.AuthMethods = "HASHEDPASSWORD"
+	fc.Password = "secret"
+	path := filepath.Join(t.TempDir(), "control_password")
+	if err := ioutil.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tpt, err := NewTransport("tcp4", fc.Addr(), WithControlPasswordFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	if tpt.controlPass != "" {
+		t.Fatal("control password kept by the transport")
+	}
+
+	// the file is read again on each connect
+	fc.SetPassword("rotated")
+	if err := ioutil.WriteFile(path, []byte("rotated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tpt.dialControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := NewTransport("tcp4", fc.Addr(), WithControlPasswordFile(missing)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestControlPasswordEnv(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.AuthMethods = "HASHEDPASSWORD"
+	fc.Password = "secret"
+	t.Setenv("TOR_CONTROL_PASSWORD", "secret")
+	tpt, err := NewTransport("tcp4", fc.Addr(), WithControlPasswordEnv("TOR_CONTROL_PASSWORD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.Close()
+
+	t.Setenv("TOR_CONTROL_PASSWORD", "wrong")
+	if _, err := NewTransport("tcp4", fc.Addr(), WithControlPasswordEnv("TOR_CONTROL_PASSWORD")); !errors.Is(err, ErrControlAuthFailed) {
+		t.Fatalf("expected ErrControlAuthFailed, got %v", err)
+	}
+	if _, err := NewTransport("tcp4", fc.Addr(), WithControlPasswordEnv("TOR_CONTROL_PASSWORD_UNSET")); err == nil {
+		t.Fatal("connected without the password variable set")
+	}
+}
+
+func TestUpdateControlAuth(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.AuthMethods = "HASHEDPASSWORD"
+	fc.Password = "old"
+	tpt, err := NewTransport("tcp4", fc.Addr(), WithControlPassword("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the password is rotated, the open connection is kept
+	fc.SetPassword("new")
+	tpt.UpdateControlAuth("new")
+	conn := tpt.conn()
+	if _, err := tpt.GetInfo("version"); err != nil {
+		t.Fatal(err)
+	}
+	if tpt.conn() != conn {
+		t.Fatal("control connection replaced after updating the password")
+	}
+
+	// tor restarts, reconnecting uses the new password
+	fc.Restart("")
+	if _, err := tpt.GetInfo("version"); err != nil {
+		t.Fatalf("reconnecting with the new password failed: %v", err)
+	}
+	if n := fc.RequestCount(`AUTHENTICATE "new"`); n != 1 {
+		t.Fatalf("authenticated with the new password %d times", n)
+	}
+	if !fc.HasOnion(l.serviceID) {
+		t.Fatal("onion service was not published again after reconnecting")
+	}
+
+	// the cookie is used from now on
+	fc.EnableCookieAuth(t)
+	tpt.UpdateControlCookieAuth()
+	fc.Restart("")
+	if _, err := tpt.GetInfo("version"); err != nil {
+		t.Fatalf("reconnecting with cookie authentication failed: %v", err)
+	}
+	if n := fc.RequestCount(`AUTHENTICATE "new"`); n != 1 {
+		t.Fatal("password used after switching to cookie authentication")
+	}
+}
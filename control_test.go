@@ -0,0 +1,729 @@
+package torOnion
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/yawning/bulb"
+	"github.com/yawning/bulb/utils/pkcs1"
+	"golang.org/x/net/proxy"
+)
+
+// newControlTransport returns an OnionTransport connected to fc
+func newControlTransport(t *testing.T, fc *testutil.ControlServer) *OnionTransport {
+	conn, err := bulb.Dial("tcp4", fc.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt := &OnionTransport{controlConn: conn}
+	t.Cleanup(func() { tpt.Close() })
+	return tpt
+}
+
+func TestCookieAuthentication(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.EnableCookieAuth(t)
+
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false, WithControlAuth(AuthCookie))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.Close()
+
+	// the wrong cookie must be rejected
+	if err := ioutil.WriteFile(fc.CookieFile, make([]byte, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false, WithControlAuth(AuthCookie)); err == nil {
+		t.Fatal("authenticated with the wrong cookie")
+	}
+
+	// null authentication must be rejected when a cookie is required
+	if _, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false, WithControlAuth(AuthNull)); err == nil {
+		t.Fatal("authenticated without the cookie")
+	}
+}
+
+func TestPasswordAuthentication(t *testing.T) {
+	// tor only unescapes backslashes and quotes, other bytes, like the
+	// zero width space strconv.Quote would escape, are sent as they are
+	password := "pa\"ss\\wör\u200bd"
+	fc := testutil.NewControlServer(t)
+	fc.AuthMethods = "HASHEDPASSWORD"
+	fc.Password = password
+
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), password, nil, t.TempDir(), false, WithControlAuth(AuthPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.Close()
+	if n := fc.RequestCount(`AUTHENTICATE "pa\"ss\\wör` + "\u200b" + `d"`); n != 1 {
+		t.Fatalf("password sent %d times with tor's quoting", n)
+	}
+}
+
+func TestBootstrapProgress(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	fc.SetBootstrap(45)
+	progress, err := tpt.bootstrapProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress != 45 {
+		t.Fatalf("expected progress 45, got %d", progress)
+	}
+}
+
+func TestWaitBootstrap(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	fc.SetBootstrap(50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := tpt.WaitBootstrap(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded while bootstrapping, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		fc.SetBootstrap(100)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tpt.WaitBootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// currentOnions returns the onion services registered on the control
+// port as reported by GETINFO onions/current
+func currentOnions(t *testing.T, tpt *OnionTransport) []string {
+	resp, err := tpt.controlConn.Request("GETINFO onions/current")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, data := range resp.Data {
+		for _, id := range strings.Fields(strings.TrimPrefix(data, "onions/current=")) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestListenerCloseRemovesOnion(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	l, err := tpt.ListenEphemeral(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onions := currentOnions(t, tpt)
+	if len(onions) != 1 || onions[0] != l.serviceID {
+		t.Fatalf("expected %s in ONIONS list, got %v", l.serviceID, onions)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("second Close failed: %v", err)
+	}
+	if onions := currentOnions(t, tpt); len(onions) != 0 {
+		t.Fatalf("onion service still listed after Close: %v", onions)
+	}
+	if n := fc.RequestCount("DEL_ONION " + l.serviceID); n != 1 {
+		t.Fatalf("DEL_ONION sent %d times, expected once", n)
+	}
+}
+
+func TestListenerAccept(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	l, err := tpt.ListenEphemeral(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// tor delivers inbound streams to the local listener
+	client, err := net.Dial("tcp4", l.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.LocalMultiaddr().Equal(l.Multiaddr()) {
+		t.Fatalf("accepted conn has local multiaddr %s, expected %s", conn.LocalMultiaddr(), l.Multiaddr())
+	}
+	// the loopback address tor connected from says nothing about the peer
+	if !conn.RemoteMultiaddr().Equal(l.Multiaddr()) {
+		t.Fatalf("accepted conn has remote multiaddr %s, expected %s", conn.RemoteMultiaddr(), l.Multiaddr())
+	}
+	if conn.Transport() != tpt {
+		t.Fatalf("accepted conn reports transport %v, expected %v", conn.Transport(), tpt)
+	}
+}
+
+func TestListenerAddr(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	l, err := tpt.ListenEphemeralV3(4003, WithVirtualPort(80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr()
+	if addr == nil {
+		t.Fatal("listener has no address")
+	}
+	if addr.Network() != "onion" || addr.String() != l.serviceID+".onion:80" {
+		t.Fatalf("unexpected listener address %s/%s", addr.Network(), addr)
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	first, err := tpt.ListenEphemeral(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := tpt.ListenEphemeralV3(4004)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	dialListener(t, second)
+	secondConn, err := second.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondConn.Close()
+	dialListener(t, first)
+	firstConn, err := first.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer firstConn.Close()
+
+	// listening again leaves the addresses of existing connections alone
+	third, err := tpt.ListenEphemeralV3(4005)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+
+	for _, tc := range []struct {
+		local ma.Multiaddr
+		l     *OnionListener
+	}{
+		{firstConn.LocalMultiaddr(), first},
+		{secondConn.LocalMultiaddr(), second},
+	} {
+		if !tc.local.Equal(tc.l.Multiaddr()) {
+			t.Fatalf("accepted conn has local multiaddr %s, expected %s", tc.local, tc.l.Multiaddr())
+		}
+	}
+}
+
+// TestConcurrentDialListen is meant to be run with the race detector
+func TestConcurrentDialListen(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fs := testutil.NewSOCKSServer(t)
+	fs.Control = fc
+	fc.SetSOCKSAddr(fs.Addr())
+	tpt := newControlTransport(t, fc)
+
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !conn.LocalMultiaddr().Equal(l.Multiaddr()) {
+				t.Errorf("accepted conn has local multiaddr %s", conn.LocalMultiaddr())
+			}
+			conn.Close()
+		}
+	}()
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				conn, err := dialer.Dial(l.Multiaddr())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !conn.RemoteMultiaddr().Equal(l.Multiaddr()) {
+					t.Errorf("dialed conn has remote multiaddr %s", conn.RemoteMultiaddr())
+				}
+				conn.Close()
+			}
+		}()
+	}
+	// listening meanwhile must not disturb the connections' addresses
+	for i := 0; i < 5; i++ {
+		other, err := tpt.ListenEphemeralV3(4004)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Close()
+	}
+	wg.Wait()
+}
+
+func TestListenEphemeral(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	l, err := tpt.ListenEphemeral(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsValidOnionMultiAddr(l.Multiaddr()) {
+		t.Fatalf("listener has an invalid multiaddr: %s", l.Multiaddr())
+	}
+	key, ok := l.PrivateKey().(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("expected the generated RSA key, got %T", l.PrivateKey())
+	}
+	id, err := pkcs1.OnionAddr(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Multiaddr().String() != "/onion/"+id+":4003" {
+		t.Fatalf("multiaddr %s does not match key %s", l.Multiaddr(), id)
+	}
+	if !fc.HasOnion(id) {
+		t.Fatal("onion service was not registered")
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fc.HasOnion(id) {
+		t.Fatal("onion service was not removed on Close")
+	}
+}
+
+func TestTransportFromConn(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	conn, err := bulb.Dial("tcp4", fc.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Authenticate(""); err != nil {
+		t.Fatal(err)
+	}
+
+	tpt, err := NewOnionTransportFromConn(conn, nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tpt.ListenEphemeral(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tpt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fc.HasOnion(l.serviceID) {
+		t.Fatal("onion service was not removed on Close")
+	}
+
+	// the caller's connection must still be usable
+	if _, err := conn.Request("GETINFO status/bootstrap-phase"); err != nil {
+		t.Fatalf("control connection closed by the transport: %v", err)
+	}
+}
+
+func TestTransportLifecycle(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fs := testutil.NewSOCKSServer(t)
+	fs.Control = fc
+	fc.SetSOCKSAddr(fs.Addr())
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dialer.Dial(l.Multiaddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("onion service received %q", buf)
+	}
+
+	if err := tpt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fc.HasOnion(l.serviceID) {
+		t.Fatal("onion service was not removed on Close")
+	}
+	if _, err := dialer.Dial(l.Multiaddr()); err != ErrTransportClosed {
+		t.Fatalf("expected dialing a closed transport to fail, got %v", err)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fs := testutil.NewSOCKSServer(t)
+	fs.Control = fc
+	fc.SetSOCKSAddr(fs.Addr())
+	tpt := newControlTransport(t, fc)
+
+	path := filepath.Join(t.TempDir(), "onion.sock")
+	l, err := tpt.ListenEphemeralV3(4003, WithUnixSocket(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if target, ok := fc.OnionTarget(l.serviceID, 4003); !ok || target != "unix:"+path {
+		t.Fatalf("onion service forwards to %q, expected the unix socket", target)
+	}
+
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dialer.Dial(l.Multiaddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if !server.RemoteMultiaddr().Equal(l.Multiaddr()) {
+		t.Fatalf("accepted conn has remote multiaddr %s", server.RemoteMultiaddr())
+	}
+
+	// tor versions without unix target support reject the service
+	fc2 := testutil.NewControlServer(t)
+	fc2.RejectUnixTargets = true
+	tpt2 := newControlTransport(t, fc2)
+	path = filepath.Join(t.TempDir(), "onion.sock")
+	if _, err := tpt2.ListenEphemeralV3(4003, WithUnixSocket(path)); err != errUnixTargetUnsupported {
+		t.Fatalf("expected errUnixTargetUnsupported, got %v", err)
+	}
+}
+
+func TestListenLocalTarget(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if target, _ := fc.OnionTarget(l.serviceID, 4003); !strings.HasPrefix(target, "127.0.0.1:") {
+		t.Fatalf("default forwarding target %q", target)
+	}
+
+	// another loopback address stands in for a second interface
+	l, err = tpt.ListenEphemeralV3(4003, WithLocalTarget("127.0.0.2:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	target, ok := fc.OnionTarget(l.serviceID, 4003)
+	if !ok || target != l.listener.Addr().String() || !strings.HasPrefix(target, "127.0.0.2:") {
+		t.Fatalf("forwarding target %q, listener bound to %s", target, l.listener.Addr())
+	}
+	client := dialListener(t, l)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	client.Close()
+
+	for _, bad := range []string{"localhost:0", "0.0.0.0:0", "127.0.0.2"} {
+		if _, err := tpt.ListenEphemeralV3(4003, WithLocalTarget(bad)); err == nil {
+			t.Fatalf("listened with the local target %q", bad)
+		}
+	}
+	if _, err := tpt.ListenEphemeralV3(4003, WithLocalTarget("127.0.0.2:0"), WithUnixSocket(filepath.Join(t.TempDir(), "s"))); err == nil {
+		t.Fatal("listened with both a local target and a unix socket")
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.SetSOCKSAddr("127.0.0.1:9050")
+	fc.AddStream("12 SUCCEEDED 7 example.com:443")
+	fc.AddStream("13 SUCCEEDED 9 erhkddypoy6qml6h.onion:4003")
+	tpt := newControlTransport(t, fc)
+
+	info, err := tpt.GetInfo("net/listeners/socks", "stream-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["net/listeners/socks"] != `"127.0.0.1:9050"` {
+		t.Fatalf("unexpected SOCKS listeners %q", info["net/listeners/socks"])
+	}
+	if info["stream-status"] != "12 SUCCEEDED 7 example.com:443\n13 SUCCEEDED 9 erhkddypoy6qml6h.onion:4003" {
+		t.Fatalf("unexpected stream status %q", info["stream-status"])
+	}
+
+	if _, err := tpt.GetInfo("no/such/key"); err == nil {
+		t.Fatal("GetInfo succeeded for an unknown key")
+	}
+	if _, err := tpt.GetInfo("version\r\nSIGNAL SHUTDOWN"); err == nil {
+		t.Fatal("GetInfo accepted a key containing a command")
+	}
+	if n := fc.RequestCount("SIGNAL SHUTDOWN"); n != 0 {
+		t.Fatal("command smuggled in a key was sent to tor")
+	}
+}
+
+func TestAllowedPorts(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	WithAllowedPorts(443)(tpt)
+
+	if _, err := tpt.ListenEphemeralV3(4003); err == nil {
+		t.Fatal("listened on a port which is not allowed")
+	}
+	if _, err := tpt.ListenEphemeralV3(443, WithVirtualPort(4003)); err == nil {
+		t.Fatal("published a virtual port which is not allowed")
+	}
+	if cmds := fc.Commands(); len(cmds) != 0 {
+		t.Fatalf("commands %v sent to tor for a disallowed port", cmds)
+	}
+
+	l, err := tpt.ListenEphemeralV3(443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestListenMultiaddrFromKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := pkcs1.OnionAddr(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	tpt.setKeys(map[string]crypto.PrivateKey{id: key})
+
+	addr, err := ma.NewMultiaddr("/onion/" + id + ":4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tpt.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Multiaddr().String() != "/onion/"+id+":4003" {
+		t.Fatalf("multiaddr %s does not match key %s", l.Multiaddr(), id)
+	}
+	if !fc.HasOnion(id) {
+		t.Fatal("onion service was not registered with the key")
+	}
+}
+
+func TestNewTransportOptions(t *testing.T) {
+	// no options: nothing but the control port
+	fc := testutil.NewControlServer(t)
+	tpt, err := NewTransport("tcp4", fc.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	tpt.Close()
+
+	dir := t.TempDir()
+	name, err := GenerateOnionV3Key(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &proxy.Auth{User: "user", Password: "pass"}
+	fc.SetPassword("secret")
+	fc.SetAuthMethods("HASHEDPASSWORD")
+	tpt, err = NewTransport("tcp4", fc.Addr(),
+		WithControlPassword("secret"),
+		WithSOCKSAuth(auth),
+		WithKeysDir(dir),
+		WithOnlyOnion(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	if _, ok := tpt.getKey(name); !ok {
+		t.Fatal("key from WithKeysDir not loaded")
+	}
+	if tpt.auth != auth {
+		t.Fatal("SOCKS credentials not set")
+	}
+	tcp, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpt.CanDial(tcp) {
+		t.Fatal("WithOnlyOnion transport dials TCP addresses")
+	}
+
+	if _, err := NewTransport("tcp4", fc.Addr(), WithControlPassword("wrong")); !errors.Is(err, ErrControlAuthFailed) {
+		t.Fatalf("expected ErrControlAuthFailed, got %v", err)
+	}
+	// the positional constructor is the same as the options
+	legacy, err := NewOnionTransport("tcp4", fc.Addr(), "secret", auth, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	if _, ok := legacy.getKey(name); !ok || legacy.auth != auth || !legacy.onlyOnion {
+		t.Fatal("positional parameters not applied")
+	}
+}
+
+func TestUnixControlPort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control")
+	fc := testutil.NewUnixControlServer(t, path)
+	for _, addr := range []string{path, "unix:" + path} {
+		tpt, err := NewTransport("unix", addr)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		l, err := tpt.ListenEphemeralV3(4003)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fc.HasOnion(l.serviceID) {
+			t.Fatalf("%s: onion service not registered", addr)
+		}
+		tpt.Close()
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	name := fmt.Sprintf("go-onion-transport-test-%d", time.Now().UnixNano())
+	testutil.NewUnixControlServer(t, "@"+name)
+	for _, addr := range []string{"@" + name, "\x00" + name} {
+		tpt, err := NewTransport("unix", addr)
+		if err != nil {
+			t.Fatalf("abstract socket %q: %v", addr, err)
+		}
+		tpt.Close()
+	}
+}
+
+func TestNewOnionTransportContext(t *testing.T) {
+	// a control port which accepts connections but never answers
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewOnionTransportContext(ctx, "tcp4", ln.Addr().String(), "", nil, t.TempDir(), false)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("constructor returned after %s", elapsed)
+	}
+
+	// a responsive control port is unaffected
+	fc := testutil.NewControlServer(t)
+	tpt, err := NewOnionTransportContext(context.Background(), "tcp4", fc.Addr(), "", nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.Close()
+}
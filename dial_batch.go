@@ -0,0 +1,55 @@
+package torOnion
+
+import (
+	"context"
+	"sync"
+
+	tpt "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DialTarget is an address to dial with DialBatch
+type DialTarget struct {
+	// Peer identifies the target to the caller, for instance by its
+	// libp2p peer ID, and is passed back unchanged in the DialResult
+	Peer string
+	Addr ma.Multiaddr
+}
+
+// DialResult is the outcome of dialing a DialTarget, either Conn or Err
+// is set
+type DialResult struct {
+	Peer string
+	Addr ma.Multiaddr
+	Conn tpt.Conn
+	Err  error
+}
+
+// DialBatch dials targets concurrently and sends each result on the
+// returned channel as soon as its dial completes, closing the channel
+// once all dials are done. How many dials run at once is bounded by
+// WithMaxConcurrentDials, if set. When ctx is done the dials still in
+// progress are abandoned and report the context error, so a caller
+// wanting the first n connections cancels ctx after receiving them.
+// The channel has room for every result so dials never block on it,
+// but the connections in results left unread are not closed: the
+// caller has to drain the channel and close the connections it does
+// not use.
+func (t *OnionTransport) DialBatch(ctx context.Context, targets []DialTarget) <-chan DialResult {
+	results := make(chan DialResult, len(targets))
+	dialer := OnionDialer{auth: t.auth, transport: t}
+	var wg sync.WaitGroup
+	wg.Add(len(targets))
+	for _, target := range targets {
+		go func(target DialTarget) {
+			defer wg.Done()
+			conn, err := dialer.DialContext(ctx, target.Addr)
+			results <- DialResult{Peer: target.Peer, Addr: target.Addr, Conn: conn, Err: err}
+		}(target)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
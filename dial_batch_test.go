@@ -0,0 +1,102 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// scriptedDialer fails dials to failAddr, holds dials to slowAddr until
+// they are cancelled and completes all others right away
+type scriptedDialer struct {
+	failAddr, slowAddr string
+}
+
+func (d *scriptedDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *scriptedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch addr {
+	case d.failAddr:
+		return nil, errors.New("connection refused")
+	case d.slowAddr:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	c1, c2 := net.Pipe()
+	go func() {
+		<-ctx.Done()
+		c2.Close()
+	}()
+	return c1, nil
+}
+
+func TestDialBatch(t *testing.T) {
+	sd := &scriptedDialer{failAddr: "10.0.0.2:4001", slowAddr: "10.0.0.3:4001"}
+	tpt, err := NewSOCKSOnionTransport("tcp4", "", nil, false, WithProxyDialer(sd), WithMaxConcurrentDials(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	var targets []DialTarget
+	for _, target := range []struct{ peer, addr string }{
+		{"fast1", "/ip4/10.0.0.1/tcp/4001"},
+		{"fail", "/ip4/10.0.0.2/tcp/4001"},
+		{"slow", "/ip4/10.0.0.3/tcp/4001"},
+		{"fast2", "/ip4/10.0.0.4/tcp/4001"},
+	} {
+		addr, err := ma.NewMultiaddr(target.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, DialTarget{Peer: target.peer, Addr: addr})
+	}
+
+	// the slow dial holds one of the two dial slots while the others
+	// take turns in the other
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := tpt.DialBatch(ctx, targets)
+	got := make(map[string]DialResult)
+	timeout := time.After(5 * time.Second)
+	for len(got) < 3 {
+		select {
+		case res := <-results:
+			got[res.Peer] = res
+		case <-timeout:
+			t.Fatalf("only %d of the quick dials completed", len(got))
+		}
+	}
+	for _, peer := range []string{"fast1", "fast2"} {
+		res, ok := got[peer]
+		if !ok || res.Err != nil || res.Conn == nil {
+			t.Fatalf("dial to %s: %+v", peer, res)
+		}
+		res.Conn.Close()
+	}
+	if res, ok := got["fail"]; !ok || res.Err == nil || res.Conn != nil {
+		t.Fatalf("failing dial reported %+v", res)
+	}
+	if !got["fail"].Addr.Equal(targets[1].Addr) {
+		t.Fatalf("result carries address %s, expected %s", got["fail"].Addr, targets[1].Addr)
+	}
+
+	// enough peers, the slow dial is cancelled
+	cancel()
+	select {
+	case res := <-results:
+		if res.Peer != "slow" || !errors.Is(res.Err, context.Canceled) {
+			t.Fatalf("cancelled dial reported %+v", res)
+		}
+	case <-timeout:
+		t.Fatal("slow dial not cancelled")
+	}
+	if _, ok := <-results; ok {
+		t.Fatal("results not closed after all dials completed")
+	}
+}
@@ -0,0 +1,36 @@
+package torOnion
+
+import "context"
+
+// WithMaxConcurrentDials limits the dials through tor in progress at
+// once to max, so that fanning out to many peers does not have tor
+// build dozens of circuits simultaneously. Further dials wait for one
+// in progress to complete, or fail with the context error should their
+// context be done first. By default dials are not limited.
+func WithMaxConcurrentDials(max int) Option {
+	return func(t *OnionTransport) {
+		if max > 0 {
+			t.dialSlots = make(chan struct{}, max)
+		}
+	}
+}
+
+// acquireDialSlot waits until a dial may start
+func (t *OnionTransport) acquireDialSlot(ctx context.Context) error {
+	if t.dialSlots == nil {
+		return nil
+	}
+	select {
+	case t.dialSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseDialSlot lets a waiting dial start
+func (t *OnionTransport) releaseDialSlot() {
+	if t.dialSlots != nil {
+		<-t.dialSlots
+	}
+}
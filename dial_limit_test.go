@@ -0,0 +1,73 @@
+package torOnion
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// waitRequests waits until fs received n SOCKS requests
+func waitRequests(t *testing.T, fs *testutil.SOCKSServer, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for fs.Requests() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d SOCKS requests received, expected %d", fs.Requests(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	// dials hang until abandoned
+	fs.Stall = true
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, WithMaxConcurrentDials(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cancels []context.CancelFunc
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cancels = append(cancels, cancel)
+		go func() {
+			_, err := dialer.DialContext(ctx, addr)
+			done <- err
+		}()
+		if i < 2 {
+			waitRequests(t, fs, i+1)
+		}
+	}
+
+	// the third dial waits for a slot
+	time.Sleep(100 * time.Millisecond)
+	if n := fs.Requests(); n != 2 {
+		t.Fatalf("%d dials in progress, expected 2", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := dialer.DialContext(ctx, addr); err != context.DeadlineExceeded {
+		t.Fatalf("expected a queued dial to time out, got %v", err)
+	}
+
+	// once a dial completes the third one proceeds
+	cancels[0]()
+	if err := <-done; err == nil {
+		t.Fatal("cancelled dial succeeded")
+	}
+	waitRequests(t, fs, 3)
+}
@@ -0,0 +1,61 @@
+package torOnion
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/yawning/bulb"
+)
+
+// eventWatcher receives asynchronous events on a control connection of
+// its own, keeping them off the connection used for commands
+type eventWatcher struct {
+	conn *bulb.Conn
+}
+
+// watchEvents subscribes to events, which have to be subscribed to
+// before the commands causing them are issued so that none is missed
+func (t *OnionTransport) watchEvents(events ...string) (*eventWatcher, error) {
+	conn, err := t.dialControl()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Request("SETEVENTS %s", strings.Join(events, " ")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SETEVENTS failed: %v", err)
+	}
+	return &eventWatcher{conn: conn}, nil
+}
+
+func (w *eventWatcher) close() {
+	w.conn.Close()
+}
+
+// next blocks until the next event arrives and returns it without the
+// status code, starting with the event name. Once ctx is done the
+// watcher is closed.
+func (w *eventWatcher) next(ctx context.Context) (string, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks ReadResponse
+			w.conn.Close()
+		case <-done:
+		}
+	}()
+	for {
+		resp, err := w.conn.ReadResponse()
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", err
+		}
+		if resp.IsAsync() {
+			return resp.Reply, nil
+		}
+	}
+}
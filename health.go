@@ -0,0 +1,40 @@
+package torOnion
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// CheckReachable dials the listener's onion address through tor to
+// confirm the service is reachable, for instance before announcing it,
+// and returns the time it took. Tor only completes the connection once
+// it reached the service, so a descriptor which failed to publish makes
+// the check fail. Publication can take a while after listening, so
+// ctx should allow for it. If handshake is not nil it is run on the
+// connection, which counts towards the returned time, and its error
+// fails the check.
+//
+// The probe connection is delivered to Accept like any other, where it
+// is closed by the remote end once the check is done; handshake may
+// exchange a message to let the application tell it apart.
+func (l *OnionListener) CheckReachable(ctx context.Context, handshake func(conn net.Conn) error) (time.Duration, error) {
+	dialer := &OnionDialer{auth: l.transport.auth, transport: l.transport}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, l.laddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if handshake != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if err := handshake(conn); err != nil {
+			return 0, err
+		}
+	}
+	rtt := time.Since(start)
+	l.transport.log().Debug("onion service reachable", "addr", l.laddr, "rtt", rtt)
+	return rtt, nil
+}
@@ -0,0 +1,74 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+func TestCheckReachable(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fs := testutil.NewSOCKSServer(t)
+	fs.Control = fc
+	fc.SetSOCKSAddr(fs.Addr())
+	tpt := newControlTransport(t, fc)
+
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the application answers probes with "pong"
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err == nil && string(buf) == "ping" {
+					conn.Write([]byte("pong"))
+				}
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rtt, err := l.CheckReachable(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("unexpected round-trip time %v", rtt)
+	}
+
+	ping := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if string(buf) != "pong" {
+			return errors.New("unexpected reply")
+		}
+		return nil
+	}
+	if _, err := l.CheckReachable(ctx, ping); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the service is gone tor cannot reach it
+	l.Close()
+	if _, err := l.CheckReachable(ctx, nil); err == nil {
+		t.Fatal("closed onion service is reachable")
+	}
+}
@@ -0,0 +1,52 @@
+package torOnion
+
+import "time"
+
+// WithIdleTimeout makes accepted and dialed connections close once no
+// data has been read or written for d, so that idle or stalled peers
+// cannot hold on to an onion service's resources. By default
+// connections are kept open until closed.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(t *OnionTransport) {
+		t.idleTimeout = d
+	}
+}
+
+// startIdleTimer closes c after it has been idle for d, if d is positive
+func (c *OnionConn) startIdleTimer(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.idleTimeout = d
+	c.idleTimer = time.AfterFunc(d, func() { c.Close() })
+}
+
+// touch restarts the idle and keep-alive timers after activity on c
+func (c *OnionConn) touch() {
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+	if c.keepAliveTimer != nil {
+		c.keepAliveTimer.Reset(c.keepAliveInterval)
+	}
+}
+
+// Read reads data from the connection
+func (c *OnionConn) Read(b []byte) (int, error) {
+	n, err := c.stream().Read(b)
+	if n > 0 {
+		c.touch()
+		c.countRead(n)
+	}
+	return n, err
+}
+
+// Write writes data to the connection
+func (c *OnionConn) Write(b []byte) (int, error) {
+	n, err := c.stream().Write(b)
+	if n > 0 {
+		c.touch()
+		c.countWritten(n)
+	}
+	return n, err
+}
@@ -0,0 +1,77 @@
+package torOnion
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, WithIdleTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// activity keeps the connection open past the timeout
+	buf := make([]byte, 4)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("active connection closed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// an idle connection is closed, unblocking the pending read
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatal("read succeeded on an idle connection")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+func TestIdleTimeoutAccepted(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	WithIdleTimeout(100 * time.Millisecond)(transport)
+	l, err := transport.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := dialListener(t, l)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the idle accepted connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package torOnion
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/net/proxy"
+)
+
+// IsolationMode controls how outbound connections are spread across tor
+// circuits. Tor isolates streams with distinct SOCKS credentials onto
+// separate circuits (IsolateSOCKSAuth, enabled by default), so isolation
+// is achieved by deriving a SOCKS username from an isolation token.
+type IsolationMode int
+
+const (
+	// IsolateNone uses the configured SOCKS credentials for every dial so
+	// connections may share circuits. This is the default and performs
+	// best, but connections to different peers are linkable.
+	IsolateNone IsolationMode = iota
+	// IsolateDestination uses a separate circuit for each remote address
+	IsolateDestination
+	// IsolateDial uses a separate circuit for every dial
+	IsolateDial
+)
+
+// isolationToken returns the isolation token for a dial to raddr, or
+// the empty string if connections are not isolated
+func isolationToken(mode IsolationMode, raddr ma.Multiaddr) string {
+	switch mode {
+	case IsolateDestination:
+		sum := sha256.Sum256(raddr.Bytes())
+		return hex.EncodeToString(sum[:16])
+	case IsolateDial:
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		return hex.EncodeToString(b)
+	}
+	return ""
+}
+
+// isolationAuth returns the SOCKS credentials for a dial to raddr
+func isolationAuth(auth *proxy.Auth, mode IsolationMode, raddr ma.Multiaddr) *proxy.Auth {
+	return isolatedAuth(auth, isolationToken(mode, raddr))
+}
+
+// isolatedAuth returns the SOCKS credentials for the isolation token.
+// The configured password, if any, is kept alongside the token.
+func isolatedAuth(auth *proxy.Auth, token string) *proxy.Auth {
+	if token == "" {
+		return auth
+	}
+	isolated := &proxy.Auth{User: token, Password: token}
+	if auth != nil && auth.Password != "" {
+		isolated.Password = auth.Password
+	}
+	return isolated
+}
+
+// WithIsolationBuckets additionally isolates connections by the time
+// they are dialed: time is cut into buckets of duration d, and
+// connections dialed in different buckets use separate circuits even
+// when the isolation mode would let them share one. Within a bucket
+// circuits are reused as the mode allows, so shorter buckets make
+// connections harder to correlate at the cost of building more
+// circuits. Bucket boundaries are offset by a random jitter chosen per
+// transport, so that they do not line up across transports.
+// IsolateDial already uses a separate circuit for every dial and is
+// unaffected.
+func WithIsolationBuckets(d time.Duration) Option {
+	return func(t *OnionTransport) {
+		t.isolationBucket = d
+		t.isolationJitter = 0
+		if d > 0 {
+			jitter, err := rand.Int(rand.Reader, big.NewInt(int64(d)))
+			if err != nil {
+				panic(err)
+			}
+			t.isolationJitter = time.Duration(jitter.Int64())
+		}
+	}
+}
+
+// bucketToken mixes the index of a time bucket into an isolation token
+func bucketToken(token string, bucket int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", token, bucket)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// dialAuth returns the SOCKS credentials for a dial to raddr at now,
+// isolated as set with WithStreamIsolation and WithIsolationBuckets
+func (t *OnionTransport) dialAuth(auth *proxy.Auth, raddr ma.Multiaddr, now time.Time) *proxy.Auth {
+	if t.isolationBucket <= 0 || t.isolation == IsolateDial {
+		return isolationAuth(auth, t.isolation, raddr)
+	}
+	bucket := now.Add(t.isolationJitter).UnixNano() / int64(t.isolationBucket)
+	return isolatedAuth(auth, bucketToken(isolationToken(t.isolation, raddr), bucket))
+}
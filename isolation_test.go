@@ -0,0 +1,93 @@
+package torOnion
+
+import (
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/net/proxy"
+)
+
+func TestIsolationAuth(t *testing.T) {
+	a, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &proxy.Auth{User: "user", Password: "pass"}
+
+	if auth := isolationAuth(base, IsolateNone, a); auth != base {
+		t.Fatalf("IsolateNone changed the credentials: %+v", auth)
+	}
+
+	authA := isolationAuth(base, IsolateDestination, a)
+	if authA.User == base.User || authA.Password != base.Password {
+		t.Fatalf("unexpected isolated credentials: %+v", authA)
+	}
+	if again := isolationAuth(base, IsolateDestination, a); again.User != authA.User {
+		t.Fatal("same destination was not given the same isolation token")
+	}
+	if authB := isolationAuth(base, IsolateDestination, b); authB.User == authA.User {
+		t.Fatal("different destinations share an isolation token")
+	}
+
+	first := isolationAuth(nil, IsolateDial, a)
+	second := isolationAuth(nil, IsolateDial, a)
+	if first.User == second.User {
+		t.Fatal("separate dials share an isolation token")
+	}
+	if first.Password == "" {
+		t.Fatal("isolated credentials have an empty password")
+	}
+}
+
+func TestIsolationBuckets(t *testing.T) {
+	a, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt := &OnionTransport{}
+	WithIsolationBuckets(time.Minute)(tpt)
+	if tpt.isolationJitter < 0 || tpt.isolationJitter >= time.Minute {
+		t.Fatalf("jitter %v outside of the bucket", tpt.isolationJitter)
+	}
+	tpt.isolationJitter = 0
+	start := time.Unix(6000, 0)
+
+	// without stream isolation all dials of a bucket share a token
+	first := tpt.dialAuth(nil, a, start)
+	if first == nil || first.User == "" {
+		t.Fatal("bucketed dial was not isolated")
+	}
+	if same := tpt.dialAuth(nil, b, start.Add(59*time.Second)); same.User != first.User {
+		t.Fatal("dials within a bucket use different tokens")
+	}
+	if next := tpt.dialAuth(nil, a, start.Add(time.Minute)); next.User == first.User {
+		t.Fatal("dials across a bucket boundary share a token")
+	}
+
+	WithStreamIsolation(IsolateDestination)(tpt)
+	authA := tpt.dialAuth(nil, a, start)
+	if again := tpt.dialAuth(nil, a, start.Add(30*time.Second)); again.User != authA.User {
+		t.Fatal("same destination within a bucket uses different tokens")
+	}
+	if authB := tpt.dialAuth(nil, b, start); authB.User == authA.User {
+		t.Fatal("different destinations share a token")
+	}
+	if later := tpt.dialAuth(nil, a, start.Add(90*time.Second)); later.User == authA.User {
+		t.Fatal("same destination across a bucket boundary shares a token")
+	}
+
+	// the jitter moves the bucket boundaries
+	tpt.isolationJitter = 30 * time.Second
+	if shifted := tpt.dialAuth(nil, a, start.Add(30*time.Second)); shifted.User == authA.User {
+		t.Fatal("jitter did not move the bucket boundary")
+	}
+}
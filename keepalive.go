@@ -0,0 +1,38 @@
+package torOnion
+
+import "time"
+
+// WithKeepAlive makes accepted and dialed connections write heartbeat
+// once no data has been read or written for interval, so that circuits
+// torn down while idle are noticed: a connection whose heartbeat cannot
+// be written is closed. The heartbeat is sent on the raw stream, so it
+// must be something the application protocol on the other end skips.
+// An empty heartbeat writes nothing and only detects connections closed
+// locally. By default no keep-alives are sent.
+func WithKeepAlive(interval time.Duration, heartbeat []byte) Option {
+	return func(t *OnionTransport) {
+		t.keepAliveInterval = interval
+		t.keepAliveHeartbeat = append([]byte(nil), heartbeat...)
+	}
+}
+
+// startKeepAlive writes heartbeat on c each time it has been idle for
+// interval, if interval is positive
+func (c *OnionConn) startKeepAlive(interval time.Duration, heartbeat []byte) {
+	if interval <= 0 {
+		return
+	}
+	c.keepAliveInterval = interval
+	c.keepAliveTimer = time.AfterFunc(interval, func() { c.keepAlive(heartbeat) })
+}
+
+// keepAlive writes heartbeat on c, closing c if that fails
+func (c *OnionConn) keepAlive(heartbeat []byte) {
+	n, err := c.stream().Write(heartbeat)
+	c.countWritten(n)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.keepAliveTimer.Reset(c.keepAliveInterval)
+}
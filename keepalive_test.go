@@ -0,0 +1,80 @@
+package torOnion
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestKeepAlive(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, WithKeepAlive(100*time.Millisecond, []byte("beat")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the proxy echoes the heartbeat sent on the idle connection
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "beat" {
+		t.Fatalf("received %q", buf)
+	}
+	if n := conn.(*OnionConn).BytesWritten(); n < 4 {
+		t.Fatalf("heartbeat not counted, %d bytes written", n)
+	}
+}
+
+func TestKeepAliveClosesDeadConn(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	WithKeepAlive(50*time.Millisecond, []byte{0})(transport)
+	l, err := transport.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := dialListener(t, l)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client.Close()
+
+	// writing to the closed peer fails once it has reset the stream
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		transport.mtx.Lock()
+		open := len(transport.conns)
+		transport.mtx.Unlock()
+		if open == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection to a closed peer was kept open")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,170 @@
+package torOnion
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	errKeyPassphraseRequired = errors.New("onion key is encrypted and no passphrase is configured")
+	errKeyPassphrase         = errors.New("wrong passphrase for encrypted onion key")
+)
+
+// encryptedKeyType is the PEM block type of PKCS#8 encrypted keys
+const encryptedKeyType = "ENCRYPTED PRIVATE KEY"
+
+// WithKeyPassphrase makes encrypted onion keys in keysDir and those
+// passed to AddKey be decrypted with the passphrase returned by fn for
+// the key's name, empty for unnamed keys given to AddKey. Keys may be
+// PKCS#8 "ENCRYPTED PRIVATE KEY" files using PBES2 with PBKDF2 and
+// AES-CBC, as written by "openssl pkcs8 -topk8 -v2 aes256", or PEM files
+// encrypted the legacy OpenSSL way, with a Proc-Type header. Keys are
+// decrypted in memory as they are loaded; unencrypted keys are loaded
+// as before.
+func WithKeyPassphrase(fn func(name string) ([]byte, error)) Option {
+	return func(t *OnionTransport) {
+		t.keyPassphrase = fn
+	}
+}
+
+// Object identifiers of the PBES2 algorithms supported for encrypted
+// keys, from RFC 8018 and NIST
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo is the PKCS#8 EncryptedPrivateKeyInfo
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptKeyPEM returns data, a PEM encoded key named name, with its
+// first block decrypted if it is encrypted, using the passphrase set
+// with WithKeyPassphrase. Unencrypted keys are returned unchanged.
+func (t *OnionTransport) decryptKeyPEM(name string, data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || (block.Type != encryptedKeyType && !x509.IsEncryptedPEMBlock(block)) {
+		return data, nil
+	}
+	if t.keyPassphrase == nil {
+		return nil, errKeyPassphraseRequired
+	}
+	pass, err := t.keyPassphrase(name)
+	if err != nil {
+		return nil, fmt.Errorf("onion key passphrase: %w", err)
+	}
+	if block.Type == encryptedKeyType {
+		der, err := decryptPKCS8(block.Bytes, pass)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	der, err := x509.DecryptPEMBlock(block, pass)
+	if err == x509.IncorrectPasswordError {
+		return nil, errKeyPassphrase
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
+
+// decryptPKCS8 decrypts a PBES2 encrypted PKCS#8 key, returning the
+// DER encoded PrivateKeyInfo
+func decryptPKCS8(data, pass []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("malformed encrypted key: %v", err)
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %v, only PBES2 is supported", info.Algo.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("malformed PBES2 parameters: %v", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %v, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("malformed PBKDF2 parameters: %v", err)
+	}
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 function %v", kdf.PRF.Algorithm)
+	}
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported key cipher %v", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("malformed key cipher IV")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("malformed encrypted key data")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(pass, kdf.Salt, kdf.IterationCount, keyLen, prf))
+	if err != nil {
+		return nil, err
+	}
+	der := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(der, info.EncryptedData)
+	// a wrong passphrase shows as bad padding or a garbled key
+	pad := int(der[len(der)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errKeyPassphrase
+	}
+	for _, b := range der[len(der)-pad:] {
+		if int(b) != pad {
+			return nil, errKeyPassphrase
+		}
+	}
+	der = der[:len(der)-pad]
+	if _, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+		return nil, errKeyPassphrase
+	}
+	return der, nil
+}
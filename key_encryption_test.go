@@ -0,0 +1,154 @@
+package torOnion
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/yawning/bulb/utils/pkcs1"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptPKCS8 encrypts key as a PKCS#8 "ENCRYPTED PRIVATE KEY" with
+// PBKDF2-HMAC-SHA256 and AES-256-CBC, like openssl pkcs8 -v2 aes256
+func encryptPKCS8(t *testing.T, key ed25519.PrivateKey, pass []byte) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, iv := make([]byte, 8), make([]byte, aes.BlockSize)
+	rand.Read(salt)
+	rand.Read(iv)
+	block, err := aes.NewCipher(pbkdf2.Key(pass, salt, 2048, 32, sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	for i := 0; i < pad; i++ {
+		der = append(der, byte(pad))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(der, der)
+
+	marshal := func(v interface{}) asn1.RawValue {
+		b, err := asn1.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asn1.RawValue{FullBytes: b}
+	}
+	info := encryptedPrivateKeyInfo{
+		Algo: pkix.AlgorithmIdentifier{
+			Algorithm: oidPBES2,
+			Parameters: marshal(pbes2Params{
+				KeyDerivationFunc: pkix.AlgorithmIdentifier{
+					Algorithm: oidPBKDF2,
+					Parameters: marshal(pbkdf2Params{
+						Salt:           salt,
+						IterationCount: 2048,
+						PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+					}),
+				},
+				EncryptionScheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: marshal(iv)},
+			}),
+		},
+		EncryptedData: der,
+	}
+	b, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedKeyType, Bytes: b})
+}
+
+func TestEncryptedKeys(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3 := onionV3Address(pub)
+	if err := ioutil.WriteFile(filepath.Join(dir, v3+".onion_v3_key"), encryptPKCS8(t, priv, []byte("v3 secret")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, onionKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := pkcs1.OnionAddr(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), []byte("v2 secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, v2+".onion_key"), pem.EncodeToMemory(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	passphrases := map[string][]byte{v2: []byte("v2 secret"), v3: []byte("v3 secret")}
+	tpt := &OnionTransport{keysDir: dir}
+	if _, err := tpt.loadKeys(); !errors.Is(err, errKeyPassphraseRequired) {
+		t.Fatalf("expected errKeyPassphraseRequired, got %v", err)
+	}
+	WithKeyPassphrase(func(name string) ([]byte, error) {
+		return passphrases[name], nil
+	})(tpt)
+	keys, err := tpt.loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := keys[v3].(ed25519.PrivateKey); !ok || !k.Equal(priv) {
+		t.Fatal("encrypted v3 key was not decrypted")
+	}
+	if k, ok := keys[v2].(*rsa.PrivateKey); !ok || !k.Equal(rsaKey) {
+		t.Fatal("encrypted v2 key was not decrypted")
+	}
+
+	passphrases[v3] = []byte("wrong")
+	if _, err := tpt.loadKeys(); !errors.Is(err, errKeyPassphrase) {
+		t.Fatalf("expected errKeyPassphrase, got %v", err)
+	}
+}
+
+func TestAddEncryptedKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := encryptPKCS8(t, priv, []byte("secret"))
+	pass := []byte("wrong")
+	tpt := &OnionTransport{}
+	WithKeyPassphrase(func(string) ([]byte, error) { return pass, nil })(tpt)
+	if err := tpt.AddKey("", pemBytes); !errors.Is(err, errKeyPassphrase) {
+		t.Fatalf("expected errKeyPassphrase, got %v", err)
+	}
+	pass = []byte("secret")
+	if err := tpt.AddKey("", pemBytes); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tpt.getKey(onionV3Address(pub)); !ok {
+		t.Fatal("decrypted key was not added")
+	}
+
+	// unencrypted keys need no passphrase
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := &OnionTransport{}
+	if err := plain.AddKey("plain", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+}
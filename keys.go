@@ -0,0 +1,277 @@
+package torOnion
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/yawning/bulb/utils/pkcs1"
+)
+
+// onionKeyBits is the RSA key size tor requires for v2 onion services
+const onionKeyBits = 1024
+
+// decodeOnionKey decodes a PEM encoded PKCS#1 RSA key for a v2 onion service
+func decodeOnionKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	key, _, err := pkcs1.DecodePrivateKeyDER(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("no RSA key found")
+	}
+	if bits := key.N.BitLen(); bits != onionKeyBits {
+		return nil, fmt.Errorf("%d-bit RSA key is not supported, v2 onion services require %d bits", bits, onionKeyBits)
+	}
+	return key, nil
+}
+
+// decodeOnionV3Key decodes a PEM encoded PKCS#8 ed25519 key for a v3 onion service
+func decodeOnionV3Key(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ed25519 key, found %T", key)
+	}
+	return edKey, nil
+}
+
+// GenerateOnionKey creates a new 1024-bit RSA key for a v2 onion service
+// and saves it as <name>.onion_key in keysDir, where loadKeys will find
+// it. If name is empty the onion address is used, which is the name
+// Listen looks keys up by. The onion address, without the ".onion"
+// suffix, is returned. An existing key file is never overwritten.
+func GenerateOnionKey(keysDir, name string) (onionAddress string, err error) {
+	return GenerateOnionKeyBits(keysDir, name, onionKeyBits)
+}
+
+// GenerateOnionKeyBits is like GenerateOnionKey but creates a bits-bit
+// RSA key, 1024 if bits is 0. Tor only accepts 1024-bit keys for v2
+// onion services, which is what loadKeys enforces, so other sizes are
+// only useful for testing and interoperability.
+func GenerateOnionKeyBits(keysDir, name string, bits int) (onionAddress string, err error) {
+	if bits == 0 {
+		bits = onionKeyBits
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return "", err
+	}
+	return SaveOnionKey(keysDir, name, priv)
+}
+
+// GenerateOnionV3Key creates a new ed25519 key for a v3 onion service and
+// saves it PKCS#8 encoded as <name>.onion_v3_key in keysDir. If name is
+// empty the onion address is used. The onion address, without the
+// ".onion" suffix, is returned. An existing key file is never overwritten.
+func GenerateOnionV3Key(keysDir, name string) (onionAddress string, err error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return SaveOnionKey(keysDir, name, priv)
+}
+
+// SaveOnionKey saves key, an *rsa.PrivateKey for a v2 or an
+// ed25519.PrivateKey for a v3 onion service, to keysDir in the format
+// loadKeys reads, as <name>.onion_key or <name>.onion_v3_key. This
+// persists the key of an ephemeral listener, obtained from its
+// PrivateKey method or WithKeyCallback, so the same onion address can
+// be published again. If name is empty the onion address is used. The
+// onion address, without the ".onion" suffix, is returned. An existing
+// key file is never overwritten.
+func SaveOnionKey(keysDir, name string, key crypto.PrivateKey) (onionAddress string, err error) {
+	onionAddress, err = onionKeyAddress(key, false)
+	if err != nil {
+		return "", err
+	}
+	var block *pem.Block
+	var ext string
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		der, err := pkcs1.EncodePrivateKeyDER(k)
+		if err != nil {
+			return "", err
+		}
+		block, ext = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}, ".onion_key"
+	case ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		block, ext = &pem.Block{Type: "PRIVATE KEY", Bytes: der}, ".onion_v3_key"
+	}
+	if name == "" {
+		name = onionAddress
+	}
+	if err := writeKeyFile(filepath.Join(keysDir, name+ext), block); err != nil {
+		return "", err
+	}
+	return onionAddress, nil
+}
+
+// FormatOnionAddress derives the onion address of an onion service
+// from its public key, an *rsa.PublicKey for v2 or an ed25519.PublicKey
+// for v3 services. The address is in lowercase and, if withSuffix is
+// set, ends in ".onion", the form dialed through tor; without it, it is
+// the service id used in multiaddrs and by the control port. An empty
+// string is returned for other key types. Addresses are formatted this
+// way throughout the package.
+func FormatOnionAddress(pubkey crypto.PublicKey, withSuffix bool) string {
+	var id string
+	switch k := pubkey.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if id, err = pkcs1.OnionAddr(k); err != nil {
+			return ""
+		}
+	case ed25519.PublicKey:
+		if len(k) != ed25519.PublicKeySize {
+			return ""
+		}
+		id = onionV3Address(k)
+	default:
+		return ""
+	}
+	id = normalizeOnionHost(id)
+	if withSuffix {
+		return id + ".onion"
+	}
+	return id
+}
+
+// onionKeyAddress derives the onion address of an *rsa.PrivateKey or
+// ed25519.PrivateKey, formatted as by FormatOnionAddress
+func onionKeyAddress(key crypto.PrivateKey, withSuffix bool) (string, error) {
+	var pub crypto.PublicKey
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pub = &k.PublicKey
+	case ed25519.PrivateKey:
+		pub = k.Public()
+	default:
+		return "", fmt.Errorf("unsupported onion service key type %T", key)
+	}
+	if id := FormatOnionAddress(pub, withSuffix); id != "" {
+		return id, nil
+	}
+	return "", errors.New("cannot derive the onion address of the key")
+}
+
+// checkKeyProtocol verifies that key is of the type used by onion
+// services of the multiaddr protocol code, RSA for onion and ed25519 for
+// onion3
+func checkKeyProtocol(code int, key crypto.PrivateKey) error {
+	var found string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		if code == ma.P_ONION {
+			return nil
+		}
+		found = "RSA"
+	case ed25519.PrivateKey:
+		if code == ma.P_ONION3 {
+			return nil
+		}
+		found = "ed25519"
+	default:
+		found = fmt.Sprintf("%T", key)
+	}
+	if code == ma.P_ONION3 {
+		return fmt.Errorf("onion3 address requires an ed25519 key, found %s", found)
+	}
+	return fmt.Errorf("onion address requires an RSA key, found %s", found)
+}
+
+// AddKey registers an onion service key held in memory, for instance
+// fetched from a secrets manager, so that Listen can use it like the
+// keys loaded from keysDir. pemBytes is either a PKCS#1 RSA key for a v2
+// or a PKCS#8 ed25519 key for a v3 onion service, as in .onion_key and
+// .onion_v3_key files, possibly encrypted as set out in
+// WithKeyPassphrase. If name is empty the onion address is used, which
+// is the name Listen looks keys up by. Adding a key under a name
+// already in use fails.
+func (t *OnionTransport) AddKey(name string, pemBytes []byte) error {
+	pemBytes, err := t.decryptKeyPEM(name, pemBytes)
+	if err != nil {
+		return fmt.Errorf("invalid onion key: %w", err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return errors.New("no PEM encoded key found")
+	}
+	var key crypto.PrivateKey
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = decodeOnionKey(pemBytes)
+	} else {
+		key, err = decodeOnionV3Key(pemBytes)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid onion key: %v", err)
+	}
+	if name == "" {
+		if name, err = onionKeyAddress(key, false); err != nil {
+			return err
+		}
+	}
+	t.keysMtx.Lock()
+	defer t.keysMtx.Unlock()
+	if _, ok := t.keys[name]; ok {
+		return fmt.Errorf("onion service key %s already loaded", name)
+	}
+	if t.keys == nil {
+		t.keys = make(map[string]crypto.PrivateKey)
+	}
+	t.keys[name] = key
+	return nil
+}
+
+// OnionAddresses returns the onion address, with the ".onion" suffix,
+// of each loaded key by key name, so that the addresses can be
+// advertised before listening
+func (t *OnionTransport) OnionAddresses() (map[string]string, error) {
+	t.keysMtx.RLock()
+	defer t.keysMtx.RUnlock()
+	addrs := make(map[string]string, len(t.keys))
+	for name, key := range t.keys {
+		addr, err := onionKeyAddress(key, true)
+		if err != nil {
+			return nil, fmt.Errorf("onion service key %s: %v", name, err)
+		}
+		addrs[name] = addr
+	}
+	return addrs, nil
+}
+
+// writeKeyFile PEM encodes block into a new file only readable by its owner
+func writeKeyFile(path string, block *pem.Block) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, block); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,476 @@
+package torOnion
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/yawning/bulb/utils/pkcs1"
+)
+
+func TestGenerateOnionKey(t *testing.T) {
+	dir := t.TempDir()
+	v2, err := GenerateOnionKey(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3, err := GenerateOnionV3Key(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{v2 + ".onion_key", v3 + ".onion_v3_key"} {
+		fi, err := os.Stat(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Fatalf("%s has permissions %v", file, fi.Mode().Perm())
+		}
+	}
+
+	tpt := &OnionTransport{keysDir: dir}
+	keys, err := tpt.loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, ok := keys[v2].(*rsa.PrivateKey)
+	if !ok {
+		t.Fatal("generated v2 key was not loaded")
+	}
+	if id, _ := pkcs1.OnionAddr(&rsaKey.PublicKey); id != v2 {
+		t.Fatalf("v2 key derives to %s, expected %s", id, v2)
+	}
+	edKey, ok := keys[v3].(ed25519.PrivateKey)
+	if !ok {
+		t.Fatal("generated v3 key was not loaded")
+	}
+	if id := onionV3Address(edKey.Public().(ed25519.PublicKey)); id != v3 {
+		t.Fatalf("v3 key derives to %s, expected %s", id, v3)
+	}
+
+	if _, err := GenerateOnionKey(dir, v2); err == nil {
+		t.Fatal("existing key file was overwritten")
+	}
+}
+
+func TestGenerateOnionKeyBits(t *testing.T) {
+	dir := t.TempDir()
+	name, err := GenerateOnionKeyBits(dir, "", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt := &OnionTransport{keysDir: dir}
+	keys, err := tpt.loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys[name]; !ok {
+		t.Fatalf("1024-bit key %s not loaded", name)
+	}
+
+	// tor rejects other sizes, so loading them fails
+	dir = t.TempDir()
+	if _, err := GenerateOnionKeyBits(dir, "big", 2048); err != nil {
+		t.Fatal(err)
+	}
+	tpt = &OnionTransport{keysDir: dir}
+	_, err = tpt.loadKeys()
+	if err == nil || !strings.Contains(err.Error(), "2048-bit RSA key is not supported, v2 onion services require 1024 bits") {
+		t.Fatalf("expected a key size error, got %v", err)
+	}
+}
+
+func TestAddKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	if err := tpt.AddKey("", pemBytes); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpt.AddKey("", pemBytes); err == nil {
+		t.Fatal("added the same key twice")
+	}
+	if err := tpt.AddKey("broken", []byte("not a key")); err == nil {
+		t.Fatal("added an invalid key")
+	}
+
+	id := onionV3Address(priv.Public().(ed25519.PublicKey))
+	addr, err := ma.NewMultiaddr("/onion3/" + id + ":4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tpt.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !l.Multiaddr().Equal(addr) {
+		t.Fatalf("listened on %s, expected %s", l.Multiaddr(), addr)
+	}
+	if !fc.HasOnion(id) {
+		t.Fatal("onion service was not registered with the added key")
+	}
+}
+
+func TestOnionAddresses(t *testing.T) {
+	// the ed25519 key with an all zero seed
+	priv := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt := &OnionTransport{}
+	if err := tpt.AddKey("service", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	v2, err := GenerateOnionKey(dir, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := (&OnionTransport{keysDir: dir}).loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.keys["legacy"] = added["legacy"]
+
+	addrs, err := tpt.OnionAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"service": "hnvcppgow2sc2yvdvdicu3ynonsteflxdxrehjr2ybekdc2z3iu63yid.onion",
+		"legacy":  v2 + ".onion",
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("got addresses %v, expected %v", addrs, want)
+	}
+	for name, addr := range want {
+		if addrs[name] != addr {
+			t.Fatalf("key %s has address %s, expected %s", name, addrs[name], addr)
+		}
+	}
+}
+
+func TestReloadKeys(t *testing.T) {
+	dir := t.TempDir()
+	first, err := GenerateOnionKey(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt := &OnionTransport{keysDir: dir}
+	keys, err := tpt.loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.setKeys(keys)
+
+	second, err := GenerateOnionV3Key(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := tpt.ReloadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != second {
+		t.Fatalf("expected %s to be added, got %v", second, added)
+	}
+	for _, name := range []string{first, second} {
+		if _, ok := tpt.getKey(name); !ok {
+			t.Fatalf("key %s missing after reload", name)
+		}
+	}
+
+	added, err = tpt.ReloadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 {
+		t.Fatalf("expected no keys to be added, got %v", added)
+	}
+}
+
+func TestLoadInvalidKeys(t *testing.T) {
+	bigKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := pkcs1.EncodePrivateKeyDER(bigKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not-pem", []byte("not a key")},
+		{"wrong-size", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, test.name+".onion_key")
+			if err := ioutil.WriteFile(path, test.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			tpt := &OnionTransport{keysDir: dir}
+			_, err := tpt.loadKeys()
+			if err == nil {
+				t.Fatal("invalid key was loaded")
+			}
+			if !strings.Contains(err.Error(), path) {
+				t.Fatalf("error does not name the key file: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadMissingKeysDir(t *testing.T) {
+	for _, dir := range []string{"", filepath.Join(t.TempDir(), "missing")} {
+		tpt := &OnionTransport{keysDir: dir}
+		keys, err := tpt.loadKeys()
+		if err != nil {
+			t.Fatalf("keys directory %q: %v", dir, err)
+		}
+		if len(keys) != 0 {
+			t.Fatalf("keys directory %q: loaded %d keys", dir, len(keys))
+		}
+	}
+
+	fc := testutil.NewControlServer(t)
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, filepath.Join(t.TempDir(), "missing"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.Close()
+}
+
+func TestLoadManyKeys(t *testing.T) {
+	// more key files than the usual default descriptor limit, which
+	// would be exhausted if files were held open during the walk
+	const n = 2048
+	dir := t.TempDir()
+	name, err := GenerateOnionKey(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, name+".onion_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < n; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("key%d.onion_key", i)), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tpt := &OnionTransport{keysDir: dir}
+	keys, err := tpt.loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != n {
+		t.Fatalf("loaded %d keys, expected %d", len(keys), n)
+	}
+}
+
+func TestPersistEphemeralKey(t *testing.T) {
+	for _, proto := range []string{"onion", "onion3"} {
+		dir := t.TempDir()
+		fc := testutil.NewControlServer(t)
+		tpt := newControlTransport(t, fc)
+		tpt.keysDir = dir
+
+		var saved string
+		persist := WithKeyCallback(func(serviceID string, key crypto.PrivateKey) {
+			name, err := SaveOnionKey(dir, "", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != serviceID {
+				t.Fatalf("saved key for %s as %s", serviceID, name)
+			}
+			saved = name
+		})
+		var l *OnionListener
+		var err error
+		if proto == "onion" {
+			l, err = tpt.ListenEphemeral(4003, persist)
+		} else {
+			l, err = tpt.ListenEphemeralV3(4003, persist)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Multiaddr()
+		l.Close()
+		if saved != l.serviceID {
+			t.Fatalf("%s: key callback not called for %s", proto, l.serviceID)
+		}
+
+		// the persisted key publishes the same address again
+		if _, err := tpt.ReloadKeys(); err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != fmt.Sprintf("/%s/%s:4003", proto, saved) {
+			t.Fatalf("unexpected ephemeral address %s", addr)
+		}
+		laddr, err := ma.NewMultiaddr(addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		relisten, err := tpt.Listen(laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !relisten.Multiaddr().Equal(addr) {
+			t.Fatalf("listened on %s, expected %s", relisten.Multiaddr(), addr)
+		}
+		relisten.Close()
+	}
+}
+
+func TestListenMisnamedKey(t *testing.T) {
+	dir := t.TempDir()
+	// keys saved under addresses they do not derive to
+	if _, err := GenerateOnionKey(dir, "erhkddypoy6qml6h"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateOnionV3Key(dir, "hnvcppgow2sc2yvdvdicu3ynonsteflxdxrehjr2ybekdc2z3iu63yid"); err != nil {
+		t.Fatal(err)
+	}
+	correct, err := GenerateOnionV3Key(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := testutil.NewControlServer(t)
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	for _, s := range []string{
+		"/onion/erhkddypoy6qml6h:4003",
+		"/onion3/hnvcppgow2sc2yvdvdicu3ynonsteflxdxrehjr2ybekdc2z3iu63yid:4003",
+	} {
+		laddr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tpt.Listen(laddr)
+		if err == nil || !strings.Contains(err.Error(), "belongs to") {
+			t.Fatalf("%s: expected a key mismatch error, got %v", s, err)
+		}
+	}
+	for _, c := range fc.Commands() {
+		if c == "ADD_ONION" {
+			t.Fatal("misnamed key was published")
+		}
+	}
+
+	laddr, err := ma.NewMultiaddr("/onion3/" + correct + ":4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tpt.Listen(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestListenKeyTypeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	// keys of the other onion service version saved under the address
+	if _, err := GenerateOnionV3Key(dir, "erhkddypoy6qml6h"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateOnionKey(dir, "hnvcppgow2sc2yvdvdicu3ynonsteflxdxrehjr2ybekdc2z3iu63yid"); err != nil {
+		t.Fatal(err)
+	}
+	fc := testutil.NewControlServer(t)
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	for addr, msg := range map[string]string{
+		"/onion/erhkddypoy6qml6h:4003":                                          "onion address requires an RSA key, found ed25519",
+		"/onion3/hnvcppgow2sc2yvdvdicu3ynonsteflxdxrehjr2ybekdc2z3iu63yid:4003": "onion3 address requires an ed25519 key, found RSA",
+	} {
+		laddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tpt.Listen(laddr); err == nil || err.Error() != msg {
+			t.Fatalf("%s: expected %q, got %v", addr, msg, err)
+		}
+	}
+	for _, c := range fc.Commands() {
+		if c == "ADD_ONION" {
+			t.Fatal("key of the wrong type was published")
+		}
+	}
+}
+
+func TestFormatOnionAddress(t *testing.T) {
+	// 2^1023+1 is not a usable modulus but formats like any other key
+	n := new(big.Int).Lsh(big.NewInt(1), 1023)
+	n.Add(n, big.NewInt(1))
+	rsaPub := &rsa.PublicKey{N: n, E: 65537}
+	edPub := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	for i := range edPub {
+		edPub[i] = byte(i)
+	}
+
+	for _, tc := range []struct {
+		pub        crypto.PublicKey
+		withSuffix bool
+		want       string
+	}{
+		{rsaPub, false, "2wa2xitrojjba6h3"},
+		{rsaPub, true, "2wa2xitrojjba6h3.onion"},
+		{edPub, false, "aaaqeayeaudaocajbifqydiob4ibceqtcqkrmfyydenbwha5dyp3kead"},
+		{edPub, true, "aaaqeayeaudaocajbifqydiob4ibceqtcqkrmfyydenbwha5dyp3kead.onion"},
+	} {
+		if got := FormatOnionAddress(tc.pub, tc.withSuffix); got != tc.want {
+			t.Errorf("%T with suffix %t formatted as %q, expected %q", tc.pub, tc.withSuffix, got, tc.want)
+		}
+	}
+	if err := ValidateV3OnionAddress(FormatOnionAddress(edPub, true)); err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatOnionAddress(edPub[:16], false); got != "" {
+		t.Fatalf("short ed25519 key formatted as %q", got)
+	}
+	if got := FormatOnionAddress("not a key", true); got != "" {
+		t.Fatalf("unsupported key formatted as %q", got)
+	}
+}
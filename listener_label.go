@@ -0,0 +1,46 @@
+package torOnion
+
+// WithLabel tags the listener with label, an opaque string for the
+// application to tell its onion services apart. Connections accepted
+// on the listener carry the label, which is passed to the ConnState
+// hook and to Metrics implementing LabeledMetrics.
+func WithLabel(label string) ListenOption {
+	return func(c *listenConfig) {
+		c.label = label
+	}
+}
+
+// LabeledMetrics may be implemented by Metrics to also count the
+// connections accepted on listeners created WithLabel, by label. Its
+// methods are called along with Accept and ConnClosed.
+type LabeledMetrics interface {
+	LabeledAccept(label string)
+	LabeledConnClosed(label string)
+}
+
+// Label returns the label the listener was created with, if any
+func (l *OnionListener) Label() string {
+	return l.label
+}
+
+// Label returns the label of the listener which accepted the
+// connection, empty for dialed connections
+func (c *OnionConn) Label() string {
+	return c.label
+}
+
+// labeledAccept tells m about a connection accepted on a listener
+// labeled label
+func labeledAccept(m Metrics, label string) {
+	if lm, ok := m.(LabeledMetrics); ok && label != "" {
+		lm.LabeledAccept(label)
+	}
+}
+
+// labeledConnClosed tells m about the close of a connection accepted on
+// a listener labeled label
+func labeledConnClosed(m Metrics, label string) {
+	if lm, ok := m.(LabeledMetrics); ok && label != "" {
+		lm.LabeledConnClosed(label)
+	}
+}
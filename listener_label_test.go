@@ -0,0 +1,67 @@
+package torOnion
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+// labelMetrics counts the accepted and open connections by label
+type labelMetrics struct {
+	nopMetrics
+	mtx      sync.Mutex
+	accepted map[string]int
+	open     map[string]int
+}
+
+func (m *labelMetrics) LabeledAccept(label string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.accepted[label]++
+	m.open[label]++
+}
+
+func (m *labelMetrics) LabeledConnClosed(label string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.open[label]--
+}
+
+func TestListenerLabel(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	var rec stateRecorder
+	lm := &labelMetrics{accepted: make(map[string]int), open: make(map[string]int)}
+	WithConnStateHook(rec.hook)(transport)
+	WithMetrics(lm)(transport)
+
+	l, err := transport.ListenEphemeralV3(4003, WithLabel("chat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Label() != "chat" {
+		t.Fatalf("listener labeled %q", l.Label())
+	}
+
+	client := dialListener(t, l)
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label := conn.(*OnionConn).Label(); label != "chat" {
+		t.Fatalf("accepted connection labeled %q", label)
+	}
+	want := ConnInfo{LocalAddr: l.Multiaddr(), RemoteAddr: l.Multiaddr(), Inbound: true, Onion: true, Label: "chat"}
+	rec.expect(t, want, StateOpen)
+	conn.Close()
+	rec.expect(t, want, StateOpen, StateClosed)
+
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+	if lm.accepted["chat"] != 1 || lm.open["chat"] != 0 {
+		t.Fatalf("labeled metrics counted %d accepted and %d open connections", lm.accepted["chat"], lm.open["chat"])
+	}
+}
@@ -0,0 +1,34 @@
+package torOnion
+
+// Logger receives diagnostic messages from the transport. Each message
+// is followed by alternating keys and values giving its context, in
+// the style of most structured logging packages.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// WithLogger sets the Logger the transport reports to. By default
+// nothing is logged.
+func WithLogger(l Logger) Option {
+	return func(t *OnionTransport) {
+		t.logger = l
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// log returns the configured Logger, or a no-op implementation
+func (t *OnionTransport) log() Logger {
+	if t == nil || t.logger == nil {
+		return nopLogger{}
+	}
+	return t.logger
+}
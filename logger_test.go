@@ -0,0 +1,70 @@
+package torOnion
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// recordingLogger keeps every message logged as "LEVEL msg k=v ..."
+type recordingLogger struct {
+	mtx  sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) record(level, msg string, kv []interface{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	line := level + " " + msg
+	for i := 0; i+1 < len(kv); i += 2 {
+		line += fmt.Sprintf(" %v=%v", kv[i], kv[i+1])
+	}
+	l.msgs = append(l.msgs, line)
+}
+
+func (l *recordingLogger) Debug(msg string, kv ...interface{}) { l.record("DEBUG", msg, kv) }
+func (l *recordingLogger) Info(msg string, kv ...interface{})  { l.record("INFO", msg, kv) }
+func (l *recordingLogger) Warn(msg string, kv ...interface{})  { l.record("WARN", msg, kv) }
+func (l *recordingLogger) Error(msg string, kv ...interface{}) { l.record("ERROR", msg, kv) }
+
+// find returns the first message starting with prefix
+func (l *recordingLogger) find(prefix string) string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, msg := range l.msgs {
+		if strings.HasPrefix(msg, prefix) {
+			return msg
+		}
+	}
+	return ""
+}
+
+func TestLogger(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	logger := &recordingLogger{}
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), true, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	if msg := logger.find("INFO loaded onion service keys"); !strings.HasSuffix(msg, "count=0") {
+		t.Fatalf("key loading not logged, got %q", msg)
+	}
+
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer.Dial(addr)
+	if msg := logger.find("DEBUG dial failed"); !strings.Contains(msg, "reason=blocked") {
+		t.Fatalf("blocked dial not logged, got %q", msg)
+	}
+}
@@ -0,0 +1,134 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// managedTorStartTimeout bounds how long tor may take to open its control port
+	managedTorStartTimeout = 30 * time.Second
+	// managedTorBootstrapTimeout bounds how long tor may take to bootstrap
+	managedTorBootstrapTimeout = 3 * time.Minute
+	// managedTorStopTimeout is how long tor is given to exit before it is killed
+	managedTorStopTimeout = 10 * time.Second
+)
+
+// managedTor is a tor process started and owned by the transport
+type managedTor struct {
+	binaryPath string
+	dataDir    string
+
+	cmd    *exec.Cmd
+	exited chan struct{}
+	// owned is set once tor exits along with the control connection
+	owned bool
+}
+
+// torrc returns the configuration for the managed tor. Both ports are
+// picked by tor and the control port is written to a file so it can be
+// discovered, and control port access is protected by cookie auth.
+func (m *managedTor) torrc() string {
+	lines := []string{
+		"DataDirectory " + m.dataDir,
+		// extended errors report onion service failures such as
+		// missing client authorization
+		"SocksPort auto ExtendedErrors",
+		"ControlPort auto",
+		"ControlPortWriteToFile " + m.controlPortFile(),
+		"CookieAuthentication 1",
+		// exit should we die without shutting tor down
+		fmt.Sprintf("__OwningControllerProcess %d", os.Getpid()),
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (m *managedTor) controlPortFile() string {
+	return filepath.Join(m.dataDir, "control_port")
+}
+
+// start launches tor and returns the address of its control port
+func (m *managedTor) start() (controlNet, controlAddr string, err error) {
+	if err := os.MkdirAll(m.dataDir, 0700); err != nil {
+		return "", "", err
+	}
+	torrcPath := filepath.Join(m.dataDir, "torrc")
+	if err := ioutil.WriteFile(torrcPath, []byte(m.torrc()), 0600); err != nil {
+		return "", "", err
+	}
+	// a stale file from an earlier run would point at the wrong port
+	os.Remove(m.controlPortFile())
+
+	m.cmd = exec.Command(m.binaryPath, "-f", torrcPath)
+	if err := m.cmd.Start(); err != nil {
+		return "", "", fmt.Errorf("failed to start tor: %v", err)
+	}
+	m.exited = make(chan struct{})
+	go func() {
+		m.cmd.Wait()
+		close(m.exited)
+	}()
+
+	deadline := time.After(managedTorStartTimeout)
+	for {
+		b, err := ioutil.ReadFile(m.controlPortFile())
+		if err == nil && strings.HasSuffix(string(b), "\n") {
+			addr := strings.TrimPrefix(strings.TrimSpace(string(b)), "PORT=")
+			return "tcp", addr, nil
+		}
+		select {
+		case <-m.exited:
+			return "", "", errors.New("tor exited before opening its control port")
+		case <-deadline:
+			m.stop()
+			return "", "", errors.New("timed out waiting for tor to open its control port")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// stop waits for tor to exit, which it does once its owning control
+// connection has been closed, and kills it if it does not exit in time
+func (m *managedTor) stop() error {
+	if m.cmd == nil || m.cmd.Process == nil {
+		return nil
+	}
+	if m.owned {
+		select {
+		case <-m.exited:
+			return nil
+		case <-time.After(managedTorStopTimeout):
+		}
+	}
+	if err := m.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	<-m.exited
+	return nil
+}
+
+// startManagedTor connects the transport to its managed tor once the
+// control connection is authenticated. Tor is told to exit when the
+// control connection closes, and the transport waits for bootstrap.
+func (t *OnionTransport) startManagedTor() error {
+	if _, err := t.controlConn.Request("TAKEOWNERSHIP"); err != nil {
+		return fmt.Errorf("failed to take ownership of tor: %v", err)
+	}
+	t.managedTor.owned = true
+	if _, err := t.controlConn.Request("RESETCONF __OwningControllerProcess"); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), managedTorBootstrapTimeout)
+	defer cancel()
+	if err := t.WaitBootstrap(ctx); err != nil {
+		return fmt.Errorf("tor failed to bootstrap: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// DialFailureReason classifies why a dial failed
+type DialFailureReason string
+
+const (
+	// DialFailureTimeout means the dial ran out of time
+	DialFailureTimeout DialFailureReason = "timeout"
+	// DialFailureCanceled means the dial's context was cancelled
+	DialFailureCanceled DialFailureReason = "canceled"
+	// DialFailureBlocked means a non-onion address was dialed on a
+	// transport restricted to onion addresses
+	DialFailureBlocked DialFailureReason = "blocked"
+	// DialFailureClientAuth means the onion service refused the dial
+	// for lack of client authorization
+	DialFailureClientAuth DialFailureReason = "client_auth"
+	// DialFailureClosed means the transport was closed
+	DialFailureClosed DialFailureReason = "closed"
+	// DialFailureOther covers all other errors, such as the onion
+	// service being unreachable
+	DialFailureOther DialFailureReason = "other"
+)
+
+// Metrics receives counts of transport activity. Implementations must
+// be safe for concurrent use. ConnOpened and ConnClosed are called for
+// both dialed and accepted connections, so their difference is the
+// number of active connections.
+type Metrics interface {
+	DialAttempt()
+	DialSuccess()
+	DialFailure(reason DialFailureReason)
+	Accept()
+	ConnOpened()
+	ConnClosed()
+}
+
+// WithMetrics sets the Metrics notified of dials, accepts and
+// connections. By default nothing is recorded.
+func WithMetrics(m Metrics) Option {
+	return func(t *OnionTransport) {
+		t.metrics = m
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) DialAttempt()                  {}
+func (nopMetrics) DialSuccess()                  {}
+func (nopMetrics) DialFailure(DialFailureReason) {}
+func (nopMetrics) Accept()                       {}
+func (nopMetrics) ConnOpened()                   {}
+func (nopMetrics) ConnClosed()                   {}
+
+// getMetrics returns the configured Metrics, or a no-op implementation
+func (t *OnionTransport) getMetrics() Metrics {
+	if t == nil || t.metrics == nil {
+		return nopMetrics{}
+	}
+	return t.metrics
+}
+
+// dialFailureReason classifies err returned by a dial using ctx. The
+// transport's errors may come wrapped, so they are matched with
+// errors.Is.
+func dialFailureReason(ctx context.Context, err error) DialFailureReason {
+	switch {
+	case errors.Is(err, ErrTransportClosed):
+		return DialFailureClosed
+	case errors.Is(err, ErrNonOnionDialBlocked):
+		return DialFailureBlocked
+	case errors.Is(err, ErrClientAuthRequired), errors.Is(err, ErrClientAuthRejected):
+		return DialFailureClientAuth
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return DialFailureTimeout
+	case errors.Is(err, context.Canceled), errors.Is(ctx.Err(), context.Canceled):
+		return DialFailureCanceled
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return DialFailureTimeout
+	}
+	return DialFailureOther
+}
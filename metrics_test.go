@@ -0,0 +1,147 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// countingMetrics records every call made to it
+type countingMetrics struct {
+	mtx       sync.Mutex
+	attempts  int
+	successes int
+	failures  map[DialFailureReason]int
+	accepts   int
+	active    int
+}
+
+func (m *countingMetrics) DialAttempt() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.attempts++
+}
+
+func (m *countingMetrics) DialSuccess() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.successes++
+}
+
+func (m *countingMetrics) DialFailure(reason DialFailureReason) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.failures[reason]++
+}
+
+func (m *countingMetrics) Accept() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.accepts++
+}
+
+func (m *countingMetrics) ConnOpened() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.active++
+}
+
+func (m *countingMetrics) ConnClosed() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.active--
+}
+
+func TestMetrics(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	fc := testutil.NewControlServer(t)
+	fc.SetSOCKSAddr(fs.Addr())
+	m := &countingMetrics{failures: make(map[DialFailureReason]int)}
+	tpt := newControlTransport(t, fc)
+	WithMetrics(m)(tpt)
+
+	// a successful and a blocked dial
+	onion, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.onlyOnion = true
+	tcp, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial(tcp); err != ErrNonOnionDialBlocked {
+		t.Fatalf("expected ErrNonOnionDialBlocked, got %v", err)
+	}
+
+	// an accepted connection
+	l, err := tpt.ListenEphemeral(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp4", l.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.mtx.Lock()
+	if m.attempts != 2 || m.successes != 1 || m.failures[DialFailureBlocked] != 1 {
+		t.Errorf("unexpected dial counts: %d attempts, %d successes, failures %v", m.attempts, m.successes, m.failures)
+	}
+	if m.accepts != 1 || m.active != 2 {
+		t.Errorf("unexpected connection counts: %d accepts, %d active", m.accepts, m.active)
+	}
+	m.mtx.Unlock()
+
+	conn.Close()
+	accepted.Close()
+	// closing twice must not be counted twice
+	conn.Close()
+	m.mtx.Lock()
+	if m.active != 0 {
+		t.Errorf("%d connections still counted as active after closing", m.active)
+	}
+	m.mtx.Unlock()
+}
+
+func TestDialFailureReason(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		ctx    context.Context
+		err    error
+		reason DialFailureReason
+	}{
+		{context.Background(), fmt.Errorf("dial: %w", ErrTransportClosed), DialFailureClosed},
+		{context.Background(), fmt.Errorf("dial: %w", ErrNonOnionDialBlocked), DialFailureBlocked},
+		{context.Background(), fmt.Errorf("dial: %w", ErrClientAuthRequired), DialFailureClientAuth},
+		{context.Background(), fmt.Errorf("dial: %w", ErrClientAuthRejected), DialFailureClientAuth},
+		{context.Background(), fmt.Errorf("dial: %w", context.DeadlineExceeded), DialFailureTimeout},
+		{canceled, errors.New("host unreachable"), DialFailureCanceled},
+		{context.Background(), errors.New("host unreachable"), DialFailureOther},
+	} {
+		if reason := dialFailureReason(tc.ctx, tc.err); reason != tc.reason {
+			t.Errorf("%v: expected %s, got %s", tc.err, tc.reason, reason)
+		}
+	}
+}
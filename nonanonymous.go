@@ -0,0 +1,27 @@
+package torOnion
+
+import "errors"
+
+var (
+	errNonAnonymousDisabled = errors.New("single onion services require tor to run with HiddenServiceNonAnonymousMode and HiddenServiceSingleHopMode")
+	errNonAnonymousRequired = errors.New("tor runs in non-anonymous hidden service mode, onion services must be created with WithNonAnonymous")
+)
+
+// WithNonAnonymous publishes the service as a single onion service,
+// which tor reaches over one hop rather than a full circuit for lower
+// latency and higher throughput.
+//
+// A single onion service is NOT anonymous: the location of the server,
+// its IP address, is visible to the relays it connects to and can be
+// discovered by its clients. Only use it for services whose operator
+// and location are public anyway. Clients keep their anonymity.
+//
+// Tor must run with HiddenServiceNonAnonymousMode and
+// HiddenServiceSingleHopMode enabled, otherwise listening fails. In
+// that mode tor only publishes single onion services, so every
+// listener of the transport needs this option.
+func WithNonAnonymous() ListenOption {
+	return func(c *listenConfig) {
+		c.nonAnonymous = true
+	}
+}
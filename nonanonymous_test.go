@@ -0,0 +1,68 @@
+package torOnion
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+func TestNonAnonymousCommand(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := addOnionCommand(key, 4003, "127.0.0.1:1234", nil, onionFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(cmd, "Flags=") {
+		t.Fatalf("flags sent without options: %s", cmd)
+	}
+	cmd, err = addOnionCommand(key, 4003, "127.0.0.1:1234", nil, onionFlags{nonAnonymous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cmd, " Flags=NonAnonymous ") {
+		t.Fatalf("NonAnonymous flag missing: %s", cmd)
+	}
+	cmd, err = addOnionCommand(key, 4003, "127.0.0.1:1234", [][32]byte{{1}}, onionFlags{nonAnonymous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cmd, " Flags=V3Auth,NonAnonymous ") {
+		t.Fatalf("flags not combined: %s", cmd)
+	}
+}
+
+func TestNonAnonymousMode(t *testing.T) {
+	// tor in the default, anonymous mode
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	if _, err := tpt.ListenEphemeralV3(4003, WithNonAnonymous()); err != errNonAnonymousDisabled {
+		t.Fatalf("expected errNonAnonymousDisabled, got %v", err)
+	}
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// tor in non-anonymous mode
+	fc = testutil.NewControlServer(t)
+	fc.NonAnonymous = true
+	tpt = newControlTransport(t, fc)
+	if _, err := tpt.ListenEphemeralV3(4003); err != errNonAnonymousRequired {
+		t.Fatalf("expected errNonAnonymousRequired, got %v", err)
+	}
+	l, err = tpt.ListenEphemeralV3(4003, WithNonAnonymous())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !fc.HasOnion(l.serviceID) {
+		t.Fatal("single onion service not published")
+	}
+}
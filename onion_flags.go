@@ -0,0 +1,68 @@
+package torOnion
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	errKeyDiscarded           = errors.New("tor discarded the onion service key, the service cannot be published again")
+	errMaxStreamsCloseNoLimit = errors.New("closing circuits over the stream limit requires a limit above 0")
+)
+
+// maxOnionStreams is the largest MaxStreams tor accepts
+const maxOnionStreams = 65535
+
+// WithDetach keeps the onion service published when the control
+// connection it was created on closes. By default tor removes a service
+// along with its control connection, so a crashed process leaves
+// nothing behind. Closing the listener or the transport still removes a
+// detached service, but if the process exits without closing it the
+// service stays published, forwarding to a port nothing listens on,
+// until it is removed with DEL_ONION or tor restarts. After the
+// transport reconnects to the control port a detached service tor still
+// has is kept as it is.
+func WithDetach() ListenOption {
+	return func(c *listenConfig) {
+		c.detach = true
+	}
+}
+
+// WithDiscardPK tells tor not to return the key it generated for the
+// onion service, so that it never leaves tor. It only affects listeners
+// whose key tor generates, like those of ListenEphemeral: their
+// PrivateKey is nil and WithKeyCallback is not called. Without the key
+// the service cannot be published again under the same address, so it
+// is lost when tor restarts. Services with a key of their own are
+// unaffected as tor never returns keys it was given.
+func WithDiscardPK() ListenOption {
+	return func(c *listenConfig) {
+		c.discardPK = true
+	}
+}
+
+// WithMaxStreams limits the streams, the connections to the onion
+// service, which a single rendezvous circuit may open to n, between 1
+// and 65535, so that one client cannot use up the service's resources
+// over a single circuit. 0, the default, sets no limit. When the limit
+// is hit tor refuses further streams on the circuit, which the client
+// may keep using for its open ones; with closeCircuit set it instead
+// tears down the whole circuit, closing all of the client's streams on
+// it, a stronger response to clients flooding the service.
+func WithMaxStreams(n int, closeCircuit bool) ListenOption {
+	return func(c *listenConfig) {
+		c.maxStreams = n
+		c.maxStreamsCloseCircuit = closeCircuit
+	}
+}
+
+// checkMaxStreams validates the limit set with WithMaxStreams
+func (c *listenConfig) checkMaxStreams() error {
+	if c.maxStreams < 0 || c.maxStreams > maxOnionStreams {
+		return fmt.Errorf("stream limit %d is out of range, tor accepts 0 to %d", c.maxStreams, maxOnionStreams)
+	}
+	if c.maxStreamsCloseCircuit && c.maxStreams == 0 {
+		return errMaxStreamsCloseNoLimit
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package torOnion
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+func TestOnionFlagsCommand(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := addOnionCommand(key, 4003, "127.0.0.1:1234", nil, onionFlags{detach: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cmd, " Flags=Detach ") {
+		t.Fatalf("Detach flag missing: %s", cmd)
+	}
+	cmd, err = addOnionCommand(key, 4003, "127.0.0.1:1234", [][32]byte{{1}}, onionFlags{detach: true, discardPK: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cmd, " Flags=V3Auth,Detach,DiscardPK ") {
+		t.Fatalf("flags not combined: %s", cmd)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	detached, err := tpt.ListenEphemeralV3(4003, WithDetach())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attached, err := tpt.ListenEphemeralV3(4004)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the control connection goes away without the services being
+	// removed, as when the process crashes
+	tpt.conn().Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for fc.HasOnion(attached.serviceID) {
+		if time.Now().After(deadline) {
+			t.Fatal("service not removed with its control connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !fc.HasOnion(detached.serviceID) {
+		t.Fatal("detached service removed with the control connection")
+	}
+}
+
+func TestDiscardPK(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	var called bool
+	l, err := tpt.ListenEphemeral(4003, WithDiscardPK(), WithKeyCallback(func(string, crypto.PrivateKey) {
+		called = true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !fc.HasOnion(l.serviceID) {
+		t.Fatal("onion service was not registered")
+	}
+	if l.PrivateKey() != nil || called {
+		t.Fatal("tor returned the discarded key")
+	}
+	// the service cannot be published again after tor restarts
+	if err := republish(tpt.conn(), l); err != errKeyDiscarded {
+		t.Fatalf("expected errKeyDiscarded, got %v", err)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	l, err := tpt.ListenEphemeralV3(4003, WithMaxStreams(10, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cmds := fc.CommandLines("ADD_ONION")
+	if len(cmds) != 1 {
+		t.Fatalf("expected one ADD_ONION request, got %d", len(cmds))
+	}
+	if cmd := cmds[0]; !strings.Contains(cmd, " Flags=MaxStreamsCloseCircuit ") || !strings.Contains(cmd, " MaxStreams=10 ") {
+		t.Fatalf("stream limit missing: %s", cmd)
+	}
+
+	for _, tc := range []struct {
+		n            int
+		closeCircuit bool
+	}{
+		{-1, false},
+		{65536, false},
+		{0, true},
+	} {
+		if _, err := tpt.ListenEphemeralV3(4004, WithMaxStreams(tc.n, tc.closeCircuit)); err == nil {
+			t.Errorf("listened with a stream limit of %d, closing circuits %t", tc.n, tc.closeCircuit)
+		}
+	}
+	if n := len(fc.CommandLines("ADD_ONION")); n != 1 {
+		t.Fatalf("invalid stream limits sent %d ADD_ONION requests", n-1)
+	}
+}
@@ -2,12 +2,12 @@ package torOnion
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto"
+	"crypto/ed25519"
 	"encoding/base32"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/yawning/bulb"
-	"github.com/yawning/bulb/utils/pkcs1"
 	"golang.org/x/net/proxy"
 	"io/ioutil"
 	"net"
@@ -15,6 +15,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	tpt "github.com/libp2p/go-libp2p-transport"
 	ma "github.com/multiformats/go-multiaddr"
@@ -22,63 +24,239 @@ import (
 	mafmt "github.com/whyrusleeping/mafmt"
 )
 
+// Errors returned by the transport, possibly wrapped with details, which
+// callers can check for with errors.Is
+var (
+	// ErrTransportClosed is returned when using a closed transport
+	ErrTransportClosed = errors.New("transport closed")
+	// ErrListenRequiresControl is returned when listening on a
+	// transport created without a tor control port
+	ErrListenRequiresControl = errors.New("listening requires a tor control port")
+	// ErrMissingKey is returned when listening on an onion address
+	// without a key for it
+	ErrMissingKey = errors.New("missing onion service key material")
+	// ErrControlAuthFailed is returned when tor refuses to
+	// authenticate the control connection
+	ErrControlAuthFailed = errors.New("authentication failed")
+	// ErrInvalidOnionAddr is returned for malformed onion addresses
+	ErrInvalidOnionAddr = errors.New("malformed onion address")
+)
+
+var (
+	errControlRequired       = errors.New("tor control port required")
+	errUnixTargetUnsupported = errors.New("tor rejected the unix socket target, unix targets require a newer tor")
+)
+
+// ErrNonOnionDialBlocked is returned when dialing an address which is
+// not an onion service on a transport restricted to onion addresses
+var ErrNonOnionDialBlocked = errors.New("dialing non-onion addresses is disabled")
+
 // IsValidOnionMultiAddr is used to validate that a multiaddr
-// is representing a Tor onion service
+// is representing a Tor onion service, either v2 (onion) or v3 (onion3)
 func IsValidOnionMultiAddr(a ma.Multiaddr) bool {
 	if len(a.Protocols()) != 1 {
 		return false
 	}
 
 	// check for correct network type
-	if a.Protocols()[0].Name != "onion" {
+	code := a.Protocols()[0].Code
+	if code != ma.P_ONION && code != ma.P_ONION3 {
 		return false
 	}
 
-	// split into onion address and port
-	addr, err := a.ValueForProtocol(ma.P_ONION)
+	addr, err := a.ValueForProtocol(code)
 	if err != nil {
 		return false
 	}
+	_, _, err = parseOnionAddr(code, addr)
+	return err == nil
+}
+
+// parseOnionAddr splits the value of an onion (v2) or onion3 multiaddr
+// component into the service id, without the ".onion" suffix, and port
+func parseOnionAddr(code int, addr string) (string, int, error) {
 	split := strings.Split(addr, ":")
 	if len(split) != 2 {
-		return false
+		return "", 0, fmt.Errorf("%w %q: expected <service id>:<port>", ErrInvalidOnionAddr, addr)
 	}
 
-	// onion address without the ".onion" substring
-	if len(split[0]) != 16 {
-		fmt.Println(split[0])
-		return false
-	}
-	_, err = base32.StdEncoding.DecodeString(strings.ToUpper(split[0]))
-	if err != nil {
-		return false
+	// the service id may come with or without the ".onion" suffix
+	id := normalizeOnionHost(split[0])
+	switch code {
+	case ma.P_ONION:
+		if len(id) != 16 {
+			return "", 0, fmt.Errorf("%w %q: service id must be 16 characters", ErrInvalidOnionAddr, addr)
+		}
+		_, err := decodeOnionHost(id)
+		if err != nil {
+			return "", 0, fmt.Errorf("%w %q: %v", ErrInvalidOnionAddr, addr, err)
+		}
+	case ma.P_ONION3:
+		// v3 onion address, which decodes to the ed25519 public key, a
+		// checksum and the version byte, all of which are verified
+		if len(id) != 56 {
+			return "", 0, fmt.Errorf("%w %q: service id must be 56 characters", ErrInvalidOnionAddr, addr)
+		}
+		if err := validateV3OnionAddress(id); err != nil {
+			return "", 0, fmt.Errorf("%w %q: %v", ErrInvalidOnionAddr, addr, err)
+		}
+	default:
+		return "", 0, fmt.Errorf("not an onion protocol: %d", code)
 	}
 
 	// onion port number
-	i, err := strconv.Atoi(split[1])
+	port, err := strconv.Atoi(split[1])
 	if err != nil {
-		return false
+		return "", 0, fmt.Errorf("%w %q: invalid port: %v", ErrInvalidOnionAddr, addr, err)
 	}
-	if i >= 65536 || i < 1 {
-		return false
+	if port >= 65536 || port < 1 {
+		return "", 0, fmt.Errorf("%w %q: port %d out of range", ErrInvalidOnionAddr, addr, port)
 	}
+	return id, port, nil
+}
+
+// normalizeOnionHost returns the canonical form of an onion service id,
+// lowercase and without the ".onion" suffix, which is how ids are
+// compared and dialed
+func normalizeOnionHost(id string) string {
+	return strings.TrimSuffix(strings.ToLower(id), ".onion")
+}
 
-	return true
+// decodeOnionHost base32 decodes an onion service id of any case
+func decodeOnionHost(id string) ([]byte, error) {
+	return base32.StdEncoding.DecodeString(strings.ToUpper(id))
 }
 
+// The transport implements go-libp2p-transport's interfaces
+var (
+	_ tpt.Transport = (*OnionTransport)(nil)
+	_ tpt.Dialer    = (*OnionDialer)(nil)
+	_ tpt.Listener  = (*OnionListener)(nil)
+	_ tpt.Conn      = (*OnionConn)(nil)
+)
+
 // OnionTransport implements go-libp2p-transport's Transport interface
 type OnionTransport struct {
+	// bytesRead and bytesWritten total the traffic of all connections.
+	// They are accessed atomically and kept first for 64-bit alignment.
+	bytesRead    uint64
+	bytesWritten uint64
+
 	controlConn *bulb.Conn
 	auth        *proxy.Auth
 	keysDir     string
-	keys        map[string]*rsa.PrivateKey
 	onlyOnion   bool
+	controlAuth ControlAuth
+	isolation   IsolationMode
+	// isolationBucket and isolationJitter isolate connections by the
+	// time they are dialed, if set
+	isolationBucket time.Duration
+	isolationJitter time.Duration
+
+	// metrics is notified of dials and connections, if set
+	metrics Metrics
+	// logger receives diagnostics, if set
+	logger Logger
+	// connStateHook is told when connections open and close, if set
+	connStateHook func(ConnInfo, ConnState)
+	// keyPassphrase returns the passphrase of encrypted onion keys,
+	// if set
+	keyPassphrase func(name string) ([]byte, error)
+	// idleTimeout closes connections without activity, if set
+	idleTimeout time.Duration
+	// keepAliveInterval and keepAliveHeartbeat make idle connections
+	// send a heartbeat, if set
+	keepAliveInterval  time.Duration
+	keepAliveHeartbeat []byte
+	// directTCP dials TCP addresses without tor
+	directTCP bool
+	// proxyDialer, if set, replaces the dialer for the tor SOCKS port
+	proxyDialer proxy.Dialer
+	// dialRetries and dialBackoff control how transient dial failures
+	// are retried
+	dialRetries int
+	dialBackoff time.Duration
+	// dialSlots holds a token for each dial in progress if concurrent
+	// dials are limited
+	dialSlots chan struct{}
+	// requireBridges makes tor's bridge configuration be verified
+	requireBridges bool
+	// circuitPaths enables PathDialer
+	circuitPaths bool
+	// selfTestTarget is dialed by SelfTest if selfTestTargetSet,
+	// DefaultSelfTestTarget otherwise
+	selfTestTarget    ma.Multiaddr
+	selfTestTargetSet bool
+
+	// borrowedConn is set when controlConn was supplied by the caller,
+	// in which case Close leaves it open
+	borrowedConn bool
+	// controlMtx guards controlConn, which is replaced when the
+	// transport reconnects to the control port, and torVersion, the
+	// version of the tor it is connected to
+	controlMtx sync.Mutex
+	torVersion *TorVersion
+	// controlNet, controlAddr and controlPass are kept to reconnect
+	controlNet  string
+	controlAddr string
+	controlPass string
+	// controlPassSource, if set, reads the control password on each
+	// connect in place of controlPass
+	controlPassSource func() (string, error)
+	// authMtx guards controlAuth, controlPass and controlPassSource,
+	// which UpdateControlAuth replaces
+	authMtx sync.Mutex
+	// reconnectMtx serializes reconnects, which back off exponentially
+	// while tor is unreachable
+	reconnectMtx     sync.Mutex
+	reconnectBackoff time.Duration
+	nextReconnect    time.Time
+
+	// allowedPorts are the virtual ports onion services may use, all
+	// ports if nil
+	allowedPorts map[uint16]bool
+
+	// clientAuth holds the v3 client authorization keys registered
+	// with tor, by onion service id
+	clientAuth map[string][32]byte
+
+	// socksNet and socksAddr locate the tor SOCKS port. They are set
+	// up front for dial-only transports, which have no control port,
+	// and with WithSOCKSPort, and otherwise discovered on first use and
+	// cached. socksFixed is set when they must not be rediscovered.
+	socksMtx   sync.Mutex
+	socksNet   string
+	socksAddr  string
+	socksFixed bool
+
+	// managedTor is set when the transport runs its own tor
+	managedTor *managedTor
+
+	// keys holds *rsa.PrivateKey for v2 and ed25519.PrivateKey
+	// for v3 onion services
+	keysMtx sync.RWMutex
+	keys    map[string]crypto.PrivateKey
+
+	mtx       sync.Mutex
+	closed    bool
+	listeners map[*OnionListener]struct{}
+	// bootstrapped is set once tor has been seen fully bootstrapped
+	bootstrapped bool
+	// draining is set while Shutdown waits for accepted connections,
+	// which are tracked in conns. drained is closed once conns is
+	// empty.
+	draining bool
+	conns    map[*OnionConn]struct{}
+	drained  chan struct{}
 }
 
 // NewOnionTransport creates a OnionTransport
 //
 // controlNet and controlAddr contain the connecting information
 // for the tor control port; either TCP or UNIX domain socket.
+// With controlNet "unix" controlAddr is a socket path, optionally
+// prefixed with "unix:" as in torrc, or on Linux the name of an
+// abstract socket starting with "@" or a NUL byte.
 //
 // controlPass contains the optional tor control password
 //
@@ -86,63 +264,394 @@ type OnionTransport struct {
 // keysDir is the key material for the Tor onion service.
 //
 // if onlyOnion is true the dialer will only be used to dial out on onion addresses
-func NewOnionTransport(controlNet, controlAddr, controlPass string, auth *proxy.Auth, keysDir string, onlyOnion bool) (*OnionTransport, error) {
-	conn, err := bulb.Dial(controlNet, controlAddr)
+//
+// opts configure optional behavior such as the control port
+// authentication method.
+//
+// It is equivalent to NewTransport with WithControlPassword,
+// WithSOCKSAuth, WithKeysDir and, if onlyOnion is set, WithOnlyOnion.
+func NewOnionTransport(controlNet, controlAddr, controlPass string, auth *proxy.Auth, keysDir string, onlyOnion bool, opts ...Option) (*OnionTransport, error) {
+	return NewOnionTransportContext(context.Background(), controlNet, controlAddr, controlPass, auth, keysDir, onlyOnion, opts...)
+}
+
+// NewOnionTransportContext is NewOnionTransport with connecting and
+// authenticating to the control port bounded by ctx, so that a control
+// port which accepts connections but never answers cannot hang the
+// caller. If ctx is done first the context error is returned.
+func NewOnionTransportContext(ctx context.Context, controlNet, controlAddr, controlPass string, auth *proxy.Auth, keysDir string, onlyOnion bool, opts ...Option) (*OnionTransport, error) {
+	base := []Option{WithControlPassword(controlPass), WithSOCKSAuth(auth), WithKeysDir(keysDir)}
+	if onlyOnion {
+		base = append(base, WithOnlyOnion())
+	}
+	return newTransport(ctx, controlNet, controlAddr, append(base, opts...)...)
+}
+
+// NewTransport creates a OnionTransport connected to the tor control
+// port at controlAddr, a TCP address or UNIX domain socket depending on
+// controlNet, as for NewOnionTransport. Everything else is configured with opts,
+// for instance the control password with WithControlPassword and the
+// onion service keys with WithKeysDir.
+func NewTransport(controlNet, controlAddr string, opts ...Option) (*OnionTransport, error) {
+	return newTransport(context.Background(), controlNet, controlAddr, opts...)
+}
+
+// newTransport creates a OnionTransport, giving up connecting to the
+// control port once ctx is done
+func newTransport(ctx context.Context, controlNet, controlAddr string, opts ...Option) (*OnionTransport, error) {
+	var o OnionTransport
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.managedTor != nil {
+		var err error
+		controlNet, controlAddr, err = o.managedTor.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+	o.controlNet, o.controlAddr = controlNet, controlAddr
+	conn, err := o.dialControlContext(ctx)
 	if err != nil {
+		o.stopManagedTor()
 		return nil, err
 	}
-	if err := conn.Authenticate(controlPass); err != nil {
-		return nil, fmt.Errorf("Authentication failed: %v", err)
+	o.controlConn = conn
+	if o.managedTor != nil {
+		if err := o.startManagedTor(); err != nil {
+			o.Close()
+			return nil, err
+		}
+	}
+	if err := o.init(); err != nil {
+		o.Close()
+		return nil, err
 	}
+	return &o, nil
+}
+
+// NewOnionTransportFromConn creates a OnionTransport which uses conn, an
+// already authenticated tor control connection owned by the caller.
+// Closing the transport removes its onion services but leaves conn open.
+//
+// auth, keysDir, onlyOnion and opts are as for NewOnionTransport.
+// WithManagedTor cannot be used as tor is already running, and
+// WithControlAuth has no effect as conn is already authenticated.
+func NewOnionTransportFromConn(conn *bulb.Conn, auth *proxy.Auth, keysDir string, onlyOnion bool, opts ...Option) (*OnionTransport, error) {
 	o := OnionTransport{
-		controlConn: conn,
-		auth:        auth,
-		keysDir:     keysDir,
-		onlyOnion:   onlyOnion,
+		controlConn:  conn,
+		borrowedConn: true,
+		auth:         auth,
+		keysDir:      keysDir,
+		onlyOnion:    onlyOnion,
 	}
-	keys, err := o.loadKeys()
-	if err != nil {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.managedTor != nil {
+		return nil, errors.New("managed tor cannot use an existing control connection")
+	}
+	if err := o.init(); err != nil {
+		o.Close()
 		return nil, err
 	}
-	o.keys = keys
 	return &o, nil
 }
 
+// init finishes setting up a transport with an authenticated control
+// connection by querying the tor version, registering client
+// authorization keys and loading the onion service keys
+func (t *OnionTransport) init() error {
+	v, err := queryTorVersion(t.conn())
+	if err != nil {
+		return err
+	}
+	t.setTorVersion(v)
+	t.log().Debug("connected to tor", "version", v)
+	if t.requireBridges {
+		if err := t.checkBridges(); err != nil {
+			return err
+		}
+	}
+	for serviceID, key := range t.clientAuthKeys() {
+		if err := t.AddClientAuthV3(serviceID, key); err != nil {
+			return err
+		}
+	}
+	keys, err := t.loadKeys()
+	if err != nil {
+		return err
+	}
+	t.setKeys(keys)
+	t.log().Info("loaded onion service keys", "dir", t.keysDir, "count", len(keys))
+	return nil
+}
+
+// NewSOCKSOnionTransport creates a dial-only OnionTransport which uses
+// an already running tor through its SOCKS proxy and has no access to
+// the control port. This suits client-only peers; Listen on such a
+// transport always fails.
+//
+// socksNet and socksAddr contain the connecting information for the
+// tor SOCKS port; either TCP or UNIX domain socket.
+//
+// auth contains the optional socks proxy username and password, sent
+// with SOCKS5 username/password authentication to SOCKS ports which
+// require it
+//
+// if onlyOnion is true the dialer will only be used to dial out on onion addresses
+func NewSOCKSOnionTransport(socksNet, socksAddr string, auth *proxy.Auth, onlyOnion bool, opts ...Option) (*OnionTransport, error) {
+	o := OnionTransport{
+		auth:      auth,
+		onlyOnion: onlyOnion,
+		socksNet:  socksNet,
+		socksAddr: socksAddr,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.clientAuth) != 0 || o.requireBridges {
+		// client authorization keys can only be registered, and the
+		// bridge configuration checked, through the control port
+		return nil, errControlRequired
+	}
+	return &o, nil
+}
+
+// Close shuts down all listeners created by this transport and
+// closes the tor control connection unless it was supplied to
+// NewOnionTransportFromConn, stopping tor if it is managed
+// by the transport. Once closed the transport
+// can no longer be used to dial or listen. Calling Close more
+// than once is safe.
+func (t *OnionTransport) Close() error {
+	t.mtx.Lock()
+	if t.closed {
+		t.mtx.Unlock()
+		return nil
+	}
+	t.closed = true
+	listeners := t.listeners
+	t.listeners = nil
+	t.mtx.Unlock()
+
+	// close listeners first so their onion services are removed
+	// while the control connection is still usable
+	for l := range listeners {
+		l.Close()
+	}
+	var err error
+	if conn := t.conn(); conn != nil && !t.borrowedConn {
+		err = conn.Close()
+	}
+	if serr := t.stopManagedTor(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// stopManagedTor shuts down the managed tor, if any
+func (t *OnionTransport) stopManagedTor() error {
+	if t.managedTor == nil {
+		return nil
+	}
+	return t.managedTor.stop()
+}
+
+// isClosed reports whether Close has been called
+func (t *OnionTransport) isClosed() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.closed
+}
+
+// String summarizes the transport's configuration and state for
+// debugging. Credentials such as the control password and SOCKS
+// isolation tokens are left out. Tor is only reported as bootstrapped
+// once the transport has seen it so, for instance in WaitBootstrap.
+func (t *OnionTransport) String() string {
+	control := "none"
+	if t.controlAddr != "" {
+		control = t.controlNet + ":" + t.controlAddr
+	} else if t.borrowedConn {
+		control = "borrowed"
+	}
+	t.keysMtx.RLock()
+	keys := len(t.keys)
+	t.keysMtx.RUnlock()
+	connected := t.conn() != nil
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return fmt.Sprintf("OnionTransport{control=%s onlyOnion=%t keys=%d listeners=%d connected=%t bootstrapped=%t closed=%t}",
+		control, t.onlyOnion, keys, len(t.listeners), connected, t.bootstrapped, t.closed)
+}
+
+// addListener tracks a listener so that it is shut down with the
+// transport. It fails if the transport has already been closed.
+func (t *OnionTransport) addListener(l *OnionListener) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.closed || t.draining {
+		return ErrTransportClosed
+	}
+	if t.listeners == nil {
+		t.listeners = make(map[*OnionListener]struct{})
+	}
+	t.listeners[l] = struct{}{}
+	return nil
+}
+
+// removeListener stops tracking a listener
+func (t *OnionTransport) removeListener(l *OnionListener) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.listeners, l)
+}
+
 // Returns a proxy dialer gathered from the control interface.
 // This isn't needed for the IPFS transport but it provides
 // easy access to Tor for other functions.
 func (t *OnionTransport) TorDialer() (proxy.Dialer, error) {
-	dialer, err := t.controlConn.Dialer(t.auth)
+	if t.proxyDialer != nil {
+		return t.proxyDialer, nil
+	}
+	return t.newTorDialer(t.auth, proxy.Direct)
+}
+
+// newTorDialer returns a proxy dialer for the tor SOCKS port using auth,
+// which may be nil, connecting to the SOCKS port through forward.
+func (t *OnionTransport) newTorDialer(auth *proxy.Auth, forward proxy.Dialer) (proxy.Dialer, error) {
+	socksNet, socksAddr, err := t.socksEndpoint()
 	if err != nil {
 		return nil, err
 	}
-	return dialer, nil
+	return proxy.SOCKS5(socksNet, socksAddr, auth, forward)
+}
+
+// socksEndpoint returns the network and address of the tor SOCKS port.
+// Unless the transport is dial-only the SOCKS port is discovered from
+// the control interface (GETINFO net/listeners/socks) the first time
+// it is needed, so tor listening on a non-standard port needs no
+// configuration.
+func (t *OnionTransport) socksEndpoint() (string, string, error) {
+	t.socksMtx.Lock()
+	socksNet, socksAddr := t.socksNet, t.socksAddr
+	t.socksMtx.Unlock()
+	if socksAddr != "" || t.conn() == nil {
+		return socksNet, socksAddr, nil
+	}
+
+	// the lock is not held while querying tor as a failed request
+	// reconnects, which resets the endpoint
+	socksNet, socksAddr, err := t.socksListener()
+	if err != nil {
+		return "", "", err
+	}
+	t.socksMtx.Lock()
+	defer t.socksMtx.Unlock()
+	if t.socksAddr == "" {
+		t.socksNet, t.socksAddr = socksNet, socksAddr
+	}
+	return t.socksNet, t.socksAddr, nil
+}
+
+// resetSOCKSEndpoint forgets a discovered SOCKS port so that it is
+// discovered again on the next dial
+func (t *OnionTransport) resetSOCKSEndpoint() {
+	if t.conn() == nil || t.socksFixed {
+		// dial-only transports and WithSOCKSPort configure the SOCKS
+		// port
+		return
+	}
+	t.socksMtx.Lock()
+	defer t.socksMtx.Unlock()
+	t.socksNet, t.socksAddr = "", ""
+}
+
+// setKeys replaces the keys map
+func (t *OnionTransport) setKeys(keys map[string]crypto.PrivateKey) {
+	t.keysMtx.Lock()
+	defer t.keysMtx.Unlock()
+	t.keys = keys
+}
+
+// getKey returns the key for the given onion service name
+func (t *OnionTransport) getKey(name string) (crypto.PrivateKey, bool) {
+	t.keysMtx.RLock()
+	defer t.keysMtx.RUnlock()
+	key, ok := t.keys[name]
+	return key, ok
+}
+
+// ReloadKeys walks the keys directory again and adds any keys which
+// were not loaded yet, returning the names of the added keys. Keys
+// already loaded are left in place so existing listeners are unaffected.
+func (t *OnionTransport) ReloadKeys() ([]string, error) {
+	keys, err := t.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	t.keysMtx.Lock()
+	defer t.keysMtx.Unlock()
+	if t.keys == nil {
+		t.keys = make(map[string]crypto.PrivateKey)
+	}
+	var added []string
+	for name, key := range keys {
+		if _, ok := t.keys[name]; !ok {
+			t.keys[name] = key
+			added = append(added, name)
+		}
+	}
+	t.log().Info("reloaded onion service keys", "dir", t.keysDir, "added", len(added))
+	return added, nil
 }
 
-// loadKeys loads keys into our keys map from files in the keys directory
-func (t *OnionTransport) loadKeys() (map[string]*rsa.PrivateKey, error) {
-	keys := make(map[string]*rsa.PrivateKey)
+// loadKeys loads keys into our keys map from files in the keys directory.
+// RSA keys for v2 services are read from .onion_key files and ed25519
+// keys for v3 services from PKCS#8 encoded .onion_v3_key files. An empty
+// or nonexistent keys directory holds no keys, which suits transports
+// only used for dialing or ephemeral services.
+func (t *OnionTransport) loadKeys() (map[string]crypto.PrivateKey, error) {
+	keys := make(map[string]crypto.PrivateKey)
+	if t.keysDir == "" {
+		return keys, nil
+	}
 	absPath, err := filepath.EvalSymlinks(t.keysDir)
+	if os.IsNotExist(err) {
+		t.log().Debug("onion service keys directory does not exist", "dir", t.keysDir)
+		return keys, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 	walkpath := func(path string, f os.FileInfo, err error) error {
 		if strings.HasSuffix(path, ".onion_key") {
-			file, err := os.Open(path)
-			defer file.Close()
+			key, err := ioutil.ReadFile(path)
 			if err != nil {
 				return err
 			}
-
+			onionName := strings.TrimSuffix(filepath.Base(path), ".onion_key")
+			if key, err = t.decryptKeyPEM(onionName, key); err != nil {
+				return fmt.Errorf("invalid onion key %s: %w", path, err)
+			}
+			privKey, err := decodeOnionKey(key)
+			if err != nil {
+				return fmt.Errorf("invalid onion key %s: %v", path, err)
+			}
+			keys[onionName] = privKey
+		} else if strings.HasSuffix(path, ".onion_v3_key") {
 			key, err := ioutil.ReadFile(path)
 			if err != nil {
 				return err
 			}
-			onionName := strings.Replace(filepath.Base(file.Name()), ".onion_key", "", 1)
-			block, _ := pem.Decode(key)
-			privKey, _, err := pkcs1.DecodePrivateKeyDER(block.Bytes)
+			onionName := strings.TrimSuffix(filepath.Base(path), ".onion_v3_key")
+			if key, err = t.decryptKeyPEM(onionName, key); err != nil {
+				return fmt.Errorf("invalid onion key %s: %w", path, err)
+			}
+			privKey, err := decodeOnionV3Key(key)
 			if err != nil {
-				return err
+				return fmt.Errorf("invalid onion key %s: %v", path, err)
 			}
 			keys[onionName] = privKey
 		}
@@ -156,157 +665,717 @@ func (t *OnionTransport) loadKeys() (map[string]*rsa.PrivateKey, error) {
 func (t *OnionTransport) Dialer(laddr ma.Multiaddr, opts ...tpt.DialOpt) (tpt.Dialer, error) {
 	dialer := OnionDialer{
 		auth:      t.auth,
-		laddr:     &laddr,
+		laddr:     laddr,
 		transport: t,
 	}
 	return &dialer, nil
 }
 
-// Listen creates and returns a go-libp2p-transport Listener
+// Listen creates and returns a go-libp2p-transport Listener. The
+// listener's multiaddr is derived from the onion service key, so it is
+// the address the service is reachable at. Unless the transport only
+// dials onion addresses laddr may also be a TCP address, which is
+// listened on directly without tor.
 func (t *OnionTransport) Listen(laddr ma.Multiaddr) (tpt.Listener, error) {
+	return t.ListenWithOptions(laddr)
+}
+
+// ListenWithOptions is like Listen but takes options for the onion
+// service, such as WithAuthorizedClients
+func (t *OnionTransport) ListenWithOptions(laddr ma.Multiaddr, opts ...ListenOption) (tpt.Listener, error) {
+	if t.isClosed() {
+		return nil, ErrTransportClosed
+	}
+	if mafmt.TCP.Matches(laddr) {
+		if t.onlyOnion {
+			return nil, errNonOnionListenBlocked
+		}
+		return t.listenTCP(laddr, opts...)
+	}
 
 	// convert to net.Addr
-	netaddr, err := laddr.ValueForProtocol(ma.P_ONION)
+	code := ma.P_ONION
+	netaddr, err := laddr.ValueForProtocol(code)
 	if err != nil {
-
+		code = ma.P_ONION3
+		netaddr, err = laddr.ValueForProtocol(code)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to get onion address from %s: %v", ErrInvalidOnionAddr, laddr, err)
+		}
 	}
 
-	// retreive onion service virtport
-	addr := strings.Split(netaddr, ":")
-	if len(addr) != 2 {
-		return nil, fmt.Errorf("failed to parse onion address")
+	// retrieve the onion service id and virtual port
+	host, port, err := parseOnionAddr(code, netaddr)
+	if err != nil {
+		return nil, err
 	}
 
-	// convert port string to int
-	port, err := strconv.Atoi(addr[1])
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert onion service port to int")
+	if t.conn() == nil {
+		return nil, ErrListenRequiresControl
 	}
 
-	onionKey, ok := t.keys[addr[0]]
+	onionKey, ok := t.getKey(host)
 	if !ok {
-		return nil, fmt.Errorf("missing onion service key material for %s", addr[0])
+		return nil, fmt.Errorf("%w for %s", ErrMissingKey, host)
 	}
 
-	listener := OnionListener{
-		port:  uint16(port),
-		key:   onionKey,
-		laddr: laddr,
+	if err := checkKeyProtocol(code, onionKey); err != nil {
+		return nil, err
 	}
-
-	// setup bulb listener
-	_, err = pkcs1.OnionAddr(&onionKey.PublicKey)
+	// a misnamed key file would otherwise publish a different address
+	keyAddr, err := onionKeyAddress(onionKey, false)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to derive onion ID: %v", err)
 	}
-	listener.listener, err = t.controlConn.Listener(uint16(port), onionKey)
+	if keyAddr != host {
+		return nil, fmt.Errorf("onion service key for %s belongs to %s, check the key file name", host, keyAddr)
+	}
+	return t.listen(uint16(port), onionKey, opts...)
+}
+
+// ListenEphemeral creates an onion service on the given virtual port
+// using a new key generated by tor. The service is removed from tor
+// when the listener is closed. The generated key is available from
+// the listener's PrivateKey method or WithKeyCallback should the caller
+// wish to persist it and publish the same onion address again later.
+func (t *OnionTransport) ListenEphemeral(port uint16, opts ...ListenOption) (*OnionListener, error) {
+	if t.isClosed() {
+		return nil, ErrTransportClosed
+	}
+	if t.conn() == nil {
+		return nil, ErrListenRequiresControl
+	}
+	return t.listen(port, nil, append(opts, ephemeralKey)...)
+}
+
+// listen registers an onion service which forwards port to a new local
+// listener. If key is nil a new key is generated by tor. The listener's
+// multiaddr is derived from the onion service ID tor reports for the
+// key, so it is the address the service is actually reachable at. With
+// WithVirtualPort port is the local port instead and the multiaddr
+// carries the virtual port. With WithUnixSocket the local listener is a
+// unix socket.
+func (t *OnionTransport) listen(port uint16, key crypto.PrivateKey, opts ...ListenOption) (*OnionListener, error) {
+	var cfg listenConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	localPort := 0
+	if cfg.virtPort != 0 {
+		localPort, port = int(port), cfg.virtPort
+	}
+	if t.allowedPorts != nil && !t.allowedPorts[port] {
+		return nil, fmt.Errorf("onion service port %d is not an allowed port", port)
+	}
+	if err := cfg.checkMaxStreams(); err != nil {
+		return nil, err
+	}
+	var local net.Listener
+	var target string
+	var err error
+	if cfg.unixPath != "" {
+		if cfg.localTarget != "" {
+			return nil, errors.New("WithLocalTarget and WithUnixSocket cannot be combined")
+		}
+		local, err = net.Listen("unix", cfg.unixPath)
+		target = "unix:" + cfg.unixPath
+	} else {
+		network, addr, terr := localTargetAddr(cfg.localTarget, localPort)
+		if terr != nil {
+			return nil, terr
+		}
+		local, err = net.Listen(network, addr)
+		if err == nil {
+			target = local.Addr().String()
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	var watcher *eventWatcher
+	if cfg.publishCtx != nil {
+		watcher, err = t.watchDescUploads()
+		if err != nil {
+			local.Close()
+			return nil, err
+		}
+		defer watcher.close()
+	}
+	flags := onionFlags{
+		nonAnonymous:           cfg.nonAnonymous,
+		detach:                 cfg.detach,
+		discardPK:              cfg.discardPK,
+		maxStreams:             cfg.maxStreams,
+		maxStreamsCloseCircuit: cfg.maxStreamsCloseCircuit,
+	}
+	info, err := t.addOnion(key, port, target, cfg.authorizedClients, flags)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	proto := "onion"
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		proto = "onion3"
+	}
+	laddr, err := ma.NewMultiaddr(fmt.Sprintf("/%s/%s:%d", proto, info.serviceID, port))
+	if err != nil {
+		local.Close()
+		t.removeOnion(info.serviceID)
+		return nil, err
+	}
+
+	listener := OnionListener{
+		port:      port,
+		key:       info.privateKey,
+		laddr:     laddr,
+		listener:  local,
+		target:    target,
+		serviceID: info.serviceID,
+		clients:   cfg.authorizedClients,
+		limiter:   newConnLimiter(cfg.maxConns, cfg.limitPolicy),
+		ephemeral: cfg.ephemeral,
+		filter:    cfg.acceptFilter,
+		flags:     flags,
+		label:     cfg.label,
+		transport: t,
+	}
+	if err := t.addListener(&listener); err != nil {
+		local.Close()
+		t.removeOnion(info.serviceID)
+		return nil, err
+	}
+	listener.startAcceptQueue(cfg.queueSize, cfg.queueWorkers)
+	if watcher != nil {
+		err := watcher.waitDescUploads(cfg.publishCtx, info.serviceID)
+		if e, ok := err.(*PublishError); err != nil && (!ok || e.Uploaded == 0) {
+			listener.Close()
+			return nil, err
+		}
+		if err != nil {
+			listener.publishErr = err.(*PublishError)
+			t.log().Warn("onion service descriptor partially published", "addr", laddr, "err", err)
+		}
+	}
+	t.log().Info("onion service published", "addr", laddr, "local", local.Addr())
+	if cfg.ephemeral && cfg.keyCallback != nil && info.privateKey != nil {
+		cfg.keyCallback(info.serviceID, info.privateKey)
+	}
 
 	return &listener, nil
 }
 
+// localTargetAddr returns the network and address to bind the local
+// listener of an onion service to, port 0 in target being replaced by
+// localPort. Without a target it is localPort on 127.0.0.1.
+func localTargetAddr(target string, localPort int) (string, string, error) {
+	if target == "" {
+		return "tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid local target %q: %v", target, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return "", "", fmt.Errorf("local target %q must have the IP address of an interface", target)
+	}
+	if port == "0" {
+		port = strconv.Itoa(localPort)
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
 // Matches returns true if the address is a valid onion multiaddr
 func (t *OnionTransport) Matches(a ma.Multiaddr) bool {
 	return IsValidOnionMultiAddr(a)
 }
 
+// Protocols returns the multiaddr protocols the transport dials: onion
+// and onion3 and, unless it only dials onion addresses, tcp
+func (t *OnionTransport) Protocols() []int {
+	if t.onlyOnion {
+		return []int{ma.P_ONION, ma.P_ONION3}
+	}
+	return []int{ma.P_ONION, ma.P_ONION3, ma.P_TCP}
+}
+
+// CanDial returns true if the transport can dial the address. Valid
+// onion and onion3 multiaddrs are always dialable, TCP addrs, by IP or
+// DNS name, only if onlyOnion is not set.
+func (t *OnionTransport) CanDial(a ma.Multiaddr) bool {
+	if t.onlyOnion {
+		// only dial out on onion addresses
+		return IsValidOnionMultiAddr(a)
+	}
+	if _, _, ok := dnsTCPAddr(a); ok {
+		return true
+	}
+	return IsValidOnionMultiAddr(a) || mafmt.TCP.Matches(a)
+}
+
+// Resolve returns the addresses to dial for a, as the resolvers of
+// newer libp2p transports do. Onion addresses need no resolution and
+// DNS names are left for tor to resolve, as a local lookup would leak
+// them outside of tor, so a is returned unchanged. Addresses the
+// transport cannot dial are an error.
+func (t *OnionTransport) Resolve(ctx context.Context, a ma.Multiaddr) ([]ma.Multiaddr, error) {
+	if !t.CanDial(a) {
+		return nil, fmt.Errorf("cannot dial %s", a)
+	}
+	return []ma.Multiaddr{a}, nil
+}
+
+// dnsTCPAddr splits a /dns4, /dns6 or /dnsaddr multiaddr followed by
+// /tcp into its host name and port
+func dnsTCPAddr(a ma.Multiaddr) (string, string, bool) {
+	protos := a.Protocols()
+	if len(protos) != 2 || protos[1].Code != ma.P_TCP {
+		return "", "", false
+	}
+	switch protos[0].Code {
+	case ma.P_DNS4, ma.P_DNS6, ma.P_DNSADDR:
+	default:
+		return "", "", false
+	}
+	host, err := a.ValueForProtocol(protos[0].Code)
+	if err != nil {
+		return "", "", false
+	}
+	port, err := a.ValueForProtocol(ma.P_TCP)
+	if err != nil {
+		return "", "", false
+	}
+	return host, port, true
+}
+
 // OnionDialer implements go-libp2p-transport's Dialer interface
 type OnionDialer struct {
 	auth      *proxy.Auth
 	conn      *OnionConn
-	laddr     *ma.Multiaddr
+	laddr     ma.Multiaddr
 	transport *OnionTransport
 }
 
 // Dial connects to the specified multiaddr and returns
 // a go-libp2p-transport Conn interface
 func (d *OnionDialer) Dial(raddr ma.Multiaddr) (tpt.Conn, error) {
-	dialer, err := d.transport.controlConn.Dialer(d.auth)
+	return d.DialContext(context.Background(), raddr)
+}
+
+// DialContext connects to the specified multiaddr and returns a
+// go-libp2p-transport Conn interface. If ctx is done before the
+// connection is established the dial is abandoned and the context
+// error is returned.
+func (d *OnionDialer) DialContext(ctx context.Context, raddr ma.Multiaddr) (tpt.Conn, error) {
+	metrics := d.transport.getMetrics()
+	metrics.DialAttempt()
+	conn, err := d.dialRetrying(ctx, raddr)
 	if err != nil {
+		d.dialFailed(ctx, metrics, raddr, err)
 		return nil, err
 	}
-	netaddr, err := manet.ToNetAddr(raddr)
-	var onionAddress string
-	if err != nil {
-		onionAddress, err = raddr.ValueForProtocol(ma.P_ONION)
+	d.established(conn, metrics)
+	return conn, nil
+}
+
+// dialFailed records the failure of a dial to raddr
+func (d *OnionDialer) dialFailed(ctx context.Context, metrics Metrics, raddr ma.Multiaddr, err error) {
+	reason := dialFailureReason(ctx, err)
+	metrics.DialFailure(reason)
+	d.transport.log().Debug("dial failed", "addr", raddr, "reason", reason, "err", err)
+}
+
+// established records the successful dial of conn, reports it to the
+// ConnState hook and starts its idle and keep-alive timers
+func (d *OnionDialer) established(conn *OnionConn, metrics Metrics) {
+	metrics.DialSuccess()
+	metrics.ConnOpened()
+	conn.metrics = metrics
+	conn.opened(d.transport.connStateHook)
+	conn.startIdleTimer(d.transport.idleTimeout)
+	conn.startKeepAlive(d.transport.keepAliveInterval, d.transport.keepAliveHeartbeat)
+}
+
+func (d *OnionDialer) dial(ctx context.Context, raddr ma.Multiaddr) (*OnionConn, error) {
+	if d.transport.isClosed() {
+		return nil, ErrTransportClosed
+	}
+	if d.transport.onlyOnion && !IsValidOnionMultiAddr(raddr) {
+		return nil, ErrNonOnionDialBlocked
+	}
+	var onionHost string
+	var network, target string
+	if host, port, ok := dnsTCPAddr(raddr); ok {
+		// the name is passed to tor unresolved, a local lookup would
+		// leak it outside of tor
+		network, target = "tcp", net.JoinHostPort(host, port)
+	} else if netaddr, err := manet.ToNetAddr(raddr); err == nil {
+		network, target = netaddr.Network(), netaddr.String()
+	} else {
+		code := ma.P_ONION
+		onionAddress, err := raddr.ValueForProtocol(code)
+		if err != nil {
+			code = ma.P_ONION3
+			onionAddress, err = raddr.ValueForProtocol(code)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var onionPort int
+		onionHost, onionPort, err = parseOnionAddr(code, onionAddress)
 		if err != nil {
 			return nil, err
 		}
+		// tor resolves the onion name so the target has no IP family,
+		// the family used to reach the SOCKS port is set by socksNet
+		network, target = "tcp", onionHost+".onion:"+strconv.Itoa(onionPort)
 	}
 	onionConn := OnionConn{
 		transport: tpt.Transport(d.transport),
 		laddr:     d.laddr,
-		raddr:     &raddr,
+		raddr:     raddr,
+		target:    target,
+		onion:     onionHost != "",
 	}
-	if onionAddress != "" {
-		split := strings.Split(onionAddress, ":")
-		onionConn.Conn, err = dialer.Dial("tcp4", split[0]+".onion:"+split[1])
-	} else {
-		onionConn.Conn, err = dialer.Dial(netaddr.Network(), netaddr.String())
+	if onionHost == "" && d.transport.directTCP {
+		d.transport.log().Debug("dialing directly, bypassing tor", "addr", raddr)
+		var direct net.Dialer
+		conn, err := direct.DialContext(ctx, network, target)
+		if err != nil {
+			return nil, err
+		}
+		onionConn.Conn = conn
+		return &onionConn, nil
+	}
+	d.transport.log().Debug("dialing through tor", "addr", raddr, "onion", onionHost != "", "isolation", d.transport.isolation)
+	onionConn.dialer = d
+	onionConn.socksAuth = d.transport.dialAuth(d.auth, raddr, time.Now())
+	conn, unreachable, err := d.dialSOCKS(ctx, onionConn.socksAuth, network, onionConn.target)
+	if unreachable && d.transport.conn() != nil && ctx.Err() == nil {
+		// tor may have restarted on a different SOCKS port
+		d.transport.log().Info("SOCKS port unreachable, rediscovering it", "err", err)
+		d.transport.resetSOCKSEndpoint()
+		conn, _, err = d.dialSOCKS(ctx, onionConn.socksAuth, network, onionConn.target)
 	}
 	if err != nil {
+		if onionHost != "" {
+			return nil, socksReplyError(err)
+		}
 		return nil, err
 	}
+	onionConn.Conn = conn
 	return &onionConn, nil
 }
 
-func (d *OnionDialer) DialContext(ctx context.Context, raddr ma.Multiaddr) (tpt.Conn, error) {
-	return d.Dial(raddr)
+// dialSOCKS dials addr through the tor SOCKS port with the credentials
+// auth, also reporting whether the SOCKS port itself could not be
+// reached
+func (d *OnionDialer) dialSOCKS(ctx context.Context, auth *proxy.Auth, network, addr string) (net.Conn, bool, error) {
+	if err := d.transport.acquireDialSlot(ctx); err != nil {
+		return nil, false, err
+	}
+	defer d.transport.releaseDialSlot()
+	if d.transport.proxyDialer != nil {
+		conn, err := dialContext(ctx, d.transport.proxyDialer, network, addr)
+		return conn, false, err
+	}
+	forward := newAbortableForward(ctx)
+	defer forward.release()
+	dialer, err := d.transport.newTorDialer(auth, forward)
+	if err != nil {
+		return nil, false, err
+	}
+	conn, err := dialContext(ctx, dialer, network, addr)
+	if err != nil {
+		return nil, forward.unreachable(), err
+	}
+	if forward.release() {
+		conn.Close()
+		return nil, false, ctx.Err()
+	}
+	return conn, false, nil
+}
+
+// contextDialer is implemented by proxy dialers that support
+// cancellation natively
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// abortableForward connects proxy dialers to the SOCKS port and closes
+// those connections if ctx is done before the dial is released, which
+// aborts SOCKS handshakes still in flight so that a cancelled dial does
+// not keep holding a circuit
+type abortableForward struct {
+	ctx  context.Context
+	done chan struct{}
+
+	mtx      sync.Mutex
+	conns    []net.Conn
+	released bool
+	// dialErr is set if connecting to the SOCKS port failed
+	dialErr error
+}
+
+func newAbortableForward(ctx context.Context) *abortableForward {
+	f := &abortableForward{ctx: ctx, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.abort()
+		case <-f.done:
+		}
+	}()
+	return f
+}
+
+// Dial connects to the SOCKS port
+func (f *abortableForward) Dial(network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(f.ctx, network, addr)
+	if err != nil {
+		f.mtx.Lock()
+		f.dialErr = err
+		f.mtx.Unlock()
+		return nil, err
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.released || f.ctx.Err() != nil {
+		conn.Close()
+		return nil, f.ctx.Err()
+	}
+	f.conns = append(f.conns, conn)
+	return conn, nil
+}
+
+// unreachable reports whether connecting to the SOCKS port failed
+func (f *abortableForward) unreachable() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.dialErr != nil
+}
+
+// abort closes all connections made unless the dial was released
+func (f *abortableForward) abort() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if !f.released {
+		f.closeConns()
+	}
+}
+
+// release stops watching ctx once the dial has returned. It reports
+// whether ctx was done, in which case the connections have been closed.
+// Calling release more than once is safe.
+func (f *abortableForward) release() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.released {
+		return false
+	}
+	f.released = true
+	close(f.done)
+	if f.ctx.Err() != nil {
+		f.closeConns()
+		return true
+	}
+	return false
+}
+
+func (f *abortableForward) closeConns() {
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+// dialContext dials addr through dialer, giving up when ctx is done.
+// A connection that completes after the caller has given up is closed.
+func dialContext(ctx context.Context, dialer proxy.Dialer, network, addr string) (net.Conn, error) {
+	if d, ok := dialer.(contextDialer); ok {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := dialer.Dial(network, addr)
+		done <- dialResult{conn, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
 }
 
 // If onlyOnion is set, Matches returns true only for onion addrs.
 // Otherwise TCP addrs can use this dialer in addition to onion.
 func (d *OnionDialer) Matches(a ma.Multiaddr) bool {
-	if d.transport.onlyOnion {
-		// only dial out on onion addresses
-		return IsValidOnionMultiAddr(a)
-	} else {
-		return IsValidOnionMultiAddr(a) || mafmt.TCP.Matches(a)
-	}
+	return d.transport.CanDial(a)
 }
 
 // OnionListener implements go-libp2p-transport's Listener interface
 type OnionListener struct {
 	port      uint16
-	key       *rsa.PrivateKey
+	key       crypto.PrivateKey
 	laddr     ma.Multiaddr
 	listener  net.Listener
-	transport tpt.Transport
+	serviceID string
+	// target is where tor forwards connections, the address of
+	// listener or "unix:" and its path
+	target string
+	// clients are the x25519 public keys of authorized clients
+	clients [][32]byte
+	// limiter caps the open accepted connections, if set
+	limiter *connLimiter
+	// ephemeral is set when the key was generated for the listener
+	ephemeral bool
+	// filter admits accepted connections, if set
+	filter func(conn net.Conn) error
+	// flags are the ADD_ONION flags the service was published with
+	flags onionFlags
+	// queue holds connections accepted in the background, if set
+	queue *acceptQueue
+	// label is set with WithLabel and passed on to accepted connections
+	label string
+	// publishErr reports a partial descriptor upload, see WithPublishWait
+	publishErr *PublishError
+	transport  *OnionTransport
+
+	stopOnce  sync.Once
+	stopErr   error
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // Accept blocks until a connection is received returning
 // go-libp2p-transport's Conn interface or an error if
 // something went wrong
 func (l *OnionListener) Accept() (tpt.Conn, error) {
-	conn, err := l.listener.Accept()
-	if err != nil {
-		return nil, err
+	if l.queue != nil {
+		conn, err := l.queue.accept()
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
 	}
-	raddr, err := manet.FromNetAddr(conn.RemoteAddr())
-	if err != nil {
-		return nil, err
+	if !l.limiter.wait() {
+		return nil, errListenerClosed
+	}
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.limiter.abandon()
+			return nil, err
+		}
+		if onionConn := l.upgrade(conn); onionConn != nil {
+			return onionConn, nil
+		}
+	}
+}
+
+// upgrade admits conn under the connection limit and the accept filter
+// and wraps it, returning nil if conn was turned away and closed
+func (l *OnionListener) upgrade(conn net.Conn) *OnionConn {
+	if !l.limiter.admit() {
+		l.transport.log().Debug("rejected connection over the limit", "addr", l.laddr)
+		conn.Close()
+		return nil
+	}
+	if err := l.runFilter(conn); err != nil {
+		l.transport.log().Debug("connection rejected by accept filter", "addr", l.laddr, "err", err)
+		conn.Close()
+		l.limiter.reject()
+		return nil
+	}
+	metrics := l.transport.getMetrics()
+	metrics.Accept()
+	labeledAccept(metrics, l.label)
+	metrics.ConnOpened()
+	// tor delivers the stream from the loopback interface and does not
+	// reveal the client, all that is known is the onion service it
+	// connected to
+	raddr := l.laddr
+	if l.serviceID == "" {
+		// a TCP listener knows its peers
+		if a, err := manet.FromNetAddr(conn.RemoteAddr()); err == nil {
+			raddr = a
+		}
 	}
 	onionConn := OnionConn{
 		Conn:      conn,
-		transport: l.transport,
-		laddr:     &l.laddr,
-		raddr:     &raddr,
+		transport: tpt.Transport(l.transport),
+		laddr:     l.laddr,
+		raddr:     raddr,
+		metrics:   metrics,
+		limiter:   l.limiter,
+		tracker:   l.transport,
+		label:     l.label,
+		onion:     l.serviceID != "",
 	}
-	return &onionConn, nil
+	l.transport.trackConn(&onionConn)
+	onionConn.opened(l.transport.connStateHook)
+	onionConn.startIdleTimer(l.transport.idleTimeout)
+	onionConn.startKeepAlive(l.transport.keepAliveInterval, l.transport.keepAliveHeartbeat)
+	return &onionConn
 }
 
-// Close shuts down the listener
+// Close shuts down the listener and removes its onion service from tor.
+// Only the first call has any effect; later calls return its result.
 func (l *OnionListener) Close() error {
-	return l.listener.Close()
+	l.closeOnce.Do(func() {
+		if l.transport != nil {
+			l.transport.removeListener(l)
+		}
+		l.closeErr = l.stopAccepting()
+		if l.transport != nil && l.serviceID != "" {
+			if err := l.transport.delOnion(l.serviceID); l.closeErr == nil {
+				l.closeErr = err
+			}
+		}
+	})
+	return l.closeErr
+}
+
+// stopAccepting closes the local listener so that no more connections
+// are accepted, leaving the onion service published
+func (l *OnionListener) stopAccepting() error {
+	l.stopOnce.Do(func() {
+		l.stopErr = l.listener.Close()
+		l.limiter.close()
+		if l.queue != nil {
+			l.queue.drain()
+		}
+	})
+	return l.stopErr
 }
 
-// Addr returns the net.Addr interface which represents
-// the local multiaddr we are listening on
+// PrivateKey returns the onion service key used by this listener;
+// either an *rsa.PrivateKey for v2 or an ed25519.PrivateKey for v3
+// onion services
+func (l *OnionListener) PrivateKey() crypto.PrivateKey {
+	return l.key
+}
+
+// Addr returns the onion address and virtual port of the service as
+// an *OnionAddr, or the bound address of a TCP listener
 func (l *OnionListener) Addr() net.Addr {
-	netaddr, _ := manet.ToNetAddr(l.laddr)
-	return netaddr
+	if l.serviceID == "" {
+		return l.listener.Addr()
+	}
+	return &OnionAddr{ServiceID: l.serviceID, Port: l.port}
 }
 
 // Multiaddr returns the local multiaddr we are listening on
@@ -316,10 +1385,81 @@ func (l *OnionListener) Multiaddr() ma.Multiaddr {
 
 // OnionConn implement's go-libp2p-transport's Conn interface
 type OnionConn struct {
+	// bytesRead and bytesWritten count the connection's traffic. They
+	// are accessed atomically and kept first for 64-bit alignment.
+	bytesRead    uint64
+	bytesWritten uint64
+
 	net.Conn
 	transport tpt.Transport
-	laddr     *ma.Multiaddr
-	raddr     *ma.Multiaddr
+	laddr     ma.Multiaddr
+	raddr     ma.Multiaddr
+	// target is the address requested from the SOCKS proxy, empty
+	// for inbound connections
+	target string
+	// onion is set for connections to and from onion services
+	onion bool
+	// dialer and socksAuth, the credentials selecting the circuit, are
+	// kept for Rotate on connections dialed through tor
+	dialer    *OnionDialer
+	socksAuth *proxy.Auth
+	// connMtx guards Conn and socksAuth, which Rotate replaces, and
+	// closed, which stops Rotate once Close was called
+	connMtx sync.Mutex
+	closed  bool
+
+	// metrics is told when the connection closes
+	metrics Metrics
+	// stateHook is told when the connection closes, with info
+	// describing it as when it opened
+	stateHook func(ConnInfo, ConnState)
+	info      ConnInfo
+	// limiter is given back the slot of an accepted connection when
+	// it closes
+	limiter *connLimiter
+	// label is the label of the listener which accepted the connection
+	label string
+	// idleTimer closes the connection once it has been idle for
+	// idleTimeout, if set
+	idleTimer   *time.Timer
+	idleTimeout time.Duration
+	// keepAliveTimer writes a heartbeat once the connection has been
+	// idle for keepAliveInterval, if set
+	keepAliveTimer    *time.Timer
+	keepAliveInterval time.Duration
+	// tracker is the transport which accepted the connection and
+	// waits for it in Shutdown
+	tracker   *OnionTransport
+	closeOnce sync.Once
+}
+
+// Close closes the connection
+func (c *OnionConn) Close() error {
+	c.connMtx.Lock()
+	c.closed = true
+	conn := c.Conn
+	c.connMtx.Unlock()
+	err := conn.Close()
+	c.closeOnce.Do(func() {
+		if c.metrics != nil {
+			c.metrics.ConnClosed()
+			labeledConnClosed(c.metrics, c.label)
+		}
+		c.limiter.release()
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		if c.keepAliveTimer != nil {
+			c.keepAliveTimer.Stop()
+		}
+		if c.tracker != nil {
+			c.tracker.untrackConn(c)
+		}
+		if c.stateHook != nil {
+			c.stateHook(c.info, StateClosed)
+		}
+	})
+	return err
 }
 
 // Transport returns the OnionTransport associated
@@ -330,10 +1470,23 @@ func (c *OnionConn) Transport() tpt.Transport {
 
 // LocalMultiaddr returns the local multiaddr for this connection
 func (c *OnionConn) LocalMultiaddr() ma.Multiaddr {
-	return *c.laddr
+	return c.laddr
 }
 
-// RemoteMultiaddr returns the remote multiaddr for this connection
+// RemoteMultiaddr returns the remote multiaddr for this connection.
+// The onion address of a client is not available to an onion service,
+// so for connections accepted by an onion service it is the multiaddr
+// of the service the client connected to rather than the loopback
+// address tor delivered the stream from.
 func (c *OnionConn) RemoteMultiaddr() ma.Multiaddr {
-	return *c.raddr
+	return c.raddr
+}
+
+// IsOnion reports whether the connection was dialed to or accepted by
+// an onion service, in which case its traffic never leaves tor. It is
+// false for TCP connections, including those dialed through a tor exit
+// relay, whose traffic travels unprotected between the exit and the
+// peer.
+func (c *OnionConn) IsOnion() bool {
+	return c.onion
 }
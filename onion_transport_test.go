@@ -1,14 +1,25 @@
 package torOnion
 
 import (
-	"testing"
-	ma "github.com/multiformats/go-multiaddr"
+	"context"
+	"crypto/rand"
 	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	tpt "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/yawning/bulb"
 	"github.com/yawning/bulb/utils/pkcs1"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
 	"os"
-	"encoding/pem"
-	"crypto/rand"
 	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 )
 
 var key string
@@ -25,7 +36,7 @@ func setup() {
 }
 
 func teardown() {
-	os.RemoveAll(path.Join("./", key + ".onion_key"))
+	os.RemoveAll(path.Join("./", key+".onion_key"))
 }
 
 func TestIsValidOnionMultiAddr(t *testing.T) {
@@ -39,6 +50,16 @@ func TestIsValidOnionMultiAddr(t *testing.T) {
 		t.Fatal("IsValidMultiAddr failed")
 	}
 
+	// Test valid v3
+	validAddr, err = ma.NewMultiaddr("/onion3/vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid = IsValidOnionMultiAddr(validAddr)
+	if !valid {
+		t.Fatal("IsValidMultiAddr failed")
+	}
+
 	// Test wrong protocol
 	invalidAddr, err := ma.NewMultiaddr("/ip4/0.0.0.0/tcp/4001")
 	if err != nil {
@@ -50,18 +71,119 @@ func TestIsValidOnionMultiAddr(t *testing.T) {
 	}
 }
 
+func TestParseOnionAddr(t *testing.T) {
+	host, port, err := parseOnionAddr(ma.P_ONION, "erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "erhkddypoy6qml6h" || port != 4003 {
+		t.Fatalf("parsed wrong address %s:%d", host, port)
+	}
+
+	for _, addr := range []string{
+		"erhkddypoy6qml6h",
+		"erhkddypoy6qml6h:",
+		"erhkddypoy6qml6h:4003:4004",
+		":4003",
+		"erhkddypoy6qml6h:0",
+		"erhkddypoy6qml6h:65536",
+	} {
+		if _, _, err := parseOnionAddr(ma.P_ONION, addr); err == nil {
+			t.Errorf("parsed malformed onion address %q", addr)
+		}
+	}
+}
+
+func TestOnionSuffix(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		addr string
+		host string
+	}{
+		{ma.P_ONION, "erhkddypoy6qml6h:4003", "erhkddypoy6qml6h"},
+		{ma.P_ONION, "erhkddypoy6qml6h.onion:4003", "erhkddypoy6qml6h"},
+		{ma.P_ONION, "ERHKDDYPOY6QML6H.ONION:4003", "erhkddypoy6qml6h"},
+		{ma.P_ONION3, "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd:1234", "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd"},
+		{ma.P_ONION3, "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd.onion:1234", "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd"},
+	} {
+		host, _, err := parseOnionAddr(tc.code, tc.addr)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", tc.addr, err)
+		}
+		if host != tc.host {
+			t.Fatalf("parsed %q as %s, expected %s", tc.addr, host, tc.host)
+		}
+	}
+	for _, addr := range []string{"erhkddypoy6qml6h.onion.onion:4003", ".onion:4003"} {
+		if _, _, err := parseOnionAddr(ma.P_ONION, addr); err == nil {
+			t.Errorf("parsed malformed onion address %q", addr)
+		}
+	}
+}
+
+func TestMixedCaseOnionAddr(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		addr string
+		host string
+	}{
+		{ma.P_ONION, "ErHkDdYpOy6QmL6h:4003", "erhkddypoy6qml6h"},
+		{ma.P_ONION3, "VWW6YBAL4BD7SZMGNCYRUUCPGFKQAHZDDI37KTCEO3AH7NGMCOPNPYYD:1234", "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd"},
+	} {
+		host, _, err := parseOnionAddr(tc.code, tc.addr)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", tc.addr, err)
+		}
+		if host != tc.host {
+			t.Fatalf("parsed %q as %s, expected %s", tc.addr, host, tc.host)
+		}
+	}
+
+	addr, err := ma.NewMultiaddr("/onion3/VWW6YBAL4BD7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsValidOnionMultiAddr(addr) {
+		t.Fatal("mixed-case onion address is invalid")
+	}
+
+	// the dial target is lowercase
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if target := fs.LastTarget(); target != "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd.onion:1234" {
+		t.Fatalf("dialed %s", target)
+	}
+}
+
 func Test_loadKeys(t *testing.T) {
-	tpt := &OnionTransport{keysDir:"./"}
+	tpt := &OnionTransport{keysDir: "./"}
 	keys, err := tpt.loadKeys()
 	if err != nil {
 		t.Fatal(err)
 	}
-	tpt.keys = keys
-	k, ok := tpt.keys[key]
+	tpt.setKeys(keys)
+	k, ok := tpt.getKey(key)
+	if !ok {
+		t.Fatal("Failed to correctly load keys")
+	}
+	rsaKey, ok := k.(*rsa.PrivateKey)
 	if !ok {
 		t.Fatal("Failed to correctly load keys")
 	}
-	id, err := pkcs1.OnionAddr(&k.PublicKey)
+	id, err := pkcs1.OnionAddr(&rsaKey.PublicKey)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,7 +192,162 @@ func Test_loadKeys(t *testing.T) {
 	}
 }
 
-func createHiddenServiceKey() (string, error){
+func TestListenNonOnionAddr(t *testing.T) {
+	tpt := &OnionTransport{}
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tpt.Listen(addr)
+	if !errors.Is(err, ErrInvalidOnionAddr) {
+		t.Fatalf("expected ErrInvalidOnionAddr, got %v", err)
+	}
+	if !strings.Contains(err.Error(), addr.String()) {
+		t.Fatalf("error does not name the multiaddr: %v", err)
+	}
+}
+
+func TestDialNonOnionBlocked(t *testing.T) {
+	tpt := &OnionTransport{onlyOnion: true}
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial(addr); err != ErrNonOnionDialBlocked {
+		t.Fatalf("expected ErrNonOnionDialBlocked, got %v", err)
+	}
+}
+
+func TestCanDial(t *testing.T) {
+	onion3, err := ma.NewMultiaddr("/onion3/vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpt := &OnionTransport{onlyOnion: true}
+	if !tpt.CanDial(onion3) {
+		t.Fatal("CanDial rejected a valid onion3 address")
+	}
+	if tpt.CanDial(tcp) {
+		t.Fatal("CanDial accepted a TCP address with onlyOnion set")
+	}
+	for _, code := range tpt.Protocols() {
+		if code == ma.P_TCP {
+			t.Fatal("Protocols includes tcp with onlyOnion set")
+		}
+	}
+
+	tpt = &OnionTransport{}
+	if !tpt.CanDial(onion3) || !tpt.CanDial(tcp) {
+		t.Fatal("CanDial rejected an address without onlyOnion set")
+	}
+	if protos := tpt.Protocols(); len(protos) != 3 || protos[1] != ma.P_ONION3 {
+		t.Fatalf("unexpected protocols %v", protos)
+	}
+}
+
+func TestCloseTransport(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tpt := &OnionTransport{controlConn: bulb.NewConn(c1)}
+	if err := tpt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpt.Close(); err != nil {
+		t.Fatalf("second Close failed: %v", err)
+	}
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpt.Listen(addr); err != ErrTransportClosed {
+		t.Fatalf("expected transport closed error from Listen, got %v", err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial(addr); err != ErrTransportClosed {
+		t.Fatalf("expected transport closed error from Dial, got %v", err)
+	}
+}
+
+func TestConcurrentListenKeyLookup(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tpt := &OnionTransport{keysDir: "./", controlConn: bulb.NewConn(c1)}
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := tpt.Listen(addr); err == nil {
+				t.Error("Listen succeeded without key material")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			keys, err := tpt.loadKeys()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tpt.setKeys(keys)
+		}()
+	}
+	wg.Wait()
+}
+
+// blockingDialer blocks every dial until release is closed
+type blockingDialer struct {
+	release chan struct{}
+	conns   chan net.Conn
+}
+
+func (d *blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	<-d.release
+	c1, c2 := net.Pipe()
+	d.conns <- c2
+	return c1, nil
+}
+
+func TestDialContextTimeout(t *testing.T) {
+	dialer := &blockingDialer{
+		release: make(chan struct{}),
+		conns:   make(chan net.Conn, 1),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := dialContext(ctx, dialer, "tcp4", "erhkddypoy6qml6h.onion:4003")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	// the abandoned connection must be closed once the dial completes
+	close(dialer.release)
+	remote := <-dialer.conns
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected abandoned connection to be closed, got %v", err)
+	}
+}
+
+func createHiddenServiceKey() (string, error) {
 	priv, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
 		return "", err
@@ -80,7 +357,7 @@ func createHiddenServiceKey() (string, error){
 		return "", err
 	}
 
-	f, err := os.Create(id+".onion_key")
+	f, err := os.Create(id + ".onion_key")
 	if err != nil {
 		return "", err
 	}
@@ -98,3 +375,194 @@ func createHiddenServiceKey() (string, error){
 	}
 	return id, nil
 }
+
+func TestSentinelErrors(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpt.Listen(addr); !errors.Is(err, ErrMissingKey) {
+		t.Fatalf("expected ErrMissingKey, got %v", err)
+	}
+	tpt.Close()
+	if _, err := tpt.Listen(addr); !errors.Is(err, ErrTransportClosed) {
+		t.Fatalf("expected ErrTransportClosed, got %v", err)
+	}
+
+	socksOnly, err := NewSOCKSOnionTransport("tcp4", "127.0.0.1:9050", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksOnly.Close()
+	if _, err := socksOnly.ListenEphemeralV3(4003); !errors.Is(err, ErrListenRequiresControl) {
+		t.Fatalf("expected ErrListenRequiresControl, got %v", err)
+	}
+
+	fc.SetPassword("secret")
+	fc.SetAuthMethods("HASHEDPASSWORD")
+	if _, err := NewOnionTransport("tcp4", fc.Addr(), "wrong", nil, t.TempDir(), false); !errors.Is(err, ErrControlAuthFailed) {
+		t.Fatalf("expected ErrControlAuthFailed, got %v", err)
+	}
+
+	if _, _, err := parseOnionAddr(ma.P_ONION3, "hnvcppgow2sc2yvdvdicu3ynonsteflxdxrehjr2ybekdc2z3iu63yia:4003"); !errors.Is(err, ErrInvalidOnionAddr) {
+		t.Fatalf("expected ErrInvalidOnionAddr, got %v", err)
+	}
+	if err := ValidateV3OnionAddress("erhkddypoy6qml6h"); !errors.Is(err, ErrInvalidOnionAddr) {
+		t.Fatalf("expected ErrInvalidOnionAddr, got %v", err)
+	}
+}
+
+func TestConnIsOnion(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fs := testutil.NewSOCKSServer(t)
+	fs.Control = fc
+	fc.SetSOCKSAddr(fs.Addr())
+	transport := newControlTransport(t, fc)
+	dialer, err := transport.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, false, WithDirectTCP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+	directDialer, err := direct.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onionListener, err := transport.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer onionListener.Close()
+	tcpAddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := transport.Listen(tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+
+	for _, tc := range []struct {
+		name     string
+		dialer   tpt.Dialer
+		listener tpt.Listener
+		onion    bool
+	}{
+		{"onion service", dialer, onionListener, true},
+		{"direct TCP", directDialer, tcpListener, false},
+	} {
+		conn, err := tc.dialer.Dial(tc.listener.Multiaddr())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		accepted, err := tc.listener.Accept()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if conn.(*OnionConn).IsOnion() != tc.onion || accepted.(*OnionConn).IsOnion() != tc.onion {
+			t.Errorf("%s: expected IsOnion %v for dialed and accepted connections", tc.name, tc.onion)
+		}
+		conn.Close()
+		accepted.Close()
+	}
+
+	// TCP traffic leaves tor at the exit relay
+	conn, err := dialer.Dial(tcpListener.Multiaddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.(*OnionConn).IsOnion() {
+		t.Error("TCP connection through tor reported as onion")
+	}
+}
+
+func TestTransportString(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.AuthMethods = "HASHEDPASSWORD"
+	fc.Password = "hunter2"
+	auth := &proxy.Auth{User: "socksuser", Password: "sockspass"}
+	transport, err := NewOnionTransport("tcp4", fc.Addr(), "hunter2", auth, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	l, err := transport.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := transport.WaitBootstrap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s := transport.String()
+	for _, want := range []string{"control=tcp4:" + fc.Addr(), "onlyOnion=true", "listeners=1", "connected=true", "bootstrapped=true", "closed=false"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("%q lacks %q", s, want)
+		}
+	}
+	for _, secret := range []string{"hunter2", "socksuser", "sockspass"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("%q leaks %q", s, secret)
+		}
+	}
+}
+
+// resolver is the address resolution interface of newer libp2p
+// transports
+type resolver interface {
+	Resolve(ctx context.Context, a ma.Multiaddr) ([]ma.Multiaddr, error)
+}
+
+var _ resolver = (*OnionTransport)(nil)
+
+func TestResolve(t *testing.T) {
+	onlyOnion, err := NewSOCKSOnionTransport("tcp4", "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer onlyOnion.Close()
+	for _, s := range []string{
+		"/onion/erhkddypoy6qml6h:4003",
+		"/onion3/vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd:1234",
+	} {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := onlyOnion.Resolve(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resolved) != 1 || !resolved[0].Equal(addr) {
+			t.Fatalf("%s resolved to %v", addr, resolved)
+		}
+	}
+
+	tcp, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := onlyOnion.Resolve(context.Background(), tcp); err == nil {
+		t.Fatal("resolved an address the transport cannot dial")
+	}
+	transport, err := NewSOCKSOnionTransport("tcp4", "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	if resolved, err := transport.Resolve(context.Background(), tcp); err != nil || !resolved[0].Equal(tcp) {
+		t.Fatalf("%s resolved to %v, %v", tcp, resolved, err)
+	}
+}
@@ -0,0 +1,102 @@
+package torOnion
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base32"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// onionV3Version is the version byte embedded in v3 onion addresses
+const onionV3Version = 0x03
+
+// onionV3Address derives the v3 onion address, without the ".onion"
+// suffix, for the ed25519 public key of an onion service
+func onionV3Address(pub ed25519.PublicKey) string {
+	// onion_address = base32(PUBKEY | CHECKSUM | VERSION)
+	b := make([]byte, 0, 35)
+	b = append(b, pub...)
+	b = append(b, onionV3Checksum(pub, onionV3Version)...)
+	b = append(b, onionV3Version)
+	return normalizeOnionHost(base32.StdEncoding.EncodeToString(b))
+}
+
+// onionV3Checksum computes the checksum embedded in v3 onion addresses
+func onionV3Checksum(pub []byte, version byte) []byte {
+	// CHECKSUM = H(".onion checksum" | PUBKEY | VERSION)[:2]
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pub)
+	h.Write([]byte{version})
+	return h.Sum(nil)[:2]
+}
+
+// ValidateV3OnionAddress checks that host is a well formed v3 onion
+// address, with or without the ".onion" suffix. Besides its length, the
+// version byte and the checksum over the public key are verified, so
+// that corrupted addresses, for instance received from untrusted peers,
+// are rejected before building circuits to them.
+func ValidateV3OnionAddress(host string) error {
+	if err := validateV3OnionAddress(normalizeOnionHost(host)); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOnionAddr, err)
+	}
+	return nil
+}
+
+// validateV3OnionAddress checks the normalized v3 onion address id
+func validateV3OnionAddress(id string) error {
+	if len(id) != 56 {
+		return errors.New("v3 onion address must be 56 characters")
+	}
+	b, err := decodeOnionHost(id)
+	if err != nil {
+		return fmt.Errorf("v3 onion address is not base32: %v", err)
+	}
+	if len(b) != 35 {
+		return errors.New("v3 onion address must decode to 35 bytes")
+	}
+	pub, checksum, version := b[:32], b[32:34], b[34]
+	if version != onionV3Version {
+		return fmt.Errorf("unsupported onion address version %d", version)
+	}
+	if !bytes.Equal(checksum, onionV3Checksum(pub, version)) {
+		return errors.New("v3 onion address checksum mismatch")
+	}
+	return nil
+}
+
+// expandEd25519Key converts an ed25519 private key into the 64 byte
+// expanded form tor expects in ADD_ONION ED25519-V3 key blobs
+func expandEd25519Key(key ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(key.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:]
+}
+
+// ListenEphemeralV3 creates a v3 onion service on the given virtual
+// port using a newly generated ed25519 key. The service is removed
+// from tor when the listener is closed, and the listener's multiaddr
+// is the onion3 address of the service. The generated key is
+// available from the listener's PrivateKey method should the caller
+// wish to persist it. opts configure the service, for instance
+// WithAuthorizedClients.
+func (t *OnionTransport) ListenEphemeralV3(port uint16, opts ...ListenOption) (*OnionListener, error) {
+	if t.isClosed() {
+		return nil, ErrTransportClosed
+	}
+	if t.conn() == nil {
+		return nil, ErrListenRequiresControl
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return t.listen(port, key, append(opts, ephemeralKey)...)
+}
@@ -0,0 +1,167 @@
+package torOnion
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestListenEphemeralV3(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := l.PrivateKey().(ed25519.PrivateKey)
+	if !ok {
+		t.Fatalf("expected an ed25519 key, got %T", l.PrivateKey())
+	}
+	id := onionV3Address(key.Public().(ed25519.PublicKey))
+	if l.Multiaddr().String() != "/onion3/"+id+":4003" {
+		t.Fatalf("multiaddr %s does not match key %s", l.Multiaddr(), id)
+	}
+	if !IsValidOnionMultiAddr(l.Multiaddr()) {
+		t.Fatalf("listener has an invalid multiaddr: %s", l.Multiaddr())
+	}
+	if !fc.HasOnion(id) {
+		t.Fatal("onion service was not registered")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fc.HasOnion(id) {
+		t.Fatal("onion service was not removed on Close")
+	}
+}
+
+func TestListenV3KeyFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := onionV3Address(pub)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, id+".onion_v3_key"), pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	tpt.keysDir = dir
+	keys, err := tpt.loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt.setKeys(keys)
+
+	addr, err := ma.NewMultiaddr("/onion3/" + id + ":4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tpt.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !fc.HasOnion(id) {
+		t.Fatal("onion service was not registered with the loaded key")
+	}
+}
+
+func TestListenVirtualPort(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+
+	// publish on port 80 while binding any free local port
+	l, err := tpt.ListenEphemeralV3(0, WithVirtualPort(80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Multiaddr().String() != "/onion3/"+l.serviceID+":80" {
+		t.Fatalf("multiaddr %s does not carry the virtual port", l.Multiaddr())
+	}
+	local := l.listener.Addr().(*net.TCPAddr)
+	if local.Port == 0 || local.Port == 80 {
+		t.Fatalf("unexpected local port %d", local.Port)
+	}
+	if target, ok := fc.OnionTarget(l.serviceID, 80); !ok || target != local.String() {
+		t.Fatalf("virtual port 80 forwards to %q, expected %s", target, local)
+	}
+}
+
+func TestValidateV3OnionAddress(t *testing.T) {
+	const valid = "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd"
+	for _, host := range []string{valid, valid + ".onion", "VWW6YBAL4BD7SZMGNCYRUUCPGFKQAHZDDI37KTCEO3AH7NGMCOPNPYYD.onion"} {
+		if err := ValidateV3OnionAddress(host); err != nil {
+			t.Fatalf("rejected valid address %s: %v", host, err)
+		}
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateV3OnionAddress(onionV3Address(pub)); err != nil {
+		t.Fatalf("rejected derived address: %v", err)
+	}
+	// an address with another version byte and its matching checksum
+	b := append(append(append([]byte{}, pub...), onionV3Checksum(pub, 4)...), 4)
+	wrongVersion := base32.StdEncoding.EncodeToString(b)
+
+	for _, host := range []string{
+		"",
+		"erhkddypoy6qml6h",
+		valid[:55],
+		valid + "a",
+		// a corrupted public key no longer matches the checksum
+		"a" + valid[1:],
+		"vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyy1",
+		wrongVersion,
+	} {
+		if err := ValidateV3OnionAddress(host); err == nil {
+			t.Errorf("accepted malformed address %q", host)
+		}
+	}
+
+	// corrupted addresses are rejected before dialing
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion3/a" + valid[1:] + ":4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsValidOnionMultiAddr(addr) {
+		t.Fatal("corrupted address is valid")
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial(addr); err == nil {
+		t.Fatal("dialed a corrupted address")
+	}
+	if n := fs.Requests(); n != 0 {
+		t.Fatalf("sent %d SOCKS requests for a corrupted address", n)
+	}
+}
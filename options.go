@@ -0,0 +1,164 @@
+package torOnion
+
+import (
+	"crypto"
+
+	"golang.org/x/net/proxy"
+)
+
+// Option configures optional behavior of an OnionTransport
+type Option func(*OnionTransport)
+
+// WithControlPassword sets the tor control port password
+func WithControlPassword(pass string) Option {
+	return func(t *OnionTransport) {
+		t.controlPass = pass
+	}
+}
+
+// WithSOCKSAuth sets the username and password sent to the tor SOCKS
+// port
+func WithSOCKSAuth(auth *proxy.Auth) Option {
+	return func(t *OnionTransport) {
+		t.auth = auth
+	}
+}
+
+// WithKeysDir sets the directory the onion service keys are loaded from
+func WithKeysDir(dir string) Option {
+	return func(t *OnionTransport) {
+		t.keysDir = dir
+	}
+}
+
+// WithOnlyOnion restricts the transport to dialing onion addresses
+func WithOnlyOnion() Option {
+	return func(t *OnionTransport) {
+		t.onlyOnion = true
+	}
+}
+
+// WithControlAuth sets the method used to authenticate to the tor
+// control port. The default, AuthAuto, picks the best method tor
+// advertises.
+func WithControlAuth(method ControlAuth) Option {
+	return func(t *OnionTransport) {
+		t.controlAuth = method
+	}
+}
+
+// WithStreamIsolation sets how outbound connections are isolated onto
+// separate tor circuits. The default, IsolateNone, lets connections
+// share circuits for performance.
+func WithStreamIsolation(mode IsolationMode) Option {
+	return func(t *OnionTransport) {
+		t.isolation = mode
+	}
+}
+
+// WithDirectTCP makes the transport dial TCP addresses directly rather
+// than through tor, for faster connections to peers which do not need
+// to be reached anonymously. This reveals the local IP address to those
+// peers and to the network, and names in DNS multiaddrs are resolved
+// outside of tor. Onion addresses are always dialed through tor. By
+// default TCP addresses are dialed through tor, and with onlyOnion set
+// they are not dialed at all.
+func WithDirectTCP() Option {
+	return func(t *OnionTransport) {
+		t.directTCP = true
+	}
+}
+
+// WithSOCKSPort makes the transport dial through the SOCKS port at addr
+// on network, "tcp" or "unix", rather than the one tor reports on the
+// control port. This suits setups where the SOCKS port is reached
+// differently from the control port, for instance through a sidecar,
+// or where tor reports an address the application cannot reach. The
+// SOCKS port is then never rediscovered, not even after tor restarts.
+func WithSOCKSPort(network, addr string) Option {
+	return func(t *OnionTransport) {
+		t.socksNet, t.socksAddr = network, addr
+		t.socksFixed = true
+	}
+}
+
+// WithProxyDialer makes the transport dial through d instead of the tor
+// SOCKS port, for instance to chain through another proxy or to test
+// without tor. d is passed the target, which is "<service id>.onion:<port>"
+// for onion addresses. Stream isolation relies on SOCKS credentials
+// and does not apply to d.
+func WithProxyDialer(d proxy.Dialer) Option {
+	return func(t *OnionTransport) {
+		t.proxyDialer = d
+	}
+}
+
+// WithManagedTor makes the transport start its own tor from binaryPath,
+// keeping its state in dataDir. The control and SOCKS ports are picked
+// by tor and the control address passed to the constructor is ignored.
+// Construction returns once tor has fully bootstrapped, and tor exits
+// when the transport is closed.
+func WithManagedTor(binaryPath, dataDir string) Option {
+	return func(t *OnionTransport) {
+		t.managedTor = &managedTor{binaryPath: binaryPath, dataDir: dataDir}
+	}
+}
+
+// WithAllowedPorts restricts the virtual ports onion services may be
+// published on to ports, guarding against misconfiguration when running
+// several services. Listening on any other port fails before tor is
+// contacted. By default all ports are allowed.
+func WithAllowedPorts(ports ...uint16) Option {
+	return func(t *OnionTransport) {
+		if t.allowedPorts == nil {
+			t.allowedPorts = make(map[uint16]bool)
+		}
+		for _, port := range ports {
+			t.allowedPorts[port] = true
+		}
+	}
+}
+
+// WithVirtualPort publishes the onion service on the virtual port port
+// rather than the port passed to Listen, which instead selects the
+// local port tor forwards connections to, 0 picking a free one. This
+// makes the service reachable on a well-known port such as 80 whatever
+// port the application binds. The listener's multiaddr carries the
+// virtual port.
+func WithVirtualPort(port uint16) ListenOption {
+	return func(c *listenConfig) {
+		c.virtPort = port
+	}
+}
+
+// WithKeyCallback has fn called with the onion service id, without the
+// ".onion" suffix, and the key generated for an ephemeral listener once
+// the service is published, so that the key can be persisted with
+// SaveOnionKey and the address published again later. It has no effect
+// on listeners using a key from keysDir.
+func WithKeyCallback(fn func(serviceID string, key crypto.PrivateKey)) ListenOption {
+	return func(c *listenConfig) {
+		c.keyCallback = fn
+	}
+}
+
+// WithUnixSocket makes tor forward connections to a unix socket created
+// at path rather than to a loopback TCP port, so that no local TCP
+// listener is exposed. The port passed to Listen is the virtual port.
+func WithUnixSocket(path string) ListenOption {
+	return func(c *listenConfig) {
+		c.unixPath = path
+	}
+}
+
+// WithLocalTarget makes tor forward connections to addr, an IP address
+// and port of this host, rather than to a port on 127.0.0.1, for hosts
+// or containers where tor reaches the application on another local
+// interface. The local listener is bound to addr. A port of 0 keeps
+// the default choice of port: the one passed to Listen with
+// WithVirtualPort, otherwise a free one.
+func WithLocalTarget(addr string) ListenOption {
+	return func(c *listenConfig) {
+		c.localTarget = addr
+	}
+}
@@ -0,0 +1,98 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errPublishWaitUnsupported = errors.New("waiting for descriptor publication requires the control port address")
+
+// PublishError reports that some of the HSDirs tor uploaded the onion
+// service descriptor to rejected it. Listen with WithPublishWait fails
+// with it if all of them did. If any of them accepted the descriptor
+// the service is reachable, Listen succeeds and the listener's
+// PublishError returns it.
+type PublishError struct {
+	// ServiceID is the onion address without the ".onion" suffix
+	ServiceID string
+	// Uploaded and Failed count the HSDirs which accepted and rejected
+	// the descriptor
+	Uploaded, Failed int
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("onion service descriptor of %s accepted by %d of %d HSDirs", e.ServiceID, e.Uploaded, e.Uploaded+e.Failed)
+}
+
+// WithPublishWait makes Listen block until tor reports the outcome of
+// uploading the onion service descriptor to the HSDirs, so that the
+// service is reachable once Listen returns. If ctx is done first the
+// service is removed and Listen fails with the context error. If some
+// of the HSDirs rejected the descriptor the listener's PublishError
+// reports it.
+func WithPublishWait(ctx context.Context) ListenOption {
+	return func(c *listenConfig) {
+		c.publishCtx = ctx
+	}
+}
+
+// watchDescUploads subscribes to HS_DESC events. It has to be called
+// before the onion service is added so that no upload is missed.
+func (t *OnionTransport) watchDescUploads() (*eventWatcher, error) {
+	if t.controlAddr == "" {
+		return nil, errPublishWaitUnsupported
+	}
+	return t.watchEvents("HS_DESC")
+}
+
+// descriptorCount is the number of descriptors tor uploads for an onion
+// service: those of the current and next time periods for v3 services
+// and the two replicas for v2 services
+const descriptorCount = 2
+
+// waitDescUploads blocks until tor has started uploading every
+// descriptor of serviceID and each upload has either succeeded or
+// failed. The descriptors may be uploaded one after the other, so a
+// batch of uploads having reported is not enough.
+func (w *eventWatcher) waitDescUploads(ctx context.Context, serviceID string) error {
+	var pending, uploaded, failed int
+	descriptors := make(map[string]bool)
+	for pending != 0 || len(descriptors) < descriptorCount {
+		event, err := w.next(ctx)
+		if err != nil {
+			return err
+		}
+		// 650 HS_DESC <action> <address> <auth type> <hsdir> [<descriptor id>] ...
+		fields := strings.Fields(event)
+		if len(fields) < 5 || fields[0] != "HS_DESC" || fields[2] != serviceID {
+			continue
+		}
+		switch fields[1] {
+		case "UPLOAD":
+			if len(fields) < 6 {
+				continue
+			}
+			descriptors[fields[5]] = true
+			pending++
+		case "UPLOADED":
+			pending--
+			uploaded++
+		case "FAILED":
+			pending--
+			failed++
+		}
+	}
+	if failed != 0 {
+		return &PublishError{ServiceID: serviceID, Uploaded: uploaded, Failed: failed}
+	}
+	return nil
+}
+
+// PublishError returns the HSDirs which rejected the onion service
+// descriptor when the listener was created WithPublishWait, or nil if
+// all of them accepted it
+func (l *OnionListener) PublishError() *PublishError {
+	return l.publishErr
+}
@@ -0,0 +1,86 @@
+package torOnion
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+func TestPublishWait(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.HSDirs = 6
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := tpt.ListenEphemeralV3(4003, WithPublishWait(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perr := l.PublishError(); perr != nil {
+		t.Fatalf("unexpected publish error %+v", perr)
+	}
+	l.Close()
+
+	// some HSDirs reject the descriptor, the service is still reachable
+	fc.SetRejectingHSDirs(2)
+	l, err = tpt.ListenEphemeralV3(4003, WithPublishWait(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	perr := l.PublishError()
+	if perr == nil {
+		t.Fatal("partial publication not reported")
+	}
+	if perr.Uploaded != 4 || perr.Failed != 2 || perr.ServiceID != l.serviceID {
+		t.Fatalf("unexpected publish error %+v", perr)
+	}
+	if !fc.HasOnion(l.serviceID) {
+		t.Fatal("partially published service removed")
+	}
+	l.Close()
+
+	// all HSDirs reject it
+	fc.SetRejectingHSDirs(6)
+	if _, err := tpt.ListenEphemeralV3(4003, WithPublishWait(ctx)); err == nil {
+		t.Fatal("listened although no HSDir accepted the descriptor")
+	}
+	if n := len(tpt.listeners); n != 0 {
+		t.Fatalf("%d listeners left open", n)
+	}
+}
+
+func TestPublishWaitTimeout(t *testing.T) {
+	// tor never reports the upload
+	fc := testutil.NewControlServer(t)
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := tpt.ListenEphemeralV3(4003, WithPublishWait(ctx)); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	for _, cmd := range fc.Commands() {
+		if cmd == "DEL_ONION" {
+			return
+		}
+	}
+	t.Fatal("onion service not removed after the deadline")
+}
+
+func TestPublishWaitRequiresControlAddr(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	if _, err := tpt.ListenEphemeralV3(4003, WithPublishWait(context.Background())); err != errPublishWaitUnsupported {
+		t.Fatalf("expected errPublishWaitUnsupported, got %v", err)
+	}
+}
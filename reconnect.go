@@ -0,0 +1,210 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/yawning/bulb"
+)
+
+// Bounds of the delay between attempts to reconnect to the control port
+const (
+	reconnectBackoffMin = 250 * time.Millisecond
+	reconnectBackoffMax = 30 * time.Second
+)
+
+// conn returns the current control connection, nil for dial-only
+// transports
+func (t *OnionTransport) conn() *bulb.Conn {
+	t.controlMtx.Lock()
+	defer t.controlMtx.Unlock()
+	return t.controlConn
+}
+
+// dialControl opens and authenticates a new control connection
+func (t *OnionTransport) dialControl() (*bulb.Conn, error) {
+	return t.dialControlContext(context.Background())
+}
+
+// dialControlContext opens and authenticates a new control connection,
+// giving up with the context error once ctx is done
+func (t *OnionTransport) dialControlContext(ctx context.Context) (*bulb.Conn, error) {
+	method, pass, err := t.controlCredentials()
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, t.controlNet, controlDialAddr(t.controlNet, t.controlAddr))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	conn := bulb.NewConn(c)
+	t.log().Debug("connected to tor control port", "network", t.controlNet, "addr", t.controlAddr)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks authentication waiting for tor
+			c.Close()
+		case <-done:
+		}
+	}()
+	err = authenticate(conn, method, pass)
+	close(done)
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrControlAuthFailed, err)
+	}
+	return conn, nil
+}
+
+// controlDialAddr converts the forms of unix socket addresses accepted
+// for the control port to the one net.Dial understands: the "unix:"
+// prefix of torrc's ControlPort syntax is dropped and the leading NUL
+// byte of an abstract socket name is replaced with "@"
+func controlDialAddr(network, addr string) string {
+	if network != "unix" {
+		return addr
+	}
+	addr = strings.TrimPrefix(addr, "unix:")
+	if strings.HasPrefix(addr, "\x00") {
+		addr = "@" + addr[1:]
+	}
+	return addr
+}
+
+// request sends a command on the control connection. If the connection
+// has failed, as happens when tor restarts, the transport reconnects
+// and sends the command again.
+func (t *OnionTransport) request(format string, args ...interface{}) (*bulb.Response, error) {
+	conn := t.conn()
+	resp, err := conn.Request(format, args...)
+	if err == nil || !t.canReconnect() {
+		return resp, err
+	}
+	if _, ok := err.(*textproto.Error); ok {
+		// tor rejected the command, the connection is fine
+		return resp, err
+	}
+	if rerr := t.reconnect(conn); rerr != nil {
+		return nil, fmt.Errorf("%v, reconnecting failed: %v", err, rerr)
+	}
+	return t.conn().Request(format, args...)
+}
+
+// canReconnect reports whether the transport may replace its control
+// connection. A connection supplied by the caller is theirs to manage,
+// and a managed tor exits along with its control connection.
+func (t *OnionTransport) canReconnect() bool {
+	return t.controlAddr != "" && !t.borrowedConn && t.managedTor == nil && !t.isClosed()
+}
+
+// reconnect replaces the failed control connection unless another
+// caller has done so already. The onion services of open listeners and
+// client authorization keys are registered with tor again, and the SOCKS
+// port is rediscovered as it may have changed. While tor is unreachable
+// attempts are refused until the backoff delay has passed.
+func (t *OnionTransport) reconnect(failed *bulb.Conn) error {
+	t.reconnectMtx.Lock()
+	defer t.reconnectMtx.Unlock()
+	if t.conn() != failed {
+		return nil
+	}
+	if wait := time.Until(t.nextReconnect); wait > 0 {
+		return fmt.Errorf("tor control port unreachable, next attempt in %v", wait.Round(time.Millisecond))
+	}
+
+	conn, err := t.dialControl()
+	if err != nil {
+		if t.reconnectBackoff == 0 {
+			t.reconnectBackoff = reconnectBackoffMin
+		} else if t.reconnectBackoff *= 2; t.reconnectBackoff > reconnectBackoffMax {
+			t.reconnectBackoff = reconnectBackoffMax
+		}
+		t.nextReconnect = time.Now().Add(t.reconnectBackoff)
+		t.log().Warn("failed to reconnect to tor control port", "addr", t.controlAddr, "retry", t.reconnectBackoff, "err", err)
+		return err
+	}
+	t.reconnectBackoff = 0
+	t.nextReconnect = time.Time{}
+
+	t.controlMtx.Lock()
+	if t.isClosed() {
+		t.controlMtx.Unlock()
+		conn.Close()
+		return ErrTransportClosed
+	}
+	t.controlConn = conn
+	t.controlMtx.Unlock()
+	failed.Close()
+	t.log().Info("reconnected to tor control port", "addr", t.controlAddr)
+
+	// tor may have been upgraded while it was down
+	if v, err := queryTorVersion(conn); err != nil {
+		t.log().Warn("failed to query tor version", "err", err)
+	} else {
+		t.setTorVersion(v)
+	}
+
+	t.resetSOCKSEndpoint()
+
+	for serviceID, key := range t.clientAuthKeys() {
+		if _, err := conn.Request("%s", clientAuthCommand(serviceID, key)); err != nil {
+			t.log().Error("failed to register client authorization again", "id", serviceID, "err", err)
+		}
+	}
+	t.mtx.Lock()
+	var listeners []*OnionListener
+	for l := range t.listeners {
+		if l.serviceID != "" {
+			listeners = append(listeners, l)
+		}
+	}
+	t.mtx.Unlock()
+	for _, l := range listeners {
+		if err := republish(conn, l); err != nil {
+			t.log().Error("failed to publish onion service again", "addr", l.laddr, "err", err)
+		}
+	}
+	return nil
+}
+
+// republish registers the onion service of l on conn
+func republish(conn *bulb.Conn, l *OnionListener) error {
+	if l.key == nil {
+		return errKeyDiscarded
+	}
+	cmd, err := addOnionCommand(l.key, l.port, l.target, l.clients, l.flags)
+	if err != nil {
+		return err
+	}
+	resp, err := conn.Request("%s", cmd)
+	if e, ok := err.(*textproto.Error); ok && e.Code == 550 && l.flags.detach {
+		// a detached service outlives the control connection, tor
+		// still has it unless it restarted
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := parseAddOnionReply(resp, l.key)
+	if err != nil {
+		return err
+	}
+	if info.serviceID != l.serviceID {
+		return errors.New("onion service was published with a different service ID")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package torOnion
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestReconnect(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	fc := testutil.NewControlServer(t)
+	fc.SetSOCKSAddr(fs.Addr())
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	l, err := tpt.ListenEphemeral(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// tor restarts with a new SOCKS port
+	fs2 := testutil.NewSOCKSServer(t)
+	fs.Close()
+	fc.Restart(fs2.Addr())
+
+	conn, err = dialer.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial after tor restarted failed: %v", err)
+	}
+	conn.Close()
+	if fs2.LastTarget() != "erhkddypoy6qml6h.onion:4003" {
+		t.Fatal("dial did not use the new SOCKS port")
+	}
+	if !fc.HasOnion(l.serviceID) {
+		t.Fatal("onion service was not published again after reconnecting")
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	// tor goes away for good
+	fc.Close()
+	fc.Restart("")
+
+	if _, err := tpt.ListenEphemeral(4003); err == nil {
+		t.Fatal("listen succeeded without tor")
+	}
+	_, err = tpt.ListenEphemeral(4003)
+	if err == nil || !strings.Contains(err.Error(), "next attempt") {
+		t.Fatalf("expected the reconnect to back off, got %v", err)
+	}
+}
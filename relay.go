@@ -0,0 +1,82 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	tpt "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var errRelayNotOnion = errors.New("relay and target must be onion addresses")
+
+// RelayHandshake asks the relay at the other end of conn to forward the
+// connection to target, returning once the relay has done so. The
+// protocol is up to the application; whatever the handshake leaves
+// unread on conn is seen by the caller of Dial as the first data from
+// target. ctx's deadline, if any, also applies to conn.
+type RelayHandshake func(ctx context.Context, conn net.Conn, target ma.Multiaddr) error
+
+// RelayDialer dials onion services through an intermediate onion
+// service, the relay, which forwards each connection to its target.
+// This adds a hop of the application's own on top of tor's circuits,
+// for overlays that route through relays; tor knows nothing of it, so
+// the relay sees which targets are reached and all traffic unless the
+// application encrypts it end to end.
+type RelayDialer struct {
+	dialer    *OnionDialer
+	relay     ma.Multiaddr
+	handshake RelayHandshake
+}
+
+// RelayDialer returns a dialer reaching onion services through relay,
+// running handshake on each connection to it. Connections are dialed
+// like those of d, with its isolation and retries applying to the
+// relay.
+func (d *OnionDialer) RelayDialer(relay ma.Multiaddr, handshake RelayHandshake) (*RelayDialer, error) {
+	if !IsValidOnionMultiAddr(relay) {
+		return nil, errRelayNotOnion
+	}
+	return &RelayDialer{dialer: d, relay: relay, handshake: handshake}, nil
+}
+
+// Dial connects to raddr through the relay
+func (r *RelayDialer) Dial(raddr ma.Multiaddr) (tpt.Conn, error) {
+	return r.DialContext(context.Background(), raddr)
+}
+
+// DialContext connects to raddr through the relay. The returned
+// connection has raddr as its remote address and cannot be rotated.
+func (r *RelayDialer) DialContext(ctx context.Context, raddr ma.Multiaddr) (tpt.Conn, error) {
+	if !IsValidOnionMultiAddr(raddr) {
+		return nil, errRelayNotOnion
+	}
+	d := r.dialer
+	metrics := d.transport.getMetrics()
+	metrics.DialAttempt()
+	onionConn, err := d.dialRetrying(ctx, r.relay)
+	if err != nil {
+		d.dialFailed(ctx, metrics, r.relay, err)
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		onionConn.SetDeadline(deadline)
+	}
+	if err := r.handshake(ctx, onionConn, raddr); err != nil {
+		onionConn.Close()
+		err = fmt.Errorf("relay handshake with %s: %w", r.relay, err)
+		d.dialFailed(ctx, metrics, raddr, err)
+		return nil, err
+	}
+	onionConn.SetDeadline(time.Time{})
+	d.transport.log().Debug("connected through relay", "relay", r.relay, "addr", raddr)
+	// Rotate would reconnect to the relay without the handshake. The
+	// connection is only reported open, with raddr as its peer, once
+	// the handshake succeeded.
+	onionConn.raddr, onionConn.dialer = raddr, nil
+	d.established(onionConn, metrics)
+	return onionConn, nil
+}
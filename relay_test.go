@@ -0,0 +1,173 @@
+package torOnion
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// relayNetwork connects dials to fake onion services: relayAddr
+// forwards to the services it is asked for with a "CONNECT <target>"
+// line, any other service echoes
+type relayNetwork struct {
+	relayAddr string
+}
+
+func (n *relayNetwork) Dial(network, addr string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	if addr == n.relayAddr {
+		go n.relay(c2)
+	} else {
+		go func() {
+			io.Copy(c2, c2)
+			c2.Close()
+		}()
+	}
+	return c1, nil
+}
+
+func (n *relayNetwork) relay(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return
+	}
+	target := strings.TrimSpace(strings.TrimPrefix(line, "CONNECT "))
+	if target == n.relayAddr {
+		io.WriteString(conn, "REFUSED\n")
+		return
+	}
+	next, err := n.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer next.Close()
+	io.WriteString(conn, "OK\n")
+	go io.Copy(next, br)
+	io.Copy(conn, next)
+}
+
+// connectHandshake asks a relayNetwork relay for target
+func connectHandshake(ctx context.Context, conn net.Conn, target ma.Multiaddr) error {
+	addr, err := target.ValueForProtocol(ma.P_ONION)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, "CONNECT "+strings.Replace(addr, ":", ".onion:", 1)+"\n"); err != nil {
+		return err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if string(reply) != "OK\n" {
+		return errors.New("relay refused the connection")
+	}
+	return nil
+}
+
+func TestRelayDialer(t *testing.T) {
+	rn := &relayNetwork{relayAddr: "erhkddypoy6qml6h.onion:4004"}
+	tpt, err := NewSOCKSOnionTransport("tcp4", "", nil, true, WithProxyDialer(rn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	relay, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := ma.NewMultiaddr("/onion/timaq4ygg2iegci7:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpRelay, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.RelayDialer(tcpRelay, connectHandshake); err != errRelayNotOnion {
+		t.Fatalf("expected errRelayNotOnion for a TCP relay, got %v", err)
+	}
+	rd, err := dialer.RelayDialer(relay, connectHandshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := rd.Dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.RemoteMultiaddr().Equal(target) {
+		t.Fatalf("remote multiaddr %s, expected %s", conn.RemoteMultiaddr(), target)
+	}
+	// the target echoes through the relay
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("received %q", buf)
+	}
+
+	// a failed handshake fails the dial
+	if _, err := rd.Dial(relay); err == nil || !strings.Contains(err.Error(), "relay refused") {
+		t.Fatalf("expected the relay to refuse, got %v", err)
+	}
+}
+
+func TestRelayDialerConnState(t *testing.T) {
+	rn := &relayNetwork{relayAddr: "erhkddypoy6qml6h.onion:4004"}
+	var rec stateRecorder
+	tpt, err := NewSOCKSOnionTransport("tcp4", "", nil, true, WithProxyDialer(rn), WithConnStateHook(rec.hook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	relay, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := ma.NewMultiaddr("/onion/timaq4ygg2iegci7:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := dialer.RelayDialer(relay, connectHandshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// connections failing the handshake are never reported
+	if _, err := rd.Dial(relay); err == nil {
+		t.Fatal("the relay did not refuse")
+	}
+	rec.expect(t, ConnInfo{})
+
+	// the hook sees the target, not the relay
+	conn, err := rd.Dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConnInfo{RemoteAddr: target, Onion: true}
+	rec.expect(t, want, StateOpen)
+	conn.Close()
+	rec.expect(t, want, StateOpen, StateClosed)
+}
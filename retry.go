@@ -0,0 +1,85 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// retryableSOCKSReplies are the SOCKS reply codes, as worded by the
+// proxy package, which tor returns for failures that may go away once a
+// circuit is built. Other codes, such as "connection refused" from the
+// remote end, are final.
+var retryableSOCKSReplies = []string{
+	"general SOCKS server failure",
+	"network unreachable",
+	"host unreachable",
+	"TTL expired",
+}
+
+// retryableOnionErrors are the onion service failures, from tor's
+// extended SOCKS replies, which may go away on a later attempt
+var retryableOnionErrors = []error{
+	ErrOnionDescriptorNotFound,
+	ErrOnionIntroFailed,
+	ErrOnionRendezvousFailed,
+	ErrOnionIntroTimeout,
+}
+
+// WithDialRetries makes dials failing transiently, for instance while
+// tor is still building circuits, be retried up to retries times. The
+// first retry waits backoff, which doubles after each attempt. Retries
+// stop early when the dial context is done, the dial then failing with
+// the context error, or when its deadline would pass before the next
+// attempt, the dial then failing with the error of the last attempt.
+// Permanent failures are never retried.
+func WithDialRetries(retries int, backoff time.Duration) Option {
+	return func(t *OnionTransport) {
+		t.dialRetries = retries
+		t.dialBackoff = backoff
+	}
+}
+
+// isRetryableDialError reports whether err is a SOCKS failure worth
+// retrying
+func isRetryableDialError(err error) bool {
+	for _, retryable := range retryableOnionErrors {
+		if errors.Is(err, retryable) {
+			return true
+		}
+	}
+	msg := err.Error()
+	for _, reply := range retryableSOCKSReplies {
+		if strings.HasSuffix(msg, reply) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialRetrying dials raddr, retrying transient failures as configured
+// with WithDialRetries
+func (d *OnionDialer) dialRetrying(ctx context.Context, raddr ma.Multiaddr) (*OnionConn, error) {
+	backoff := d.transport.dialBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := d.dial(ctx, raddr)
+		if err == nil || attempt >= d.transport.dialRetries || !isRetryableDialError(err) {
+			return conn, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return nil, err
+		}
+		d.transport.log().Debug("retrying dial", "addr", raddr, "attempt", attempt+1, "backoff", backoff, "err", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
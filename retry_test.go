@@ -0,0 +1,135 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDialRetries(t *testing.T) {
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(fs *testutil.SOCKSServer, opts ...Option) error {
+		tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tpt.Close()
+		dialer, err := tpt.Dialer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := dialer.DialContext(ctx, addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// transient failures are retried
+	fs := testutil.NewSOCKSServer(t)
+	fs.FailFirst = 2
+	if err := dial(fs, WithDialRetries(3, 10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.Requests(); n != 3 {
+		t.Fatalf("dialed %d times, expected 3", n)
+	}
+
+	// without the option a failure is final
+	fs = testutil.NewSOCKSServer(t)
+	fs.FailFirst = 2
+	if err := dial(fs); err == nil {
+		t.Fatal("dial succeeded without retries")
+	}
+	if n := fs.Requests(); n != 1 {
+		t.Fatalf("dialed %d times, expected once", n)
+	}
+
+	// retries are bounded
+	fs = testutil.NewSOCKSServer(t)
+	fs.FailFirst = 5
+	if err := dial(fs, WithDialRetries(2, 10*time.Millisecond)); err == nil {
+		t.Fatal("dial succeeded after the retries were exhausted")
+	}
+	if n := fs.Requests(); n != 3 {
+		t.Fatalf("dialed %d times, expected 3", n)
+	}
+
+	// permanent failures are not retried, 0x05 is "connection refused"
+	fs = testutil.NewSOCKSServer(t)
+	fs.Reply = 5
+	if err := dial(fs, WithDialRetries(3, 10*time.Millisecond)); err == nil {
+		t.Fatal("dial succeeded with a refused connection")
+	}
+	if n := fs.Requests(); n != 1 {
+		t.Fatalf("dialed %d times, expected once", n)
+	}
+
+	// the context deadline cuts retries short
+	fs = testutil.NewSOCKSServer(t)
+	fs.FailFirst = 5
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, WithDialRetries(5, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := dialer.DialContext(ctx, addr); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if time.Since(start) > 400*time.Millisecond {
+		t.Fatal("dial waited for a retry past the deadline")
+	}
+}
+
+func TestDialRetriesCanceled(t *testing.T) {
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := testutil.NewSOCKSServer(t)
+	fs.FailFirst = 5
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, WithDialRetries(5, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dial is canceled while waiting to retry
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := dialer.DialContext(ctx, addr); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n := fs.Requests(); n != 1 {
+		t.Fatalf("dialed %d times, expected once", n)
+	}
+}
+
+func TestRetryableWrappedErrors(t *testing.T) {
+	if !isRetryableDialError(fmt.Errorf("dialing: %w", ErrOnionIntroFailed)) {
+		t.Fatal("wrapped retryable onion error not retried")
+	}
+	if isRetryableDialError(fmt.Errorf("dialing: %w", ErrOnionAddressInvalid)) {
+		t.Fatal("wrapped permanent onion error retried")
+	}
+}
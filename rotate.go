@@ -0,0 +1,91 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	errRotateNotTor      = errors.New("only connections dialed through tor can be rotated")
+	errRotateProxyDialer = errors.New("connections dialed through a proxy dialer cannot be rotated")
+	errRotateClosed      = errors.New("cannot rotate a closed connection")
+)
+
+// Rotate moves the connection onto a new tor circuit. Tor keeps a
+// stream on the circuit it was opened on, and NEWNYM would affect every
+// connection, so the connection is dialed again with a fresh isolation
+// token and the old stream is closed once the new one is established.
+// Subsequent reads and writes use the new stream. Data in flight on the
+// old stream is lost and the remote end sees a new connection, so this
+// only suits protocols which can resume on a new connection. Reads and
+// writes blocked on the old stream fail when it is closed. Inbound
+// connections, TCP connections dialed without tor and connections
+// dialed through WithProxyDialer, which ignores the isolation token,
+// cannot be rotated, nor can closed connections.
+func (c *OnionConn) Rotate(ctx context.Context) error {
+	if c.dialer == nil {
+		return errRotateNotTor
+	}
+	if c.dialer.transport.proxyDialer != nil {
+		return errRotateProxyDialer
+	}
+	c.connMtx.Lock()
+	closed := c.closed
+	c.connMtx.Unlock()
+	if closed {
+		return errRotateClosed
+	}
+	auth := isolatedAuth(c.dialer.auth, isolationToken(IsolateDial, c.raddr))
+	conn, _, err := c.dialer.dialSOCKS(ctx, auth, "tcp", c.target)
+	if err != nil {
+		return err
+	}
+	c.connMtx.Lock()
+	if c.closed {
+		c.connMtx.Unlock()
+		conn.Close()
+		return errRotateClosed
+	}
+	old := c.Conn
+	c.Conn, c.socksAuth = conn, auth
+	c.connMtx.Unlock()
+	old.Close()
+	c.dialer.transport.log().Debug("connection moved to a new circuit", "addr", c.raddr)
+	return nil
+}
+
+// stream returns the stream the connection currently uses, which
+// Rotate replaces
+func (c *OnionConn) stream() net.Conn {
+	c.connMtx.Lock()
+	defer c.connMtx.Unlock()
+	return c.Conn
+}
+
+// LocalAddr returns the local address of the current stream
+func (c *OnionConn) LocalAddr() net.Addr {
+	return c.stream().LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the current stream
+func (c *OnionConn) RemoteAddr() net.Addr {
+	return c.stream().RemoteAddr()
+}
+
+// SetDeadline sets the deadlines of the current stream. Rotate does
+// not carry deadlines over to the new stream.
+func (c *OnionConn) SetDeadline(t time.Time) error {
+	return c.stream().SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the current stream
+func (c *OnionConn) SetReadDeadline(t time.Time) error {
+	return c.stream().SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the current stream
+func (c *OnionConn) SetWriteDeadline(t time.Time) error {
+	return c.stream().SetWriteDeadline(t)
+}
@@ -0,0 +1,169 @@
+package torOnion
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestRotate(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, WithStreamIsolation(IsolateDestination))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	oc := conn.(*OnionConn)
+
+	tokens := map[string]bool{oc.socksAuth.User: true}
+	for i := 0; i < 2; i++ {
+		if err := oc.Rotate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if tokens[oc.socksAuth.User] {
+			t.Fatalf("rotation %d kept the isolation token %s", i, oc.socksAuth.User)
+		}
+		tokens[oc.socksAuth.User] = true
+		// the proxy echoes everything written on the new stream
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fs.Requests(); n != 3 {
+		t.Fatalf("expected 3 SOCKS requests, got %d", n)
+	}
+	if target := fs.LastTarget(); target != "erhkddypoy6qml6h.onion:4003" {
+		t.Fatalf("rotated connection dialed %q", target)
+	}
+}
+
+func TestRotateInbound(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	l, err := tpt.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client := dialListener(t, l)
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.(*OnionConn).Rotate(context.Background()); err != errRotateNotTor {
+		t.Fatalf("expected errRotateNotTor, got %v", err)
+	}
+}
+
+func TestRotateClosed(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := conn.(*OnionConn).Rotate(context.Background()); err != errRotateClosed {
+		t.Fatalf("expected errRotateClosed, got %v", err)
+	}
+	if n := fs.Requests(); n != 1 {
+		t.Fatalf("rotating a closed connection dialed again, %d SOCKS requests", n)
+	}
+}
+
+func TestRotateProxyDialer(t *testing.T) {
+	rd := &recordingDialer{}
+	tpt, err := NewSOCKSOnionTransport("tcp4", "", nil, true, WithProxyDialer(rd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.(*OnionConn).Rotate(context.Background()); err != errRotateProxyDialer {
+		t.Fatalf("expected errRotateProxyDialer, got %v", err)
+	}
+	rd.mtx.Lock()
+	defer rd.mtx.Unlock()
+	if len(rd.targets) != 1 {
+		t.Fatalf("rotation dialed through the proxy dialer: %q", rd.targets)
+	}
+}
+
+func TestRotateConcurrentClose(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true, WithKeepAlive(time.Millisecond, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oc := conn.(*OnionConn)
+	// run under -race: the keep-alive timer writes while Rotate swaps
+	// the stream and Close races both
+	done := make(chan error)
+	go func() { done <- oc.Rotate(context.Background()) }()
+	conn.Close()
+	if err := <-done; err != nil && err != errRotateClosed {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err == nil {
+		t.Fatal("write on a closed, rotated connection succeeded")
+	}
+}
@@ -0,0 +1,88 @@
+package torOnion
+
+import (
+	"context"
+	"fmt"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultSelfTestTarget is the onion service SelfTest dials unless
+// WithSelfTestTarget says otherwise, the Tor Project's website
+const DefaultSelfTestTarget = "/onion3/2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid:80"
+
+// SelfTestStage is a check made by SelfTest
+type SelfTestStage string
+
+const (
+	// StageControl checks that the control connection answers
+	StageControl SelfTestStage = "control"
+	// StageBootstrap checks that tor has fully bootstrapped
+	StageBootstrap SelfTestStage = "bootstrap"
+	// StageDial checks that an onion service can be dialed
+	StageDial SelfTestStage = "dial"
+)
+
+// SelfTestError is returned by SelfTest, telling the stage which failed
+type SelfTestError struct {
+	Stage SelfTestStage
+	Err   error
+}
+
+func (e *SelfTestError) Error() string {
+	return fmt.Sprintf("tor self-test failed at the %s stage: %v", e.Stage, e.Err)
+}
+
+func (e *SelfTestError) Unwrap() error {
+	return e.Err
+}
+
+// WithSelfTestTarget sets the onion service SelfTest dials to check
+// that tor can reach onion services. A nil addr makes SelfTest skip the
+// dial, leaving it free of network traffic beyond the control port.
+func WithSelfTestTarget(addr ma.Multiaddr) Option {
+	return func(t *OnionTransport) {
+		t.selfTestTarget = addr
+		t.selfTestTargetSet = true
+	}
+}
+
+// SelfTest checks that tor is working, for instance at startup: the
+// control connection must answer, tor must have fully bootstrapped and
+// a connection to the self-test target, DefaultSelfTestTarget by
+// default, must succeed. It does not wait for tor; use WaitBootstrap
+// first if it may still be starting. The first failing check is
+// returned as a *SelfTestError.
+func (t *OnionTransport) SelfTest(ctx context.Context) error {
+	if t.conn() == nil {
+		return &SelfTestError{StageControl, errControlRequired}
+	}
+	if _, err := t.request("GETINFO version"); err != nil {
+		return &SelfTestError{StageControl, err}
+	}
+	progress, _, err := t.bootstrapStatus()
+	if err != nil {
+		return &SelfTestError{StageBootstrap, err}
+	}
+	if progress != 100 {
+		return &SelfTestError{StageBootstrap, fmt.Errorf("tor has only bootstrapped %d%%", progress)}
+	}
+
+	target := t.selfTestTarget
+	if !t.selfTestTargetSet {
+		if target, err = ma.NewMultiaddr(DefaultSelfTestTarget); err != nil {
+			return &SelfTestError{StageDial, err}
+		}
+	}
+	if target == nil {
+		return nil
+	}
+	dialer := &OnionDialer{auth: t.auth, transport: t}
+	conn, err := dialer.DialContext(ctx, target)
+	if err != nil {
+		return &SelfTestError{StageDial, err}
+	}
+	conn.Close()
+	t.log().Debug("self-test passed", "target", target)
+	return nil
+}
@@ -0,0 +1,90 @@
+package torOnion
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// selfTestStage returns the stage at which SelfTest failed with err
+func selfTestStage(t *testing.T, err error) SelfTestStage {
+	t.Helper()
+	var stErr *SelfTestError
+	if !errors.As(err, &stErr) {
+		t.Fatalf("expected a SelfTestError, got %v", err)
+	}
+	return stErr.Stage
+}
+
+func TestSelfTest(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fs := testutil.NewSOCKSServer(t)
+	fc.SetSOCKSAddr(fs.Addr())
+	tpt := newControlTransport(t, fc)
+	target, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	WithSelfTestTarget(target)(tpt)
+
+	if err := tpt.SelfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.LastTarget(); got != "erhkddypoy6qml6h.onion:4003" {
+		t.Fatalf("self-test dialed %q", got)
+	}
+
+	fc.SetBootstrap(80)
+	if stage := selfTestStage(t, tpt.SelfTest(context.Background())); stage != StageBootstrap {
+		t.Fatalf("expected the bootstrap stage to fail, got %s", stage)
+	}
+	fc.SetBootstrap(100)
+
+	// tor's SOCKS port moved somewhere nothing listens
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	fc.Restart(closed)
+	if stage := selfTestStage(t, tpt.SelfTest(context.Background())); stage != StageControl {
+		t.Fatalf("expected the control stage to fail after tor restarted, got %s", stage)
+	}
+
+	reconnected := newControlTransport(t, fc)
+	WithSelfTestTarget(target)(reconnected)
+	if stage := selfTestStage(t, reconnected.SelfTest(context.Background())); stage != StageDial {
+		t.Fatalf("expected the dial stage to fail, got %s", stage)
+	}
+	WithSelfTestTarget(nil)(reconnected)
+	if err := reconnected.SelfTest(context.Background()); err != nil {
+		t.Fatalf("self-test without a target failed: %v", err)
+	}
+}
+
+func TestSelfTestWithoutControl(t *testing.T) {
+	tpt, err := NewSOCKSOnionTransport("tcp4", "127.0.0.1:9050", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	err = tpt.SelfTest(context.Background())
+	if stage := selfTestStage(t, err); stage != StageControl || !errors.Is(err, errControlRequired) {
+		t.Fatalf("expected errControlRequired at the control stage, got %v", err)
+	}
+}
+
+func TestDefaultSelfTestTarget(t *testing.T) {
+	addr, err := ma.NewMultiaddr(DefaultSelfTestTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsValidOnionMultiAddr(addr) {
+		t.Fatalf("%s is not a valid onion address", addr)
+	}
+}
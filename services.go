@@ -0,0 +1,69 @@
+package torOnion
+
+import (
+	"sort"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// OnionServiceInfo describes an onion service published by the transport
+type OnionServiceInfo struct {
+	// ServiceID is the onion address without the .onion suffix
+	ServiceID string
+	// Addr is the multiaddr the service is reachable at
+	Addr ma.Multiaddr
+	// VirtPort is the port the service is published on
+	VirtPort uint16
+	// Ephemeral is set for services using a key generated when
+	// listening, whose address is lost unless the key is persisted
+	Ephemeral bool
+	// AuthorizedClients is the number of clients allowed to connect to
+	// a private service, 0 for a public one
+	AuthorizedClients int
+	// Published reports whether tor currently lists the service, which
+	// is not the case while the transport reconnects to a restarted tor
+	Published bool
+}
+
+// ActiveOnions returns the onion services of the transport's open
+// listeners ordered by service ID and port, checking each against the
+// services tor reports for the control connection
+func (t *OnionTransport) ActiveOnions() ([]OnionServiceInfo, error) {
+	if t.conn() == nil {
+		return nil, errControlRequired
+	}
+	lines, err := t.getInfoLines("onions/current")
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]bool, len(lines))
+	for _, id := range lines {
+		current[id] = true
+	}
+
+	t.mtx.Lock()
+	onions := make([]OnionServiceInfo, 0, len(t.listeners))
+	for l := range t.listeners {
+		if l.serviceID == "" {
+			// TCP listener
+			continue
+		}
+		onions = append(onions, OnionServiceInfo{
+			ServiceID:         l.serviceID,
+			Addr:              l.laddr,
+			VirtPort:          l.port,
+			Ephemeral:         l.ephemeral,
+			AuthorizedClients: len(l.clients),
+			Published:         current[l.serviceID],
+		})
+	}
+	t.mtx.Unlock()
+
+	sort.Slice(onions, func(i, j int) bool {
+		if onions[i].ServiceID != onions[j].ServiceID {
+			return onions[i].ServiceID < onions[j].ServiceID
+		}
+		return onions[i].VirtPort < onions[j].VirtPort
+	})
+	return onions, nil
+}
@@ -0,0 +1,86 @@
+package torOnion
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/yawning/bulb/utils/pkcs1"
+)
+
+func TestActiveOnions(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := pkcs1.OnionAddr(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := testutil.NewControlServer(t)
+	tpt := newControlTransport(t, fc)
+	tpt.setKeys(map[string]crypto.PrivateKey{id: key})
+
+	addr, err := ma.NewMultiaddr("/onion/" + id + ":4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	persistent, err := tpt.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer persistent.Close()
+	ephemeral, err := tpt.ListenEphemeralV3(80, WithAuthorizedClients([32]byte{1}, [32]byte{2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ephemeral.Close()
+
+	onions, err := tpt.ActiveOnions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onions) != 2 {
+		t.Fatalf("expected 2 onion services, got %d", len(onions))
+	}
+	for _, info := range onions {
+		if !info.Published {
+			t.Fatalf("onion service %s is not published", info.ServiceID)
+		}
+		switch info.ServiceID {
+		case id:
+			if info.VirtPort != 4003 || info.Ephemeral || info.AuthorizedClients != 0 || !info.Addr.Equal(addr) {
+				t.Fatalf("unexpected info for the persistent service: %+v", info)
+			}
+		case ephemeral.serviceID:
+			if info.VirtPort != 80 || !info.Ephemeral || info.AuthorizedClients != 2 || !info.Addr.Equal(ephemeral.Multiaddr()) {
+				t.Fatalf("unexpected info for the ephemeral service: %+v", info)
+			}
+		default:
+			t.Fatalf("unexpected onion service %s", info.ServiceID)
+		}
+	}
+
+	// closed listeners are no longer listed
+	ephemeral.Close()
+	onions, err = tpt.ActiveOnions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onions) != 1 || onions[0].ServiceID != id {
+		t.Fatalf("unexpected onion services after close: %+v", onions)
+	}
+
+	// dial-only transports publish nothing
+	dialOnly, err := NewSOCKSOnionTransport("tcp4", "127.0.0.1:9050", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialOnly.Close()
+	if _, err := dialOnly.ActiveOnions(); err != errControlRequired {
+		t.Fatalf("expected errControlRequired, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package torOnion
+
+import "context"
+
+// Shutdown gracefully shuts down the transport. It stops accepting
+// connections on all listeners and waits for the connections already
+// accepted to be closed before removing the onion services and closing
+// the transport like Close. If ctx is done first the remaining accepted
+// connections are closed and the context error is returned. Listening
+// fails once Shutdown has been called, and calling it again or after
+// Close has no effect.
+func (t *OnionTransport) Shutdown(ctx context.Context) error {
+	t.mtx.Lock()
+	if t.closed || t.draining {
+		t.mtx.Unlock()
+		return nil
+	}
+	t.draining = true
+	listeners := make([]*OnionListener, 0, len(t.listeners))
+	for l := range t.listeners {
+		listeners = append(listeners, l)
+	}
+	t.mtx.Unlock()
+
+	for _, l := range listeners {
+		l.stopAccepting()
+	}
+	t.log().Info("shutting down, draining connections", "listeners", len(listeners))
+	err := t.drain(ctx)
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// drain waits for the tracked connections to be closed, closing them
+// if ctx is done first
+func (t *OnionTransport) drain(ctx context.Context) error {
+	t.mtx.Lock()
+	if len(t.conns) == 0 {
+		t.mtx.Unlock()
+		return nil
+	}
+	drained := make(chan struct{})
+	t.drained = drained
+	t.mtx.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+	t.mtx.Lock()
+	conns := make([]*OnionConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mtx.Unlock()
+	t.log().Warn("shutdown deadline reached, closing connections", "conns", len(conns))
+	for _, c := range conns {
+		c.Close()
+	}
+	return ctx.Err()
+}
+
+// trackConn records a connection accepted by a listener
+func (t *OnionTransport) trackConn(c *OnionConn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[*OnionConn]struct{})
+	}
+	t.conns[c] = struct{}{}
+}
+
+// untrackConn forgets a closed connection, notifying a draining
+// Shutdown once no connection is left
+func (t *OnionTransport) untrackConn(c *OnionConn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.conns, c)
+	if len(t.conns) == 0 && t.drained != nil {
+		close(t.drained)
+		t.drained = nil
+	}
+}
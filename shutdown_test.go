@@ -0,0 +1,97 @@
+package torOnion
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+func TestShutdownDrainsConns(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	l, err := transport.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := l.listener.Addr().String()
+	dialListener(t, l)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- transport.Shutdown(ctx)
+	}()
+
+	// while draining no connections are accepted but the service stays
+	// published for the open one
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned with an open connection: %v", err)
+	default:
+	}
+	if c, err := net.Dial("tcp4", local); err == nil {
+		c.Close()
+		t.Fatal("listener still accepting while draining")
+	}
+	if !fc.HasOnion(l.serviceID) {
+		t.Fatal("onion service removed before the connection was closed")
+	}
+	if _, err := transport.ListenEphemeralV3(4004); err == nil {
+		t.Fatal("listened while shutting down")
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return once the connection was closed")
+	}
+	if fc.HasOnion(l.serviceID) {
+		t.Fatal("onion service not removed by Shutdown")
+	}
+	if !transport.isClosed() {
+		t.Fatal("transport not closed by Shutdown")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	l, err := transport.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dialListener(t, l)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := transport.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	// the remaining connection was closed
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if fc.HasOnion(l.serviceID) {
+		t.Fatal("onion service not removed by Shutdown")
+	}
+}
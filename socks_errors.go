@@ -0,0 +1,82 @@
+package torOnion
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Errors for the extended SOCKS replies tor sends when dialing an onion
+// service fails, with the SocksPort ExtendedErrors flag. Failures to
+// find or reach the service's introduction and rendezvous points may
+// go away on a later attempt, unlike invalid descriptors and addresses.
+// ErrClientAuthRequired and ErrClientAuthRejected cover the replies for
+// client authorization failures.
+var (
+	// ErrOnionDescriptorNotFound is returned when tor cannot find the
+	// onion service's descriptor, for instance because the service is
+	// offline
+	ErrOnionDescriptorNotFound = errors.New("onion service descriptor not found")
+	// ErrOnionDescriptorInvalid is returned when the onion service's
+	// descriptor cannot be parsed or its signature is invalid
+	ErrOnionDescriptorInvalid = errors.New("onion service descriptor is invalid")
+	// ErrOnionIntroFailed is returned when every introduction point of
+	// the onion service failed
+	ErrOnionIntroFailed = errors.New("onion service introduction failed")
+	// ErrOnionRendezvousFailed is returned when the rendezvous with the
+	// onion service failed
+	ErrOnionRendezvousFailed = errors.New("onion service rendezvous failed")
+	// ErrOnionAddressInvalid is returned when tor rejects the onion
+	// address, for instance because its checksum is wrong
+	ErrOnionAddressInvalid = errors.New("invalid onion service address")
+	// ErrOnionIntroTimeout is returned when the introduction to the
+	// onion service timed out
+	ErrOnionIntroTimeout = errors.New("onion service introduction timed out")
+)
+
+// Extended SOCKS reply codes tor uses for onion service failures, the
+// client authorization codes 0xF4 and 0xF5 being in client_auth.go
+const (
+	socksOnionDescNotFound   = 0xF0
+	socksOnionDescInvalid    = 0xF1
+	socksOnionIntroFailed    = 0xF2
+	socksOnionRendFailed     = 0xF3
+	socksOnionAddressInvalid = 0xF6
+	socksOnionIntroTimeout   = 0xF7
+)
+
+// socksReplyErrors maps extended SOCKS reply codes to their errors
+var socksReplyErrors = map[int]error{
+	socksOnionDescNotFound:   ErrOnionDescriptorNotFound,
+	socksOnionDescInvalid:    ErrOnionDescriptorInvalid,
+	socksOnionIntroFailed:    ErrOnionIntroFailed,
+	socksOnionRendFailed:     ErrOnionRendezvousFailed,
+	socksClientAuthMissing:   ErrClientAuthRequired,
+	socksClientAuthBad:       ErrClientAuthRejected,
+	socksOnionAddressInvalid: ErrOnionAddressInvalid,
+	socksOnionIntroTimeout:   ErrOnionIntroTimeout,
+}
+
+// socksReplyError maps the SOCKS error of a failed onion dial carrying
+// one of tor's extended reply codes to the error for the code,
+// returning any other error unchanged. The proxy dialer does not expose
+// the reply code so it is read from the error text, which ends in
+// "unknown code: <code>" for codes it does not know.
+func socksReplyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	i := strings.LastIndex(msg, "unknown code: ")
+	if i < 0 {
+		return err
+	}
+	code, cerr := strconv.Atoi(msg[i+len("unknown code: "):])
+	if cerr != nil {
+		return err
+	}
+	if mapped, ok := socksReplyErrors[code]; ok {
+		return mapped
+	}
+	return err
+}
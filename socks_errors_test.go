@@ -0,0 +1,71 @@
+package torOnion
+
+import (
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestSOCKSReplyErrors(t *testing.T) {
+	addr, err := ma.NewMultiaddr("/onion3/vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		reply     byte
+		err       error
+		retryable bool
+	}{
+		{0xF0, ErrOnionDescriptorNotFound, true},
+		{0xF1, ErrOnionDescriptorInvalid, false},
+		{0xF2, ErrOnionIntroFailed, true},
+		{0xF3, ErrOnionRendezvousFailed, true},
+		{0xF4, ErrClientAuthRequired, false},
+		{0xF5, ErrClientAuthRejected, false},
+		{0xF6, ErrOnionAddressInvalid, false},
+		{0xF7, ErrOnionIntroTimeout, true},
+	} {
+		fs := testutil.NewSOCKSServer(t)
+		fs.Reply = tc.reply
+		tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialer, err := tpt.Dialer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dialer.Dial(addr)
+		if err != tc.err {
+			t.Errorf("SOCKS reply %#x: expected %v, got %v", tc.reply, tc.err, err)
+		} else if isRetryableDialError(err) != tc.retryable {
+			t.Errorf("SOCKS reply %#x: retryable is %t", tc.reply, !tc.retryable)
+		}
+		tpt.Close()
+	}
+
+	// standard replies and unknown codes are left alone
+	for _, reply := range []byte{5, 0xF8} {
+		fs := testutil.NewSOCKSServer(t)
+		fs.Reply = reply
+		tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialer, err := tpt.Dialer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dialer.Dial(addr)
+		for _, mapped := range socksReplyErrors {
+			if err == mapped {
+				t.Errorf("SOCKS reply %#x mapped to %v", reply, err)
+			}
+		}
+		if err == nil {
+			t.Errorf("SOCKS reply %#x: dial succeeded", reply)
+		}
+		tpt.Close()
+	}
+}
@@ -0,0 +1,451 @@
+package torOnion
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	"golang.org/x/net/proxy"
+)
+
+func TestSOCKSOnlyTransport(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	if _, err := tpt.ListenEphemeral(4003); err != ErrListenRequiresControl {
+		t.Fatalf("expected listen to require the control port, got %v", err)
+	}
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := fs.LastTarget(); target != "erhkddypoy6qml6h.onion:4003" {
+		t.Fatalf("dialed wrong target %q", target)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q", buf)
+	}
+}
+
+func TestDialSOCKSAddressFamilies(t *testing.T) {
+	for _, tc := range []struct {
+		network string
+		socks   func(testing.TB) *testutil.SOCKSServer
+	}{
+		{"tcp4", testutil.NewSOCKSServer},
+		{"tcp6", testutil.NewSOCKSServer6},
+	} {
+		t.Run(tc.network, func(t *testing.T) {
+			fs := tc.socks(t)
+			// the SOCKS port is discovered as plain "tcp" so the
+			// family must follow from the listener address
+			fc := testutil.NewControlServer(t)
+			fc.SetSOCKSAddr(fs.Addr())
+			tpt := newControlTransport(t, fc)
+
+			dialer, err := tpt.Dialer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range []string{
+				"/onion/erhkddypoy6qml6h:4003",
+				"/ip6/2001:db8::1/tcp/4001",
+			} {
+				addr, err := ma.NewMultiaddr(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn, err := dialer.Dial(addr)
+				if err != nil {
+					t.Fatalf("dialing %s: %v", s, err)
+				}
+				conn.Close()
+			}
+			if target := fs.LastTarget(); target != "[2001:db8::1]:4001" {
+				t.Fatalf("dialed wrong target %q", target)
+			}
+		})
+	}
+}
+
+func TestDialHostnameResolvedByTor(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr   string
+		target string
+	}{
+		// names reach the SOCKS layer unresolved
+		{"/dns4/unresolvable.invalid/tcp/4001", "unresolvable.invalid:4001"},
+		{"/dns6/unresolvable.invalid/tcp/4002", "unresolvable.invalid:4002"},
+		{"/ip4/192.0.2.1/tcp/4003", "192.0.2.1:4003"},
+	} {
+		addr, err := ma.NewMultiaddr(tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tpt.CanDial(addr) {
+			t.Fatalf("cannot dial %s", tc.addr)
+		}
+		conn, err := dialer.Dial(addr)
+		if err != nil {
+			t.Fatalf("dialing %s: %v", tc.addr, err)
+		}
+		conn.Close()
+		if target := fs.LastTarget(); target != tc.target {
+			t.Fatalf("dialing %s requested %q from the SOCKS proxy", tc.addr, target)
+		}
+	}
+}
+
+func TestDirectTCP(t *testing.T) {
+	// an echo server standing in for a clearnet peer
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	tcp, err := manet.FromNetAddr(ln.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, direct := range []bool{false, true} {
+		fs := testutil.NewSOCKSServer(t)
+		var opts []Option
+		if direct {
+			opts = append(opts, WithDirectTCP())
+		}
+		tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, false, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tpt.Close()
+		dialer, err := tpt.Dialer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.Dial(tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if n := fs.Requests(); direct && n != 0 || !direct && n != 1 {
+			t.Fatalf("direct %v: %d SOCKS requests for a TCP address", direct, n)
+		}
+
+		// onion addresses always go through tor
+		conn, err = dialer.Dial(onion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if target := fs.LastTarget(); target != "erhkddypoy6qml6h.onion:4003" {
+			t.Fatalf("direct %v: onion address not dialed through tor, last target %q", direct, target)
+		}
+	}
+}
+
+// recordingDialer hands out one end of a pipe for every dial and
+// records the targets
+type recordingDialer struct {
+	mtx     sync.Mutex
+	targets []string
+}
+
+func (d *recordingDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mtx.Lock()
+	d.targets = append(d.targets, network+" "+addr)
+	d.mtx.Unlock()
+	c1, c2 := net.Pipe()
+	go func() {
+		io.Copy(c2, c2)
+		c2.Close()
+	}()
+	return c1, nil
+}
+
+func TestProxyDialer(t *testing.T) {
+	rd := &recordingDialer{}
+	// no tor is running, the injected dialer replaces the SOCKS port
+	tpt, err := NewSOCKSOnionTransport("tcp4", "", nil, true, WithProxyDialer(rd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	rd.mtx.Lock()
+	defer rd.mtx.Unlock()
+	if len(rd.targets) != 1 || rd.targets[0] != "tcp erhkddypoy6qml6h.onion:4003" {
+		t.Fatalf("unexpected dials %q", rd.targets)
+	}
+	if d, err := tpt.TorDialer(); err != nil || d != proxy.Dialer(rd) {
+		t.Fatalf("TorDialer did not return the injected dialer: %v", err)
+	}
+}
+
+func TestDialerCached(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	fc := testutil.NewControlServer(t)
+	fc.SetSOCKSAddr(fs.Addr())
+	tpt := newControlTransport(t, fc)
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		conn, err := dialer.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if n := fc.RequestCount("GETINFO net/listeners/socks"); n != 1 {
+		t.Fatalf("SOCKS listener was queried %d times, expected once", n)
+	}
+
+	// isolated dials use their own credentials but the same SOCKS port
+	tpt.isolation = IsolateDial
+	for i := 0; i < 2; i++ {
+		conn, err := dialer.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if n := fc.RequestCount("GETINFO net/listeners/socks"); n != 1 {
+		t.Fatalf("SOCKS listener was queried %d times, expected once", n)
+	}
+}
+
+func TestDialContextCancelAbortsSOCKS(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	fs.Stall = true
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := dialer.DialContext(ctx, addr); err == nil {
+		t.Fatal("dial succeeded through a stalled proxy")
+	}
+	if fs.LastTarget() == "" {
+		t.Fatal("dial was cancelled before reaching the proxy")
+	}
+
+	// the proxy connection must be torn down, not left to finish
+	// the handshake in the background
+	deadline := time.Now().Add(time.Second)
+	for fs.ActiveConns() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("SOCKS connection still open after the dial was cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialerDiscoversSOCKSPort(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	fc := testutil.NewControlServer(t)
+	fc.SetSOCKSAddr(fs.Addr())
+	tpt := newControlTransport(t, fc)
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if target := fs.LastTarget(); target != "erhkddypoy6qml6h.onion:4003" {
+		t.Fatalf("dial did not go through the discovered SOCKS port, got target %q", target)
+	}
+
+	// with no SOCKS listener configured dialing fails instead of
+	// falling back to a default port
+	fc2 := testutil.NewControlServer(t)
+	tpt2 := newControlTransport(t, fc2)
+	dialer, err = tpt2.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial(addr); err == nil {
+		t.Fatal("dial succeeded without a SOCKS listener")
+	}
+}
+
+func TestSOCKSPortOverride(t *testing.T) {
+	advertised := testutil.NewSOCKSServer(t)
+	sidecar := testutil.NewSOCKSServer(t)
+	fc := testutil.NewControlServer(t)
+	fc.SetSOCKSAddr(advertised.Addr())
+	tpt, err := NewTransport("tcp4", fc.Addr(), WithSOCKSPort("tcp4", sidecar.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if sidecar.Requests() != 1 || advertised.Requests() != 0 {
+		t.Fatalf("dialed through the advertised SOCKS port %d times and the override %d times", advertised.Requests(), sidecar.Requests())
+	}
+
+	// the override survives tor restarting
+	fc.Restart(advertised.Addr())
+	if _, err := tpt.GetInfo("version"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err = dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if sidecar.Requests() != 2 || advertised.Requests() != 0 {
+		t.Fatal("SOCKS port rediscovered after reconnecting")
+	}
+}
+
+func TestSOCKSAuthentication(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	fs.User, fs.Password = "alice", "secret"
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		auth *proxy.Auth
+		ok   bool
+	}{
+		{&proxy.Auth{User: "alice", Password: "secret"}, true},
+		{&proxy.Auth{User: "alice", Password: "wrong"}, false},
+		{nil, false},
+	} {
+		tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), tc.auth, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialer, err := tpt.Dialer(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.Dial(addr)
+		if tc.ok != (err == nil) {
+			t.Fatalf("dial with credentials %+v: %v", tc.auth, err)
+		}
+		if err == nil {
+			conn.Close()
+		}
+		tpt.Close()
+	}
+}
@@ -0,0 +1,35 @@
+package torOnion
+
+import "sync/atomic"
+
+// BytesRead returns the number of bytes read from the connection
+func (c *OnionConn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.bytesRead)
+}
+
+// BytesWritten returns the number of bytes written to the connection
+func (c *OnionConn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&c.bytesWritten)
+}
+
+// countRead records n bytes read from c
+func (c *OnionConn) countRead(n int) {
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	if t, ok := c.transport.(*OnionTransport); ok {
+		atomic.AddUint64(&t.bytesRead, uint64(n))
+	}
+}
+
+// countWritten records n bytes written to c
+func (c *OnionConn) countWritten(n int) {
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	if t, ok := c.transport.(*OnionTransport); ok {
+		atomic.AddUint64(&t.bytesWritten, uint64(n))
+	}
+}
+
+// Traffic returns the number of bytes read from and written to all
+// connections dialed or accepted by the transport since it was created
+func (t *OnionTransport) Traffic() (read, written uint64) {
+	return atomic.LoadUint64(&t.bytesRead), atomic.LoadUint64(&t.bytesWritten)
+}
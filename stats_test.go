@@ -0,0 +1,81 @@
+package torOnion
+
+import (
+	"io"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestConnTraffic(t *testing.T) {
+	fs := testutil.NewSOCKSServer(t)
+	tpt, err := NewSOCKSOnionTransport("tcp4", fs.Addr(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	addr, err := ma.NewMultiaddr("/onion/erhkddypoy6qml6h:4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := tpt.Dialer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the proxy echoes everything written
+	for _, size := range []int{10, 5} {
+		conn, err := dialer.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		oc := conn.(*OnionConn)
+		if oc.BytesRead() != uint64(size) || oc.BytesWritten() != uint64(size) {
+			t.Fatalf("counted %d bytes read and %d written, expected %d", oc.BytesRead(), oc.BytesWritten(), size)
+		}
+		conn.Close()
+	}
+	if read, written := tpt.Traffic(); read != 15 || written != 15 {
+		t.Fatalf("transport counted %d bytes read and %d written, expected 15", read, written)
+	}
+}
+
+func TestAcceptedConnTraffic(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	transport := newControlTransport(t, fc)
+	l, err := transport.ListenEphemeralV3(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := dialListener(t, l)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := client.Write(make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	oc := conn.(*OnionConn)
+	if oc.BytesRead() != 7 || oc.BytesWritten() != 3 {
+		t.Fatalf("counted %d bytes read and %d written, expected 7 and 3", oc.BytesRead(), oc.BytesWritten())
+	}
+	if read, written := transport.Traffic(); read != 7 || written != 3 {
+		t.Fatalf("transport counted %d bytes read and %d written, expected 7 and 3", read, written)
+	}
+}
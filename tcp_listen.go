@@ -0,0 +1,54 @@
+package torOnion
+
+import (
+	"errors"
+	"net"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+var errNonOnionListenBlocked = errors.New("listening on non-onion addresses is disabled")
+
+// listenTCP binds a clearnet TCP listener on laddr so that a transport
+// which also dials TCP addresses accepts connections from peers not
+// using tor. These connections bypass tor entirely: the peer learns the
+// host's address and the listener reports the peer's. WithMaxConns,
+// WithAcceptFilter and WithAcceptQueue apply as for onion services,
+// options specific to onion services are ignored.
+func (t *OnionTransport) listenTCP(laddr ma.Multiaddr, opts ...ListenOption) (*OnionListener, error) {
+	var cfg listenConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	netaddr, err := manet.ToNetAddr(laddr)
+	if err != nil {
+		return nil, err
+	}
+	local, err := net.Listen(netaddr.Network(), netaddr.String())
+	if err != nil {
+		return nil, err
+	}
+	// the bound port replaces port 0
+	bound, err := manet.FromNetAddr(local.Addr())
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	listener := OnionListener{
+		laddr:     bound,
+		listener:  local,
+		target:    local.Addr().String(),
+		limiter:   newConnLimiter(cfg.maxConns, cfg.limitPolicy),
+		filter:    cfg.acceptFilter,
+		label:     cfg.label,
+		transport: t,
+	}
+	if err := t.addListener(&listener); err != nil {
+		local.Close()
+		return nil, err
+	}
+	listener.startAcceptQueue(cfg.queueSize, cfg.queueWorkers)
+	t.log().Info("listening on TCP without tor", "addr", bound)
+	return &listener, nil
+}
@@ -0,0 +1,69 @@
+package torOnion
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+func TestListenTCP(t *testing.T) {
+	laddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onlyOnion, err := NewSOCKSOnionTransport("tcp4", "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer onlyOnion.Close()
+	if _, err := onlyOnion.Listen(laddr); err != errNonOnionListenBlocked {
+		t.Fatalf("expected errNonOnionListenBlocked, got %v", err)
+	}
+
+	// no tor is needed to listen on TCP
+	tpt, err := NewSOCKSOnionTransport("tcp4", "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+	l, err := tpt.Listen(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if port, err := l.Multiaddr().ValueForProtocol(ma.P_TCP); err != nil || port == "0" {
+		t.Fatalf("listener multiaddr %s lacks the bound port", l.Multiaddr())
+	}
+
+	client, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	clientAddr, err := manet.FromNetAddr(client.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.RemoteMultiaddr().Equal(clientAddr) {
+		t.Fatalf("remote multiaddr %s, expected %s", conn.RemoteMultiaddr(), clientAddr)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("received %q", buf)
+	}
+}
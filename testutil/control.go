@@ -0,0 +1,893 @@
+// Package testutil provides fakes of the tor control port and SOCKS
+// port so that code using the onion transport can be tested without
+// running tor.
+package testutil
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yawning/bulb/utils/pkcs1"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	safeCookieServerKey = "Tor safe cookie authentication server-to-controller hash"
+	safeCookieClientKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// ControlServer is a minimal tor control port which handles the
+// commands issued by the transport: PROTOCOLINFO, AUTHCHALLENGE,
+// AUTHENTICATE, GETINFO, GETCONF, ADD_ONION, DEL_ONION,
+// ONION_CLIENT_AUTH_ADD, SETEVENTS, EXTENDCIRCUIT, ATTACHSTREAM and
+// CLOSECIRCUIT. Onion services are only recorded, a SOCKSServer whose
+// Control field is set connects to them. If Conf sets
+// __LeaveStreamsUnattached to 1 the SOCKSServer reports its streams in
+// STREAM events and waits for them to be attached.
+type ControlServer struct {
+	// AuthMethods is the PROTOCOLINFO auth method list, NULL by
+	// default, see SetAuthMethods to change it once the server is in use
+	AuthMethods string
+	// Password is accepted by AUTHENTICATE when set, see SetPassword
+	// to change it once the server is in use
+	Password string
+	// CookieFile holds the SAFECOOKIE cookie, see EnableCookieAuth
+	CookieFile string
+	// Version is the reported tor version, 0.4.8.9 by default
+	Version string
+	// RejectUnixTargets makes ADD_ONION fail for unix socket targets
+	// like tor versions without support for them
+	RejectUnixTargets bool
+	// NonAnonymous makes tor run in non-anonymous hidden service mode,
+	// accepting only single onion services
+	NonAnonymous bool
+	// HSDirs is the number of HSDirs the two descriptors of a new
+	// onion service are uploaded to, half each, reported in HS_DESC
+	// events. The first RejectingHSDirs of them reject it, see
+	// SetRejectingHSDirs to change it once the server is in use.
+	HSDirs          int
+	RejectingHSDirs int
+	// Conf holds the values GETCONF reports by option, unset options
+	// have none, see SetConf to change it once the server is in use
+	Conf map[string][]string
+
+	ln     net.Listener
+	cookie []byte
+
+	mtx sync.Mutex
+	// socksAddr is reported as the SOCKS listener
+	socksAddr string
+	// bootstrap is the reported bootstrap progress in percent and
+	// bootstrapWarning the problem reported with it, if any
+	bootstrap        int
+	bootstrapWarning string
+	// onions maps the registered onion services to their targets by
+	// virtual port
+	onions   map[string]map[string]string
+	requests map[string]int
+	commands []string
+	// lines are the command lines received, with their arguments
+	lines []string
+	// clientAuth holds the ClientAuthV3 keys of private onion services
+	clientAuth map[string][]string
+	// clientKeys holds the x25519 private keys registered with
+	// ONION_CLIENT_AUTH_ADD by onion service
+	clientKeys map[string][]byte
+	// streams and circuits are reported by stream-status and
+	// circuit-status
+	streams  []string
+	circuits []string
+	// conns are the open control connections with their write locks
+	conns map[net.Conn]*sync.Mutex
+	// events holds the events each connection subscribed to
+	events map[net.Conn]map[string]bool
+	// circuitCount and streamCount number circuits and streams, and
+	// unattached holds the streams waiting for ATTACHSTREAM
+	circuitCount int
+	streamCount  int
+	unattached   map[string]chan string
+	// owners are the connections which added onion services without
+	// the Detach flag
+	owners map[string]net.Conn
+}
+
+// NewControlServer starts a ControlServer on the IPv4 loopback which
+// is shut down when the test finishes
+func NewControlServer(t testing.TB) *ControlServer {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveControl(t, ln)
+}
+
+// NewUnixControlServer starts a ControlServer on the unix socket addr,
+// either a path or on Linux an abstract socket name starting with "@"
+func NewUnixControlServer(t testing.TB, addr string) *ControlServer {
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveControl(t, ln)
+}
+
+func serveControl(t testing.TB, ln net.Listener) *ControlServer {
+	s := &ControlServer{
+		AuthMethods: "NULL",
+		Version:     "0.4.8.9",
+		ln:          ln,
+		bootstrap:   100,
+		onions:      make(map[string]map[string]string),
+		requests:    make(map[string]int),
+		clientAuth:  make(map[string][]string),
+		clientKeys:  make(map[string][]byte),
+		conns:       make(map[net.Conn]*sync.Mutex),
+		events:      make(map[net.Conn]map[string]bool),
+		unattached:  make(map[string]chan string),
+		owners:      make(map[string]net.Conn),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Addr returns the address of the control port
+func (s *ControlServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops accepting control connections. Open connections are
+// left alone, use Restart to drop them.
+func (s *ControlServer) Close() error {
+	return s.ln.Close()
+}
+
+// EnableCookieAuth makes the server require SAFECOOKIE authentication
+// with a cookie written to a temporary CookieFile
+func (s *ControlServer) EnableCookieAuth(t testing.TB) {
+	s.cookie = make([]byte, 32)
+	rand.Read(s.cookie)
+	s.CookieFile = filepath.Join(t.TempDir(), "control_auth_cookie")
+	if err := ioutil.WriteFile(s.CookieFile, s.cookie, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.AuthMethods = "COOKIE,SAFECOOKIE"
+}
+
+// SetPassword changes the password accepted by AUTHENTICATE
+func (s *ControlServer) SetPassword(password string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.Password = password
+}
+
+// SetAuthMethods changes the PROTOCOLINFO auth method list
+func (s *ControlServer) SetAuthMethods(methods string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.AuthMethods = methods
+}
+
+// SetRejectingHSDirs changes the number of HSDirs rejecting the
+// descriptors of new onion services
+func (s *ControlServer) SetRejectingHSDirs(n int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.RejectingHSDirs = n
+}
+
+// SetConf replaces the values GETCONF reports
+func (s *ControlServer) SetConf(conf map[string][]string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.Conf = conf
+}
+
+// SetSOCKSAddr sets the SOCKS listener reported to clients, none by
+// default
+func (s *ControlServer) SetSOCKSAddr(addr string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.socksAddr = addr
+}
+
+// SetBootstrap sets the reported bootstrap progress, 100 by default
+func (s *ControlServer) SetBootstrap(progress int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.bootstrap = progress
+}
+
+// SetBootstrapWarning makes the bootstrap phase report warning, as tor
+// does when it has trouble connecting to the network. An empty warning
+// clears it.
+func (s *ControlServer) SetBootstrapWarning(warning string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.bootstrapWarning = warning
+}
+
+// AddStream adds a line to the stream-status reply
+func (s *ControlServer) AddStream(line string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.streams = append(s.streams, line)
+}
+
+// AddCircuit adds a line to the circuit-status reply
+func (s *ControlServer) AddCircuit(line string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.circuits = append(s.circuits, line)
+}
+
+// HasOnion reports whether the onion service id is registered
+func (s *ControlServer) HasOnion(id string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.onions[id]
+	return ok
+}
+
+// OnionTarget returns the target the onion service id forwards its
+// virtual port to, either a TCP address or "unix:" and a socket path
+func (s *ControlServer) OnionTarget(id string, port int) (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	target, ok := s.onions[id][strconv.Itoa(port)]
+	return target, ok
+}
+
+// ClientAuth returns the ClientAuthV3 keys of the onion service id
+func (s *ControlServer) ClientAuth(id string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]string(nil), s.clientAuth[id]...)
+}
+
+// RequestCount returns how often a command line was received
+func (s *ControlServer) RequestCount(cmd string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests[cmd]
+}
+
+// Commands returns the commands received so far, without arguments
+func (s *ControlServer) Commands() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// CommandLines returns the command lines received so far for cmd,
+// with their arguments
+func (s *ControlServer) CommandLines(cmd string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var lines []string
+	for _, line := range s.lines {
+		if strings.HasPrefix(line, cmd+" ") || line == cmd {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Restart simulates tor restarting: all control connections are
+// dropped along with their onion services and the SOCKS listener
+// moves to socksAddr
+func (s *ControlServer) Restart(socksAddr string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.onions = make(map[string]map[string]string)
+	s.owners = make(map[string]net.Conn)
+	s.socksAddr = socksAddr
+}
+
+func (s *ControlServer) serve(conn net.Conn) {
+	writeMtx := new(sync.Mutex)
+	s.mtx.Lock()
+	s.conns[conn] = writeMtx
+	s.mtx.Unlock()
+	defer func() {
+		conn.Close()
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		delete(s.events, conn)
+		// onion services go away with the connection which added
+		// them unless they were detached
+		for id, owner := range s.owners {
+			if owner == conn {
+				delete(s.onions, id)
+				delete(s.owners, id)
+			}
+		}
+		s.mtx.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	var clientHash []byte
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		s.mtx.Lock()
+		s.requests[strings.Join(args, " ")]++
+		s.commands = append(s.commands, args[0])
+		s.lines = append(s.lines, strings.Join(args, " "))
+		authMethods, password := s.AuthMethods, s.Password
+		s.mtx.Unlock()
+
+		var reply string
+		switch args[0] {
+		case "PROTOCOLINFO":
+			reply = "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=" + authMethods
+			if s.CookieFile != "" {
+				reply += " COOKIEFILE=" + strconv.Quote(s.CookieFile)
+			}
+			reply += "\r\n250-VERSION Tor=" + strconv.Quote(s.Version) + "\r\n250 OK\r\n"
+		case "AUTHCHALLENGE":
+			if len(args) != 3 || s.cookie == nil {
+				reply = "513 Invalid AUTHCHALLENGE\r\n"
+				break
+			}
+			clientNonce, _ := hex.DecodeString(args[2])
+			serverNonce := make([]byte, 32)
+			rand.Read(serverNonce)
+			msg := append(append(append([]byte{}, s.cookie...), clientNonce...), serverNonce...)
+			clientHash = safeCookieHash(safeCookieClientKey, msg)
+			reply = fmt.Sprintf("250 AUTHCHALLENGE SERVERHASH=%X SERVERNONCE=%X\r\n",
+				safeCookieHash(safeCookieServerKey, msg), serverNonce)
+		case "AUTHENTICATE":
+			reply = "515 Authentication failed\r\n"
+			switch {
+			case len(args) == 1 && strings.Contains(authMethods, "NULL"):
+				reply = "250 OK\r\n"
+			case len(args) == 2 && clientHash != nil:
+				if h, _ := hex.DecodeString(args[1]); hmac.Equal(h, clientHash) {
+					reply = "250 OK\r\n"
+				}
+			case len(args) >= 2 && password != "":
+				rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "AUTHENTICATE"))
+				if got, ok := unquoteControlString(rest); ok && got == password {
+					reply = "250 OK\r\n"
+				}
+			}
+		case "GETINFO":
+			reply = s.getInfo(args[1:])
+		case "GETCONF":
+			reply = s.getConf(args[1:])
+		case "ADD_ONION":
+			reply = s.addOnion(args[1:])
+		case "DEL_ONION":
+			reply = s.delOnion(args[1:])
+		case "ONION_CLIENT_AUTH_ADD":
+			reply = s.addClientKey(args[1:])
+		case "SETEVENTS":
+			reply = s.setEvents(conn, args[1:])
+		case "EXTENDCIRCUIT":
+			reply = s.extendCircuit(args[1:])
+		case "ATTACHSTREAM":
+			reply = s.attachStream(args[1:])
+		case "CLOSECIRCUIT":
+			reply = "250 OK\r\n"
+		default:
+			reply = "510 Unrecognized command\r\n"
+		}
+		writeMtx.Lock()
+		_, err = conn.Write([]byte(reply))
+		writeMtx.Unlock()
+		if err != nil {
+			return
+		}
+		if args[0] == "ADD_ONION" && strings.HasPrefix(reply, "250-ServiceID=") {
+			id := strings.TrimPrefix(strings.SplitN(reply, "\r\n", 2)[0], "250-ServiceID=")
+			if !strings.Contains(line, "Detach") {
+				s.own(conn, id)
+			}
+			go s.uploadDescriptor(id)
+		}
+		if args[0] == "EXTENDCIRCUIT" && strings.HasPrefix(reply, "250 EXTENDED ") {
+			id := strings.TrimSpace(strings.TrimPrefix(reply, "250 EXTENDED "))
+			go s.emit("CIRC", fmt.Sprintf("650 CIRC %s LAUNCHED\r\n650 CIRC %s BUILT %s PURPOSE=GENERAL\r\n", id, id, args[2]))
+		}
+	}
+}
+
+func (s *ControlServer) addClientKey(args []string) string {
+	if len(args) != 2 || !strings.HasPrefix(args[1], "x25519:") {
+		return "512 Invalid argument\r\n"
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(args[1], "x25519:"))
+	if err != nil || len(key) != 32 {
+		return "512 Failed to decode x25519 private key\r\n"
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.clientKeys[args[0]] = key
+	return "250 OK\r\n"
+}
+
+// clientAuthReply returns the SOCKS reply tor sends when a client
+// connects to the onion service id: 0 if it is public or the client
+// registered an authorized key, 0xF4 if it registered none and 0xF5 if
+// the service does not accept its key
+func (s *ControlServer) clientAuthReply(id string) byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	authorized := s.clientAuth[id]
+	if len(authorized) == 0 {
+		return 0
+	}
+	key, ok := s.clientKeys[id]
+	if !ok {
+		return 0xF4
+	}
+	pub, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return 0xF5
+	}
+	for _, client := range authorized {
+		if client == base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(pub) {
+			return 0
+		}
+	}
+	return 0xF5
+}
+
+func (s *ControlServer) setEvents(conn net.Conn, events []string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	subscribed := make(map[string]bool)
+	for _, event := range events {
+		switch event {
+		case "HS_DESC", "CIRC", "STREAM":
+			subscribed[event] = true
+		default:
+			return fmt.Sprintf("552 Unrecognized event \"%s\"\r\n", event)
+		}
+	}
+	s.events[conn] = subscribed
+	return "250 OK\r\n"
+}
+
+// emit sends the lines of an event to the connections subscribed to it
+func (s *ControlServer) emit(event, lines string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for conn, subscribed := range s.events {
+		if !subscribed[event] {
+			continue
+		}
+		writeMtx := s.conns[conn]
+		writeMtx.Lock()
+		conn.Write([]byte(lines))
+		writeMtx.Unlock()
+	}
+}
+
+// extendCircuit handles EXTENDCIRCUIT 0 <path>, the circuit is reported
+// built right away
+func (s *ControlServer) extendCircuit(args []string) string {
+	if len(args) != 2 || args[0] != "0" {
+		return "512 Invalid argument\r\n"
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.circuitCount++
+	return fmt.Sprintf("250 EXTENDED %d\r\n", s.circuitCount)
+}
+
+// newStream reports a stream to target opened from source in a STREAM
+// event if streams are left unattached, and waits for it to be attached.
+// It returns false if the stream was not attached in time.
+func (s *ControlServer) newStream(target, source string) bool {
+	s.mtx.Lock()
+	if leave := s.Conf["__LeaveStreamsUnattached"]; len(leave) == 0 || leave[0] != "1" {
+		s.mtx.Unlock()
+		return true
+	}
+	attached := make(chan string, 1)
+	s.streamCount++
+	id := strconv.Itoa(s.streamCount)
+	s.unattached[id] = attached
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.unattached, id)
+		s.mtx.Unlock()
+	}()
+	s.emit("STREAM", fmt.Sprintf("650 STREAM %s NEW 0 %s SOURCE_ADDR=%s PURPOSE=USER\r\n", id, target, source))
+	select {
+	case <-attached:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+// attachStream handles ATTACHSTREAM <stream id> <circuit id>
+func (s *ControlServer) attachStream(args []string) string {
+	if len(args) != 2 {
+		return "512 Invalid argument\r\n"
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	attached, ok := s.unattached[args[0]]
+	if !ok {
+		return fmt.Sprintf("552 Unknown stream \"%s\"\r\n", args[0])
+	}
+	if n, err := strconv.Atoi(args[1]); err != nil || n < 1 || n > s.circuitCount {
+		return fmt.Sprintf("552 Unknown circuit \"%s\"\r\n", args[1])
+	}
+	select {
+	case attached <- args[1]:
+	default:
+		return "555 Connection is not managed by controller.\r\n"
+	}
+	return "250 OK\r\n"
+}
+
+// uploadDescriptor sends the HS_DESC events of uploading the two
+// descriptors of the onion service id to the subscribed connections.
+// They are uploaded one after the other, as tor may do, each to half of
+// the HSDirs.
+func (s *ControlServer) uploadDescriptor(id string) {
+	s.mtx.Lock()
+	hsDirs, rejecting := s.HSDirs, s.RejectingHSDirs
+	s.mtx.Unlock()
+	for d := 0; d < 2; d++ {
+		first, last := d*hsDirs/2, (d+1)*hsDirs/2
+		if first == last {
+			continue
+		}
+		var events string
+		for i := first; i < last; i++ {
+			events += fmt.Sprintf("650 HS_DESC UPLOAD %s UNKNOWN $%040X~hsdir%d %s%d HSDIR_INDEX=%064X\r\n", id, i, i, id, d, i)
+		}
+		for i := first; i < last; i++ {
+			if i < rejecting {
+				events += fmt.Sprintf("650 HS_DESC FAILED %s UNKNOWN $%040X~hsdir%d REASON=UPLOAD_REJECTED\r\n", id, i, i)
+			} else {
+				events += fmt.Sprintf("650 HS_DESC UPLOADED %s UNKNOWN $%040X~hsdir%d\r\n", id, i, i)
+			}
+		}
+		s.emit("HS_DESC", events)
+	}
+}
+
+func (s *ControlServer) getInfo(args []string) string {
+	if len(args) == 0 {
+		return "512 Missing argument\r\n"
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var reply string
+	for _, key := range args {
+		value, ok := s.getInfoValue(key)
+		if !ok {
+			return fmt.Sprintf("552 Unrecognized key \"%s\"\r\n", key)
+		}
+		reply += value
+	}
+	return reply + "250 OK\r\n"
+}
+
+// getInfoValue returns the reply lines for a GETINFO key, without the
+// final status line
+func (s *ControlServer) getInfoValue(key string) (string, bool) {
+	switch key {
+	case "version":
+		return "250-version=" + s.Version + "\r\n", true
+	case "net/listeners/socks":
+		if s.socksAddr == "" {
+			return "250-net/listeners/socks=\r\n", true
+		}
+		return fmt.Sprintf("250-net/listeners/socks=%q\r\n", s.socksAddr), true
+	case "status/bootstrap-phase":
+		if s.bootstrapWarning != "" {
+			return fmt.Sprintf("250-status/bootstrap-phase=WARN BOOTSTRAP PROGRESS=%d TAG=conn SUMMARY=\"Connecting to a relay\" WARNING=%q REASON=NOROUTE COUNT=3 RECOMMENDATION=warn\r\n", s.bootstrap, s.bootstrapWarning), true
+		}
+		return fmt.Sprintf("250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=%d TAG=done SUMMARY=\"Done\"\r\n", s.bootstrap), true
+	case "stream-status", "circuit-status":
+		lines := s.streams
+		if key == "circuit-status" {
+			lines = s.circuits
+		}
+		var reply string
+		for _, line := range lines {
+			reply += line + "\r\n"
+		}
+		return "250+" + key + "=\r\n" + reply + ".\r\n", true
+	case "onions/current":
+		var ids []string
+		for id := range s.onions {
+			ids = append(ids, id)
+		}
+		if len(ids) <= 1 {
+			return fmt.Sprintf("250-onions/current=%s\r\n", strings.Join(ids, "")), true
+		}
+		return fmt.Sprintf("250+onions/current=\r\n%s\r\n.\r\n", strings.Join(ids, "\r\n")), true
+	}
+	return "", false
+}
+
+func (s *ControlServer) getConf(args []string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var lines []string
+	for _, key := range args {
+		values := s.Conf[key]
+		if len(values) == 0 {
+			lines = append(lines, key)
+		}
+		for _, value := range values {
+			lines = append(lines, key+"="+value)
+		}
+	}
+	if len(lines) == 0 {
+		return "250 OK\r\n"
+	}
+	// the last line ends the reply
+	var reply string
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		reply += "250" + sep + line + "\r\n"
+	}
+	return reply
+}
+
+func (s *ControlServer) addOnion(args []string) string {
+	if len(args) < 2 {
+		return "512 Missing argument\r\n"
+	}
+	var clients []string
+	var nonAnonymous, discardPK bool
+	ports := make(map[string]string)
+	for _, arg := range args[1:] {
+		switch {
+		case strings.HasPrefix(arg, "Flags="):
+			for _, flag := range strings.Split(strings.TrimPrefix(arg, "Flags="), ",") {
+				nonAnonymous = nonAnonymous || flag == "NonAnonymous"
+				discardPK = discardPK || flag == "DiscardPK"
+			}
+		case strings.HasPrefix(arg, "ClientAuthV3="):
+			clients = append(clients, strings.TrimPrefix(arg, "ClientAuthV3="))
+		case strings.HasPrefix(arg, "Port="):
+			virtPort := strings.TrimPrefix(arg, "Port=")
+			target := virtPort
+			if i := strings.IndexByte(virtPort, ','); i >= 0 {
+				virtPort, target = virtPort[:i], virtPort[i+1:]
+			}
+			if s.RejectUnixTargets && strings.HasPrefix(target, "unix:") {
+				return "512 Invalid VIRTPORT/TARGET\r\n"
+			}
+			ports[virtPort] = target
+		}
+	}
+	if len(ports) == 0 {
+		return "512 Missing 'Port' argument\r\n"
+	}
+	if nonAnonymous && !s.NonAnonymous {
+		return "512 Tor is in anonymous hidden service mode\r\n"
+	}
+	if !nonAnonymous && s.NonAnonymous {
+		return "512 Tor is in non-anonymous hidden service mode\r\n"
+	}
+	if strings.HasPrefix(args[0], "ED25519-V3:") {
+		return s.addOnionV3(args[0], ports, clients)
+	}
+	if len(clients) != 0 {
+		return "512 ClientAuthV3 requires a v3 onion service\r\n"
+	}
+	var key *rsa.PrivateKey
+	var generated bool
+	switch {
+	case args[0] == "NEW:RSA1024":
+		k, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			return "551 Failed to generate key\r\n"
+		}
+		key, generated = k, true
+	case strings.HasPrefix(args[0], "RSA1024:"):
+		der, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(args[0], "RSA1024:"))
+		if err != nil {
+			return "513 Invalid key blob\r\n"
+		}
+		key, _, err = pkcs1.DecodePrivateKeyDER(der)
+		if err != nil {
+			return "513 Invalid key blob\r\n"
+		}
+	default:
+		return "513 Invalid key type\r\n"
+	}
+	id, err := pkcs1.OnionAddr(&key.PublicKey)
+	if err != nil {
+		return "551 Failed to derive onion ID\r\n"
+	}
+	if !s.registerOnion(id, ports) {
+		return "550 Onion address collision\r\n"
+	}
+	reply := fmt.Sprintf("250-ServiceID=%s\r\n", id)
+	if generated && !discardPK {
+		der, _ := pkcs1.EncodePrivateKeyDER(key)
+		reply += fmt.Sprintf("250-PrivateKey=RSA1024:%s\r\n", base64.StdEncoding.EncodeToString(der))
+	}
+	return reply + "250 OK\r\n"
+}
+
+func (s *ControlServer) addOnionV3(keyArg string, ports map[string]string, clients []string) string {
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(keyArg, "ED25519-V3:"))
+	if err != nil || len(blob) != 64 {
+		return "513 Invalid key blob\r\n"
+	}
+	id := onionV3Address(expandedPublicKey(blob[:32]))
+	if !s.registerOnion(id, ports) {
+		return "550 Onion address collision\r\n"
+	}
+	if len(clients) != 0 {
+		s.mtx.Lock()
+		s.clientAuth[id] = clients
+		s.mtx.Unlock()
+	}
+	return fmt.Sprintf("250-ServiceID=%s\r\n250 OK\r\n", id)
+}
+
+// registerOnion records a new onion service, returning false if it
+// is already registered
+func (s *ControlServer) registerOnion(id string, ports map[string]string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.onions[id]; ok {
+		return false
+	}
+	s.onions[id] = ports
+	return true
+}
+
+func (s *ControlServer) delOnion(args []string) string {
+	if len(args) != 1 {
+		return "512 Missing argument\r\n"
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.onions[args[0]]; !ok {
+		return "552 Unknown Onion Service id\r\n"
+	}
+	delete(s.onions, args[0])
+	delete(s.owners, args[0])
+	return "250 OK\r\n"
+}
+
+// own ties the onion service id to the connection which added it
+func (s *ControlServer) own(conn net.Conn, id string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.owners[id] = conn
+}
+
+func safeCookieHash(key string, msg []byte) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// unquoteControlString decodes a QuotedString in which, as for tor, a
+// backslash escapes the following byte
+func unquoteControlString(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s)-1 {
+				return "", false
+			}
+		case '"':
+			return "", false
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), true
+}
+
+// onionV3Address derives the v3 onion address of an ed25519 public key
+// independently of the transport's implementation
+func onionV3Address(pub []byte) string {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pub)
+	h.Write([]byte{0x03})
+	b := append(append(append([]byte{}, pub...), h.Sum(nil)[:2]...), 0x03)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+// The ed25519 curve -x^2 + y^2 = 1 + d x^2 y^2 over GF(2^255 - 19) and
+// its base point
+var (
+	edP     = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	edD     = new(big.Int).Mod(new(big.Int).Mul(big.NewInt(-121665), new(big.Int).ModInverse(big.NewInt(121666), edP)), edP)
+	edBx, _ = new(big.Int).SetString("15112221349535400772501151409588531511454012693041857206046113283949847762202", 10)
+	edBy, _ = new(big.Int).SetString("46316835694926478169428394003475163141307993866256225615783033603165251855960", 10)
+)
+
+// expandedPublicKey derives the ed25519 public key of the secret scalar
+// of an expanded private key, as tor stores them. It is slow, but it
+// only serves the few keys of a test.
+func expandedPublicKey(scalar []byte) []byte {
+	// the scalar is clamped and little-endian
+	k := append([]byte{}, scalar...)
+	k[0] &= 248
+	k[31] &= 127
+	k[31] |= 64
+	for i, j := 0, len(k)-1; i < j; i, j = i+1, j-1 {
+		k[i], k[j] = k[j], k[i]
+	}
+	n := new(big.Int).SetBytes(k)
+
+	x, y := big.NewInt(0), big.NewInt(1)
+	for i := n.BitLen() - 1; i >= 0; i-- {
+		x, y = edAdd(x, y, x, y)
+		if n.Bit(i) == 1 {
+			x, y = edAdd(x, y, edBx, edBy)
+		}
+	}
+	// the encoding is y, little-endian, with the sign of x in the top bit
+	pub := make([]byte, 32)
+	y.FillBytes(pub)
+	for i, j := 0, len(pub)-1; i < j; i, j = i+1, j-1 {
+		pub[i], pub[j] = pub[j], pub[i]
+	}
+	pub[31] |= byte(x.Bit(0)) << 7
+	return pub
+}
+
+// edAdd adds two points of the ed25519 curve in affine coordinates
+func edAdd(x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
+	mul := func(a, b *big.Int) *big.Int {
+		return new(big.Int).Mod(new(big.Int).Mul(a, b), edP)
+	}
+	t := mul(edD, mul(mul(x1, x2), mul(y1, y2)))
+	one := big.NewInt(1)
+	x := mul(new(big.Int).Add(mul(x1, y2), mul(y1, x2)), new(big.Int).ModInverse(new(big.Int).Add(one, t), edP))
+	y := mul(new(big.Int).Add(mul(y1, y2), mul(x1, x2)), new(big.Int).ModInverse(new(big.Int).Mod(new(big.Int).Sub(one, t), edP), edP))
+	return x, y
+}
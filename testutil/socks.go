@@ -0,0 +1,267 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// SOCKSServer is a minimal SOCKS5 proxy which records the requested
+// targets. Streams to onion services registered on Control are
+// forwarded to the service's target, all other streams echo back
+// everything written to them.
+type SOCKSServer struct {
+	// Control, if set, resolves onion services to their targets
+	Control *ControlServer
+	// Stall makes the proxy hang before answering the CONNECT request
+	Stall bool
+	// Reply is the CONNECT reply code, success by default
+	Reply byte
+	// FailFirst makes the first FailFirst CONNECT requests fail with
+	// "host unreachable", as tor does while circuits are being built
+	FailFirst int
+	// User and Password, if User is set, are required with
+	// username/password authentication
+	User     string
+	Password string
+
+	ln net.Listener
+
+	mtx     sync.Mutex
+	targets []string
+	active  int
+}
+
+// NewSOCKSServer starts a SOCKSServer on the IPv4 loopback which is
+// shut down when the test finishes
+func NewSOCKSServer(t testing.TB) *SOCKSServer {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveSOCKS(t, ln)
+}
+
+// NewSOCKSServer6 starts a SOCKSServer on the IPv6 loopback, skipping
+// the test if IPv6 is unavailable
+func NewSOCKSServer6(t testing.TB) *SOCKSServer {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	return serveSOCKS(t, ln)
+}
+
+func serveSOCKS(t testing.TB, ln net.Listener) *SOCKSServer {
+	s := &SOCKSServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Addr returns the address of the SOCKS port
+func (s *SOCKSServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops accepting SOCKS connections
+func (s *SOCKSServer) Close() error {
+	return s.ln.Close()
+}
+
+// LastTarget returns the target of the last CONNECT request
+func (s *SOCKSServer) LastTarget() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.targets) == 0 {
+		return ""
+	}
+	return s.targets[len(s.targets)-1]
+}
+
+// Requests returns the number of CONNECT requests received
+func (s *SOCKSServer) Requests() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.targets)
+}
+
+// ActiveConns returns the number of proxy connections still open
+func (s *SOCKSServer) ActiveConns() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.active
+}
+
+// authenticate runs the username/password subnegotiation (RFC 1929)
+func (s *SOCKSServer) authenticate(conn net.Conn) bool {
+	readField := func() (string, bool) {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return "", false
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		return false
+	}
+	user, ok := readField()
+	if !ok {
+		return false
+	}
+	password, ok := readField()
+	if !ok {
+		return false
+	}
+	if user != s.User || password != s.Password {
+		conn.Write([]byte{1, 1})
+		return false
+	}
+	_, err := conn.Write([]byte{1, 0})
+	return err == nil
+}
+
+func (s *SOCKSServer) serve(conn net.Conn) {
+	s.mtx.Lock()
+	s.active++
+	s.mtx.Unlock()
+	defer func() {
+		conn.Close()
+		s.mtx.Lock()
+		s.active--
+		s.mtx.Unlock()
+	}()
+
+	// method negotiation, either "no authentication" or
+	// username/password if credentials are required
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if s.User != "" {
+		if !bytes.Contains(methods, []byte{2}) {
+			conn.Write([]byte{5, 0xff})
+			return
+		}
+		if _, err := conn.Write([]byte{5, 2}); err != nil {
+			return
+		}
+		if !s.authenticate(conn) {
+			return
+		}
+	} else if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// CONNECT request
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	default:
+		return
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+	port := int(binary.BigEndian.Uint16(b))
+	s.mtx.Lock()
+	s.targets = append(s.targets, net.JoinHostPort(host, strconv.Itoa(port)))
+	failed := len(s.targets) <= s.FailFirst
+	s.mtx.Unlock()
+
+	if s.Stall {
+		// hold the request until the client goes away
+		io.Copy(io.Discard, conn)
+		return
+	}
+
+	var upstream net.Conn
+	reply := s.Reply
+	if failed {
+		reply = 4
+	}
+	if reply == 0 && s.Control != nil && !s.Control.newStream(net.JoinHostPort(host, strconv.Itoa(port)), conn.RemoteAddr().String()) {
+		// 0x01 is "general failure", the stream was never attached
+		reply = 1
+	}
+	if id := strings.TrimSuffix(host, ".onion"); reply == 0 && s.Control != nil && id != host {
+		// 0x04 is "host unreachable", tor's reply for unknown services
+		reply = 4
+		if target, ok := s.Control.OnionTarget(id, port); ok {
+			// private services require an authorized client key
+			if reply = s.Control.clientAuthReply(id); reply == 0 {
+				reply = 4
+				network := "tcp"
+				if strings.HasPrefix(target, "unix:") {
+					network, target = "unix", strings.TrimPrefix(target, "unix:")
+				}
+				if c, err := net.Dial(network, target); err == nil {
+					upstream, reply = c, 0
+					defer upstream.Close()
+				}
+			}
+		}
+	}
+	if _, err := conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	if reply != 0 {
+		return
+	}
+	if upstream == nil {
+		io.Copy(conn, conn)
+		return
+	}
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+}
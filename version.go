@@ -0,0 +1,116 @@
+package torOnion
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yawning/bulb"
+)
+
+// TorVersion is the version of a running tor, such as 0.4.8.9
+type TorVersion struct {
+	Major, Minor, Micro, Patch int
+	// Status is the release status tag, for instance "alpha" or
+	// "rc", and empty for stable releases
+	Status string
+}
+
+// Minimum tor versions of features depending on tor's support
+var (
+	v3OnionMinVersion            = TorVersion{Major: 0, Minor: 3, Micro: 5, Patch: 7}
+	clientAuthAddMinVersion      = TorVersion{Major: 0, Minor: 4, Micro: 3, Patch: 1}
+	addOnionClientAuthMinVersion = TorVersion{Major: 0, Minor: 4, Micro: 6, Patch: 1}
+)
+
+// String formats v the way tor does
+func (v TorVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Micro, v.Patch)
+	if v.Status != "" {
+		s += "-" + v.Status
+	}
+	return s
+}
+
+// AtLeast reports whether v is min or newer. The status tag is not
+// compared.
+func (v TorVersion) AtLeast(min TorVersion) bool {
+	a := [4]int{v.Major, v.Minor, v.Micro, v.Patch}
+	b := [4]int{min.Major, min.Minor, min.Micro, min.Patch}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return true
+}
+
+// parseTorVersion parses a version as reported by GETINFO version, for
+// instance "0.4.8.9" or "0.4.9.1-alpha-dev (git-5a2f6c3e3d2e0a9b)"
+func parseTorVersion(s string) (TorVersion, error) {
+	var v TorVersion
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return v, fmt.Errorf("malformed tor version %q", s)
+	}
+	version := fields[0]
+	if i := strings.IndexByte(version, '-'); i >= 0 {
+		version, v.Status = version[:i], version[i+1:]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) < 3 || len(parts) > 4 {
+		return v, fmt.Errorf("malformed tor version %q", s)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Micro, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("malformed tor version %q", s)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// queryTorVersion asks tor for its version on conn
+func queryTorVersion(conn *bulb.Conn) (TorVersion, error) {
+	resp, err := conn.Request("GETINFO version")
+	if err != nil {
+		return TorVersion{}, fmt.Errorf("failed to query tor version: %v", err)
+	}
+	for _, data := range resp.Data {
+		if _, v, ok := cutInfoKey(data, []string{"version"}); ok {
+			return parseTorVersion(v)
+		}
+	}
+	return TorVersion{}, errors.New("GETINFO version reply is missing the version")
+}
+
+// TorVersion returns the version of the tor the transport controls. It
+// is not known for dial-only transports.
+func (t *OnionTransport) TorVersion() (TorVersion, bool) {
+	t.controlMtx.Lock()
+	defer t.controlMtx.Unlock()
+	if t.torVersion == nil {
+		return TorVersion{}, false
+	}
+	return *t.torVersion, true
+}
+
+// setTorVersion records the version of the tor the transport controls
+func (t *OnionTransport) setTorVersion(v TorVersion) {
+	t.controlMtx.Lock()
+	defer t.controlMtx.Unlock()
+	t.torVersion = &v
+}
+
+// requireTorVersion fails with a descriptive error if tor is known to be
+// older than min, which feature requires
+func (t *OnionTransport) requireTorVersion(min TorVersion, feature string) error {
+	v, ok := t.TorVersion()
+	if !ok || v.AtLeast(min) {
+		return nil
+	}
+	return fmt.Errorf("%s require Tor >= %s, running %s", feature, min, v)
+}
@@ -0,0 +1,68 @@
+package torOnion
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/OpenBazaar/go-onion-transport/testutil"
+)
+
+func TestParseTorVersion(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want TorVersion
+	}{
+		{"0.4.8.9", TorVersion{0, 4, 8, 9, ""}},
+		{"0.4.9.1-alpha-dev (git-5a2f6c3e3d2e0a9b)", TorVersion{0, 4, 9, 1, "alpha-dev"}},
+		{"0.3.5", TorVersion{0, 3, 5, 0, ""}},
+	} {
+		v, err := parseTorVersion(tc.in)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", tc.in, err)
+		}
+		if v != tc.want {
+			t.Fatalf("parsed %q as %v, expected %v", tc.in, v, tc.want)
+		}
+	}
+	for _, in := range []string{"", "tor", "0.4", "0.4.x.9", "0.4.8.9.1"} {
+		if _, err := parseTorVersion(in); err == nil {
+			t.Fatalf("parsed malformed version %q", in)
+		}
+	}
+
+	if !(TorVersion{0, 4, 8, 9, ""}).AtLeast(v3OnionMinVersion) {
+		t.Fatal("0.4.8.9 is not at least 0.3.5.7")
+	}
+	if (TorVersion{0, 3, 4, 9, ""}).AtLeast(v3OnionMinVersion) {
+		t.Fatal("0.3.4.9 is at least 0.3.5.7")
+	}
+}
+
+func TestOldTorVersion(t *testing.T) {
+	fc := testutil.NewControlServer(t)
+	fc.Version = "0.3.4.9"
+	tpt, err := NewOnionTransport("tcp4", fc.Addr(), "", nil, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpt.Close()
+
+	v, ok := tpt.TorVersion()
+	if !ok || v.String() != "0.3.4.9" {
+		t.Fatalf("unexpected tor version %v", v)
+	}
+	_, err = tpt.ListenEphemeralV3(4003)
+	if err == nil || !strings.Contains(err.Error(), "v3 onion services require Tor >= 0.3.5.7") {
+		t.Fatalf("expected a descriptive version error, got %v", err)
+	}
+	if n := fc.RequestCount("GETINFO version"); n != 1 {
+		t.Fatalf("tor version queried %d times, expected once", n)
+	}
+
+	// v2 services work with old versions
+	l, err := tpt.ListenEphemeral(4003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}